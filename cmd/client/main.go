@@ -1,43 +1,304 @@
 package main
 
 import (
+    "crypto/tls"
+    "crypto/x509"
     "flag"
     "log"
+    "net/url"
     "os"
     "os/signal"
+    "strings"
     "syscall"
+    "time"
 
     "github.com/euphoricair7/tun/internal/client"
+    "github.com/euphoricair7/tun/internal/flagutil"
+    "github.com/euphoricair7/tun/internal/noiseconn"
 )
 
+// Re-registering after a drain is retried, waiting twice as long after each
+// failure up to maxRetryDelay
+const (
+    firstRetryDelay = time.Second
+    maxRetryDelay   = 30 * time.Second
+)
+
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+    *l = append(*l, value)
+    return nil
+}
+
 func main() {
     // Command-line flags
     relayHost := flag.String("relay", "localhost", "Relay server hostname or IP")
     relayPort := flag.Int("relay-port", 5678, "Relay server registration port")
     localHost := flag.String("local-host", "localhost", "Local service hostname")
     localPort := flag.Int("local-port", 3000, "Local service port")
+    var forwardSpecs stringList
+    flag.Var(&forwardSpecs, "L", "Forward a local port to a host reachable from the relay, [bind_address:]port:host:hostport (repeatable)")
+    relayURL := flag.String("relay-url", "", "Reach the relay over WebSocket at this ws:// or wss:// URL instead of -relay and -relay-port")
+    relayQUIC := flag.String("relay-quic", "", "Reach the relay over QUIC at this host:port instead of -relay and -relay-port")
+    relayNoise := flag.String("relay-noise", "", "Reach the relay's Noise address at this host:port over an encrypted control connection, needs -relay-noise-key")
+    relayNoiseKey := flag.String("relay-noise-key", "", "Public key the relay prints for its Noise address")
+    proxy := flag.String("proxy", "", "Reach the relay through this http://, https:// or socks5:// proxy, with optional user:password@ (defaults to HTTPS_PROXY unless NO_PROXY matches)")
+    relayCA := flag.String("relay-ca", "", "PEM file of CA certificates to trust for a wss:// or QUIC relay (defaults to the system roots)")
+    token := flag.String("token", os.Getenv("TUN_TOKEN"), "Account token for relays with accounts (defaults to $TUN_TOKEN)")
+    publicPort := flag.Int("public-port", 0, "Public port to ask the relay for (0 takes any free port)")
+    hostname := flag.String("hostname", "", "Hostname to serve the tunnel under on the relay's shared HTTP address in HTTP mode")
+    reserve := flag.Bool("reserve", false, "Reserve the public port and hostname for this account on the relay for good")
+    release := flag.Bool("release", false, "Give up this account's reservation of the public port and hostname on the relay")
+    socksAddr := flag.String("socks", "", "Run a SOCKS5 proxy on this loopback address whose connections are dialed by the relay")
+    proxyProtocol := flag.Int("proxy-protocol", 0, "Send a PROXY protocol header of this version (1 or 2) to the local service, 0 disables")
+    allowCIDRs := flag.String("allow-cidr", "", "Comma-separated CIDRs allowed to reach the tunnel (empty allows everyone)")
+    denyCIDRs := flag.String("deny-cidr", "", "Comma-separated CIDRs denied from the tunnel")
+    maxConns := flag.Int("max-conns", 0, "Maximum concurrent user connections on the tunnel (0 leaves it to the relay)")
+    connRate := flag.Float64("conn-rate", 0, "Maximum new user connections per second from each source IP (0 leaves it to the relay)")
+    requestRate := flag.Float64("request-rate", 0, "Maximum requests per second in HTTP mode (0 leaves it to the relay)")
+    var inboundRate, outboundRate flagutil.ByteSize
+    flag.Var(&inboundRate, "inbound-rate", "Bandwidth from users towards the local service in bytes per second, e.g. 1M (0 leaves it to the relay)")
+    flag.Var(&outboundRate, "outbound-rate", "Bandwidth from the local service towards users in bytes per second, e.g. 1M (0 leaves it to the relay)")
+    e2eCert := flag.String("e2e-tls-cert", "", "Terminate TLS for public users in the client with this certificate file, so the relay only sees encrypted bytes (TCP tunnels)")
+    e2eKey := flag.String("e2e-tls-key", "", "TLS key file for -e2e-tls-cert")
+    compress := flag.Bool("compress", false, "Ask the relay to compress data between it and the client, for slow links")
+    compressThreshold := flag.Int("compress-threshold", 512, "Smallest data frame in bytes worth compressing with -compress")
+    readSize := flagutil.ByteSize(32 << 10)
+    flag.Var(&readSize, "read-size", "Bytes read from the local service at once, larger sizes mean fewer frames for bulk transfers, e.g. 64K (at most 1M)")
+    pool := flag.String("pool", "", "Share the tunnel with every client of the account registering this pool name, the relay spreads users over them")
+    poolSecret := flag.String("pool-secret", os.Getenv("TUN_POOL_SECRET"), "Secret every client of the -pool registers with, required on relays without accounts (defaults to $TUN_POOL_SECRET)")
+    balance := flag.String("balance", "", "How the relay spreads users over a -pool: round_robin, least_conn or random (defaults to round_robin)")
+    healthInterval := flag.Duration("health-interval", 0, "Probe the local service this often and have the relay turn users away while it is down (0 disables)")
+    healthTimeout := flag.Duration("health-timeout", 5*time.Second, "How long a local service health probe may take")
+    healthPath := flag.String("health-path", "", "Probe the local service with a GET of this path instead of only connecting")
+    healthStatus := flag.Int("health-status", 0, "Status -health-path must answer with (0 accepts any status below 400)")
+    httpMode := flag.Bool("http", false, "Register an HTTP tunnel, the relay adds X-Forwarded-* headers and applies header rules")
+    hostHeader := flag.String("host-header", "", "Host header sent to the local service in HTTP mode, \"rewrite\" for the local address")
+    var basicAuth stringList
+    flag.Var(&basicAuth, "basic-auth", "Require HTTP basic auth with these user:password credentials at the relay (repeatable)")
+    bearerToken := flag.String("bearer-token", "", "Require this bearer token at the relay in HTTP mode")
+    oidcAllow := flag.String("oidc-allow", "", "Comma-separated emails or @domains allowed to log in with the relay's OIDC provider in HTTP mode, needs -hostname")
+    var requestHeaders, responseHeaders stringList
+    flag.Var(&requestHeaders, "request-header", "Request header rule in HTTP mode, add:Name:Value, set:Name:Value or remove:Name (repeatable)")
+    flag.Var(&responseHeaders, "response-header", "Response header rule in HTTP mode, add:Name:Value, set:Name:Value or remove:Name (repeatable)")
     flag.Parse()
 
+    var tlsConfig *tls.Config
+    if *relayCA != "" {
+        pem, err := os.ReadFile(*relayCA)
+        if err != nil {
+            log.Fatalf("Failed to read -relay-ca: %v", err)
+        }
+        roots := x509.NewCertPool()
+        if !roots.AppendCertsFromPEM(pem) {
+            log.Fatalf("No certificates found in %s", *relayCA)
+        }
+        tlsConfig = &tls.Config{RootCAs: roots}
+    }
+
+    var proxyURL *url.URL
+    if *proxy != "" {
+        var err error
+        proxyURL, err = client.ParseProxyURL(*proxy)
+        if err != nil {
+            log.Fatalf("Invalid -proxy flag: %v", err)
+        }
+    }
+
+    var noiseKey []byte
+    if *relayNoise != "" {
+        var err error
+        noiseKey, err = noiseconn.ParsePublicKey(*relayNoiseKey)
+        if err != nil {
+            log.Fatalf("Invalid -relay-noise-key flag: %v", err)
+        }
+    }
+
+    var e2eTLS *tls.Config
+    if *e2eCert != "" {
+        cert, err := tls.LoadX509KeyPair(*e2eCert, *e2eKey)
+        if err != nil {
+            log.Fatalf("Failed to load end-to-end TLS certificate: %v", err)
+        }
+        e2eTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+    }
+
+    var forwards []client.LocalForward
+    for _, spec := range forwardSpecs {
+        forward, err := client.ParseLocalForward(spec)
+        if err != nil {
+            log.Fatalf("Invalid -L flag: %v", err)
+        }
+        forwards = append(forwards, forward)
+    }
+
+    var httpOptions client.HTTPOptions
+    httpOptions.HostHeader = *hostHeader
+    httpOptions.Hostname = *hostname
+    httpOptions.BasicAuth = basicAuth
+    httpOptions.BearerToken = *bearerToken
+    httpOptions.OIDCAllow = flagutil.SplitList(*oidcAllow)
+    for _, spec := range requestHeaders {
+        rule, err := client.ParseHeaderRule(spec)
+        if err != nil {
+            log.Fatalf("Invalid -request-header flag: %v", err)
+        }
+        httpOptions.RequestHeaders = append(httpOptions.RequestHeaders, rule)
+    }
+    for _, spec := range responseHeaders {
+        rule, err := client.ParseHeaderRule(spec)
+        if err != nil {
+            log.Fatalf("Invalid -response-header flag: %v", err)
+        }
+        httpOptions.ResponseHeaders = append(httpOptions.ResponseHeaders, rule)
+    }
+
+    // newClient creates a tunnel client with all local forwards configured
+    newClient := func() (*client.TunnelClient, error) {
+        c, err := client.NewTunnelClient(*relayHost, *relayPort, *localHost, *localPort)
+        if err != nil {
+            return nil, err
+        }
+        for _, forward := range forwards {
+            c.AddLocalForward(forward)
+        }
+        if *relayURL != "" {
+            c.SetWebSocketURL(*relayURL, tlsConfig)
+        }
+        c.SetProxy(proxyURL)
+        if *compress {
+            c.SetCompression(*compressThreshold)
+        }
+        if err := c.SetReadSize(int(readSize)); err != nil {
+            return nil, err
+        }
+        c.SetPool(*pool, *poolSecret, *balance)
+        healthCheck := client.HealthCheck{
+            Interval:     *healthInterval,
+            Timeout:      *healthTimeout,
+            HTTPPath:     *healthPath,
+            ExpectStatus: *healthStatus,
+        }
+        if err := c.SetHealthCheck(healthCheck); err != nil {
+            return nil, err
+        }
+        if *relayNoise != "" {
+            c.SetNoise(*relayNoise, noiseKey)
+        }
+        c.SetEndToEndTLS(e2eTLS)
+        if *relayQUIC != "" {
+            c.SetQUICAddr(*relayQUIC, tlsConfig)
+        }
+        c.SetToken(*token)
+        c.SetPublicPort(*publicPort)
+        c.SetReserve(*reserve)
+        c.SetRelease(*release)
+        c.SetSOCKSListenAddr(*socksAddr)
+        c.SetSourceACL(flagutil.SplitList(*allowCIDRs), flagutil.SplitList(*denyCIDRs))
+        c.SetLimits(*maxConns, *connRate, *requestRate)
+        c.SetBandwidth(int64(inboundRate), int64(outboundRate))
+        if *httpMode {
+            c.EnableHTTP(httpOptions)
+        }
+        if err := c.SetProxyProtocol(*proxyProtocol); err != nil {
+            return nil, err
+        }
+        return c, nil
+    }
+
     // Create tunnel client
-    tunnelClient, err := client.NewTunnelClient(*relayHost, *relayPort, *localHost, *localPort)
+    tunnelClient, err := newClient()
     if err != nil {
         log.Fatalf("Failed to create tunnel client: %v", err)
     }
 
-    // Connect to relay in a goroutine
-    go func() {
-        log.Printf("Connecting to relay server %s:%d...", *relayHost, *relayPort)
-        if err := tunnelClient.Start(); err != nil {
-            log.Fatalf("Tunnel client failed: %v", err)
-        }
-    }()
+    // Connect to relay
+    log.Printf("Connecting to relay server %s:%d...", *relayHost, *relayPort)
+    if err := tunnelClient.Start(); err != nil {
+        log.Fatalf("Tunnel client failed: %v", err)
+    }
 
     // Handle graceful shutdown
     sig := make(chan os.Signal, 1)
     signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-    <-sig
 
-    log.Println("Shutting down tunnel client...")
-    tunnelClient.Shutdown()
-    log.Println("Client shutdown complete")
-}
\ No newline at end of file
+    // Clients whose relay is draining keep serving their in-flight users
+    // until the relay closes them
+    drained := make(map[*client.TunnelClient]bool)
+    finished := make(chan *client.TunnelClient)
+    draining, done := tunnelClient.Draining(), tunnelClient.Done()
+    var retry <-chan time.Time
+    retryDelay := firstRetryDelay
+
+    // reregister replaces tunnelClient with a newly registered client, or
+    // tries again later if that fails
+    reregister := func() {
+        replacement, err := newClient()
+        if err == nil {
+            err = replacement.Start()
+        }
+        if err != nil {
+            log.Printf("Failed to re-register with relay, retrying in %s: %v", retryDelay, err)
+            retry = time.After(retryDelay)
+            retryDelay = min(2*retryDelay, maxRetryDelay)
+            return
+        }
+
+        retry, retryDelay = nil, firstRetryDelay
+        if done != nil {
+            drained[tunnelClient] = true
+            go func(old *client.TunnelClient) {
+                <-old.Done()
+                finished <- old
+            }(tunnelClient)
+        }
+        tunnelClient = replacement
+        draining, done = tunnelClient.Draining(), tunnelClient.Done()
+    }
+
+    for {
+        select {
+        case <-sig:
+            log.Println("Shutting down tunnel client...")
+            for c := range drained {
+                c.Shutdown()
+            }
+            tunnelClient.Shutdown()
+            log.Println("Client shutdown complete")
+            return
+
+        case <-draining:
+            // Register again, a load balancer in front of the relays will
+            // route us to an instance that is still accepting registrations
+            draining = nil
+            log.Printf("Relay is draining, re-registering with %s:%d...", *relayHost, *relayPort)
+            reregister()
+
+        case <-retry:
+            reregister()
+
+        case c := <-finished:
+            // The old relay closed the connection once its users were done
+            delete(drained, c)
+
+        case <-done:
+            if retry != nil {
+                // The draining relay is gone, keep trying to register elsewhere
+                log.Println("Draining relay closed the tunnel, still re-registering")
+                done = nil
+                continue
+            }
+            log.Println("Tunnel closed by relay server")
+            for c := range drained {
+                c.Shutdown()
+            }
+            return
+        }
+    }
+}
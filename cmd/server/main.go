@@ -1,13 +1,25 @@
 package main
 
 import (
+    "context"
+    "crypto/tls"
+    "errors"
     "flag"
     "log"
+    "net/http"
     "os"
     "os/signal"
+    "path/filepath"
     "syscall"
+    "time"
 
+    "github.com/euphoricair7/tun/internal/audit"
+    "github.com/euphoricair7/tun/internal/cluster"
+    "github.com/euphoricair7/tun/internal/flagutil"
+    "github.com/euphoricair7/tun/internal/noiseconn"
+    "github.com/euphoricair7/tun/internal/oidc"
     "github.com/euphoricair7/tun/internal/server"
+    "github.com/euphoricair7/tun/internal/state"
 )
 
 func main() {
@@ -15,6 +27,50 @@ func main() {
     registrationPort := flag.Int("port", 5678, "Port for client registrations")
     minPort := flag.Int("min-port", 10000, "Minimum port in the range of assignable ports")
     maxPort := flag.Int("max-port", 10050, "Maximum port in the range of assignable ports")
+    drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "How long to wait for user connections to finish on shutdown (0 to close immediately)")
+    clusterID := flag.String("cluster-id", "", "Unique ID of this relay within a cluster (empty disables clustering)")
+    clusterAddr := flag.String("cluster-addr", "127.0.0.1:5679", "Address for user connections forwarded by other relays, keep it on a private network")
+    clusterAdvertise := flag.String("cluster-advertise", "", "Address other relays use to reach -cluster-addr (defaults to -cluster-addr)")
+    registryKind := flag.String("registry", "gossip", "Cluster registry backend: gossip, file or memory")
+    registryFile := flag.String("registry-file", "tun-registry.json", "Registry file on shared storage for the file backend")
+    clusterSecret := flag.String("cluster-secret", os.Getenv("TUN_CLUSTER_SECRET"), "Secret shared by all relays of a cluster, authenticating forwarded connections and gossip (defaults to $TUN_CLUSTER_SECRET)")
+    gossipAddr := flag.String("gossip-addr", "127.0.0.1:5680", "Address to exchange registry state with other relays, keep it on a private network")
+    gossipPeers := flag.String("gossip-peers", "", "Comma-separated gossip addresses of the other relays")
+    allowCIDRs := flag.String("allow-cidr", "", "Comma-separated CIDRs allowed to reach any tunnel (empty allows everyone)")
+    denyCIDRs := flag.String("deny-cidr", "", "Comma-separated CIDRs denied from every tunnel")
+    allowDial := flag.String("allow-dial", "", "Comma-separated host:port, *.domain:port or CIDR:port destinations clients may reach through the relay (port may be *)")
+    maxConns := flag.Int("max-conns", 0, "Maximum concurrent user connections per tunnel (0 for unlimited)")
+    connRate := flag.Float64("conn-rate", 0, "Maximum new user connections per second from each source IP on a tunnel (0 for unlimited)")
+    requestRate := flag.Float64("request-rate", 0, "Maximum requests per second per HTTP tunnel (0 for unlimited)")
+    var inboundRate, outboundRate, dailyQuota, monthlyQuota flagutil.ByteSize
+    flag.Var(&inboundRate, "inbound-rate", "Bandwidth per tunnel from users towards clients in bytes per second, e.g. 1M (0 for unlimited)")
+    flag.Var(&outboundRate, "outbound-rate", "Bandwidth per tunnel from clients towards users in bytes per second, e.g. 1M (0 for unlimited)")
+    flag.Var(&dailyQuota, "daily-quota", "Bytes each client IP may move through its tunnels per UTC day, e.g. 5G (0 for unlimited)")
+    flag.Var(&monthlyQuota, "monthly-quota", "Bytes each client IP may move through its tunnels per month, e.g. 100G (0 for unlimited)")
+    accountsFile := flag.String("accounts", "", "JSON file of accounts clients must register with (empty allows anyone)")
+    stateFile := flag.String("state", "", "File keeping reservations and quota usage across restarts, e.g. tun-state.json (empty keeps nothing and disables reservations)")
+    reservationsFile := flag.String("reservations", "", "Deprecated, use -state: reservations file of earlier releases, imported into the state store (which defaults to tun-state.json next to it)")
+    httpAddr := flag.String("http-addr", "", "Shared address serving HTTP tunnels by hostname (empty disables hostnames)")
+    httpPublicURL := flag.String("http-public-url", "", "How users reach -http-addr through a proxy or TLS terminator, scheme and port only, e.g. https:// (empty for plain HTTP on -http-addr)")
+    readSize := flagutil.ByteSize(32 << 10)
+    flag.Var(&readSize, "read-size", "Bytes read from a user at once, larger sizes mean fewer frames for bulk transfers, e.g. 64K (at most 1M)")
+    auditFile := flag.String("audit-log", "", "File to append audit events to as JSON lines (empty disables)")
+    auditMaxSize := flagutil.ByteSize(100 << 20)
+    flag.Var(&auditMaxSize, "audit-max-size", "Size at which the audit log is rotated, e.g. 100M (0 disables rotation)")
+    auditMaxFiles := flag.Int("audit-max-files", 10, "Number of rotated audit logs to keep")
+    wsAddr := flag.String("ws-addr", "", "Address accepting client control connections over WebSocket (empty disables)")
+    wsCert := flag.String("ws-tls-cert", "", "TLS certificate file for -ws-addr (empty serves plain HTTP)")
+    wsKey := flag.String("ws-tls-key", "", "TLS key file for -ws-addr")
+    noiseAddr := flag.String("noise-addr", "", "Address accepting client control connections encrypted with Noise (empty disables)")
+    noiseKey := flag.String("noise-key", "tun-noise.key", "Private key file for -noise-addr, created if missing")
+    quicAddr := flag.String("quic-addr", "", "UDP address accepting clients over QUIC (empty disables)")
+    quicCert := flag.String("quic-tls-cert", "", "TLS certificate file for -quic-addr")
+    quicKey := flag.String("quic-tls-key", "", "TLS key file for -quic-addr")
+    statsAddr := flag.String("stats-addr", "", "Address to serve tunnel statistics as JSON on (empty disables)")
+    oidcIssuer := flag.String("oidc-issuer", "", "OIDC issuer URL users of HTTP tunnels can be required to log in with (empty disables)")
+    oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID of the relay")
+    oidcClientSecret := flag.String("oidc-client-secret", os.Getenv("TUN_OIDC_CLIENT_SECRET"), "OIDC client secret of the relay (defaults to $TUN_OIDC_CLIENT_SECRET)")
+    oidcSessionKey := flag.String("oidc-session-key", os.Getenv("TUN_OIDC_SESSION_KEY"), "Key signing login sessions, shared by all relays of a cluster (defaults to $TUN_OIDC_SESSION_KEY, random if empty)")
     flag.Parse()
 
     // Create and start the relay server
@@ -23,6 +79,159 @@ func main() {
         log.Fatalf("Failed to create relay server: %v", err)
     }
 
+    // Source addresses allowed on every tunnel
+    if err := s.SetSourceACL(flagutil.SplitList(*allowCIDRs), flagutil.SplitList(*denyCIDRs)); err != nil {
+        log.Fatalf("Invalid source address lists: %v", err)
+    }
+
+    // Destinations clients may reach with local forwards
+    if err := s.SetDialAllowlist(flagutil.SplitList(*allowDial)); err != nil {
+        log.Fatalf("Invalid -allow-dial: %v", err)
+    }
+
+    // Accounts clients must authenticate as
+    if *accountsFile != "" {
+        accounts, err := server.LoadAccounts(*accountsFile)
+        if err != nil {
+            log.Fatalf("Failed to load accounts: %v", err)
+        }
+        if err := s.SetAccounts(accounts); err != nil {
+            log.Fatalf("Invalid accounts: %v", err)
+        }
+        log.Printf("Loaded %d accounts from %s", len(accounts), *accountsFile)
+    }
+    // Record who did what, separately from this log
+    if *auditFile != "" {
+        auditLog, err := audit.NewLogger(*auditFile, int64(auditMaxSize), *auditMaxFiles)
+        if err != nil {
+            log.Fatalf("Failed to open audit log: %v", err)
+        }
+        defer auditLog.Close()
+        s.SetAuditLog(auditLog)
+    }
+
+    // Durable state such as reservations and quota usage
+    if *reservationsFile != "" && *stateFile == "" {
+        *stateFile = filepath.Join(filepath.Dir(*reservationsFile), "tun-state.json")
+    }
+    if *stateFile != "" {
+        store, err := state.NewFileStore(*stateFile)
+        if err != nil {
+            log.Fatalf("Failed to open state file: %v", err)
+        }
+        s.SetStateStore(store)
+    }
+    if *reservationsFile != "" {
+        log.Printf("-reservations is deprecated, reservations are kept in the state file %s", *stateFile)
+        added, err := s.ImportReservationsFile(*reservationsFile)
+        switch {
+        case errors.Is(err, os.ErrNotExist):
+        case err != nil:
+            log.Fatalf("Failed to import reservations: %v", err)
+        case added > 0:
+            log.Printf("Imported %d reservations from %s", added, *reservationsFile)
+        }
+    }
+    s.SetHTTPAddr(*httpAddr)
+    if *httpPublicURL != "" {
+        if err := s.SetHTTPPublicURL(*httpPublicURL); err != nil {
+            log.Fatalf("Invalid -http-public-url: %v", err)
+        }
+    }
+
+    // Control connections for clients that can only speak HTTP(S)
+    if *wsAddr != "" {
+        var tlsConfig *tls.Config
+        if *wsCert != "" {
+            cert, err := tls.LoadX509KeyPair(*wsCert, *wsKey)
+            if err != nil {
+                log.Fatalf("Failed to load WebSocket TLS certificate: %v", err)
+            }
+            tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+        }
+        s.SetWebSocketAddr(*wsAddr, tlsConfig)
+    }
+
+    // Encrypted control connections without certificates
+    if *noiseAddr != "" {
+        key, err := noiseconn.LoadKey(*noiseKey)
+        if err != nil {
+            log.Fatalf("Failed to load Noise key: %v", err)
+        }
+        s.SetNoiseAddr(*noiseAddr, key)
+    }
+
+    // Clients over QUIC, where every user connection gets its own stream
+    if *quicAddr != "" {
+        cert, err := tls.LoadX509KeyPair(*quicCert, *quicKey)
+        if err != nil {
+            log.Fatalf("Failed to load QUIC TLS certificate: %v", err)
+        }
+        s.SetQUICAddr(*quicAddr, &tls.Config{Certificates: []tls.Certificate{cert}})
+    }
+
+    // Protect clients from floods of users
+    limits := server.Limits{
+        MaxConns:     *maxConns,
+        ConnRate:     *connRate,
+        RequestRate:  *requestRate,
+        InboundRate:  int64(inboundRate),
+        OutboundRate: int64(outboundRate),
+    }
+    if err := s.SetLimits(limits); err != nil {
+        log.Fatalf("Invalid limits: %v", err)
+    }
+    if err := s.SetQuota(int64(dailyQuota), int64(monthlyQuota)); err != nil {
+        log.Fatalf("Invalid quota: %v", err)
+    }
+    if err := s.SetReadSize(int(readSize)); err != nil {
+        log.Fatalf("Invalid -read-size: %v", err)
+    }
+
+    // Let clients require users to log in
+    if *oidcIssuer != "" {
+        provider, err := oidc.NewProvider(context.Background(), *oidcIssuer, *oidcClientID, *oidcClientSecret)
+        if err != nil {
+            log.Fatalf("Failed to set up OIDC: %v", err)
+        }
+        if err := s.EnableOIDC(provider, []byte(*oidcSessionKey)); err != nil {
+            log.Fatalf("Failed to set up OIDC: %v", err)
+        }
+    }
+
+    // Join a cluster of relays sharing a tunnel registry
+    if *clusterID != "" {
+        if *clusterSecret == "" {
+            log.Fatal("Clustering needs -cluster-secret or $TUN_CLUSTER_SECRET")
+        }
+        var registry cluster.Registry
+        switch *registryKind {
+        case "memory":
+            registry = cluster.NewMemoryRegistry(cluster.DefaultTTL)
+        case "file":
+            registry = cluster.NewFileRegistry(*registryFile, cluster.DefaultTTL)
+        case "gossip":
+            gossip, err := cluster.NewGossipRegistry(*clusterID, *gossipAddr, flagutil.SplitList(*gossipPeers), cluster.DefaultTTL, []byte(*clusterSecret))
+            if err != nil {
+                log.Fatalf("Failed to create gossip registry: %v", err)
+            }
+            defer gossip.Close()
+            registry = gossip
+        default:
+            log.Fatalf("Unknown registry backend %q", *registryKind)
+        }
+        s.EnableCluster(registry, *clusterID, *clusterAddr, *clusterAdvertise, []byte(*clusterSecret))
+    }
+
+    if *statsAddr != "" {
+        go func() {
+            log.Printf("Serving statistics on %s", *statsAddr)
+            if err := http.ListenAndServe(*statsAddr, s.StatsHandler()); err != nil {
+                log.Printf("Statistics server failed: %v", err)
+            }
+        }()
+    }
+
     // Start server in a goroutine
     go func() {
         log.Printf("Starting relay server on port %d...", *registrationPort)
@@ -36,7 +245,12 @@ func main() {
     signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
     <-sig
 
+    if *drainTimeout > 0 {
+        log.Printf("Draining relay server for up to %s...", *drainTimeout)
+        s.Drain(*drainTimeout)
+    }
+
     log.Println("Shutting down relay server...")
     s.Shutdown()
     log.Println("Server shutdown complete")
-}
\ No newline at end of file
+}
@@ -1,5 +1,19 @@
 module github.com/euphoricair7/tun
 
+go 1.24
 
+require (
+	github.com/flynn/noise v1.1.0
+	github.com/quic-go/quic-go v0.54.1
+	golang.org/x/net v0.28.0
+)
 
-go 1.24
+require (
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
@@ -0,0 +1,251 @@
+package audit
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Event types
+const (
+    RegistrationAccepted = "registration_accepted"
+    RegistrationRejected = "registration_rejected"
+    TunnelClosed         = "tunnel_closed"
+    TunnelSuspended      = "tunnel_suspended"
+    ReservationCreated   = "reservation_created"
+    ReservationReleased  = "reservation_released"
+    AuthFailed           = "auth_failed"
+    UserRejected         = "user_rejected"
+    RequestRejected      = "request_rejected"
+    ForwardRejected      = "forward_rejected"
+    RelayDraining        = "relay_draining"
+    RelayShutdown        = "relay_shutdown"
+)
+
+// Repeated events, such as the rejections a port scan causes, are counted
+// and written once per source every repeatInterval. Past maxRepeated
+// distinct events in an interval, new ones are counted without their source.
+const (
+    repeatInterval = time.Minute
+    maxRepeated    = 1024
+)
+
+// Event is one audit record. Identity is the account, or the client IP on
+// relays without accounts, and SourceIP the address the event came from.
+type Event struct {
+    Time     time.Time `json:"time"`
+    Type     string    `json:"type"`
+    Identity string    `json:"identity,omitempty"`
+    SourceIP string    `json:"source_ip,omitempty"`
+    Port     int       `json:"port,omitempty"`
+    Hostname string    `json:"hostname,omitempty"`
+    Pool     string    `json:"pool,omitempty"`
+    Protocol string    `json:"protocol,omitempty"`
+    Target   string    `json:"target,omitempty"`
+    Reason   string    `json:"reason,omitempty"`
+
+    // Count is how many times a repeated event happened since Time
+    Count int `json:"count,omitempty"`
+}
+
+// Logger appends events as JSON lines to a file, rotating it once it grows
+// past a size. Rotated files are named path.1 (newest) to path.N.
+type Logger struct {
+    path     string
+    maxSize  int64
+    maxFiles int
+    mutex    sync.Mutex
+    file     *os.File
+    size     int64
+
+    repeatMutex sync.Mutex
+    repeated    map[Event]*Event // by the event without Time and Count
+    stop        chan struct{}
+    stopped     chan struct{}
+    closeOnce   sync.Once
+}
+
+// NewLogger opens the audit log at path. maxSize of zero disables
+// rotation, otherwise maxFiles rotated files are kept.
+func NewLogger(path string, maxSize int64, maxFiles int) (*Logger, error) {
+    l := &Logger{
+        path:     path,
+        maxSize:  maxSize,
+        maxFiles: maxFiles,
+        repeated: make(map[Event]*Event),
+        stop:     make(chan struct{}),
+        stopped:  make(chan struct{}),
+    }
+    if err := l.open(); err != nil {
+        return nil, err
+    }
+    go l.writeRepeatedPeriodically()
+    return l, nil
+}
+
+// open opens the current file for appending
+func (l *Logger) open() error {
+    file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to open audit log: %w", err)
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return fmt.Errorf("failed to open audit log: %w", err)
+    }
+
+    l.file = file
+    l.size = info.Size()
+    return nil
+}
+
+// Log records an event. A nil Logger discards it, so callers need not care
+// whether auditing is enabled.
+func (l *Logger) Log(event Event) {
+    if l == nil {
+        return
+    }
+    if event.Time.IsZero() {
+        event.Time = time.Now().UTC()
+    }
+
+    line, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("Failed to encode audit event: %v", err)
+        return
+    }
+    line = append(line, '\n')
+
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.file == nil {
+        return // Closed
+    }
+    if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+        if err := l.rotate(); err != nil {
+            log.Printf("Failed to rotate audit log: %v", err)
+            if l.file == nil {
+                return
+            }
+        }
+    }
+
+    n, err := l.file.Write(line)
+    l.size += int64(n)
+    if err != nil {
+        log.Printf("Failed to write audit event: %v", err)
+    }
+}
+
+// LogRepeated counts an event that may happen many times in a row, such as
+// a rejected connection, and writes it later with how often it happened.
+// It never waits for the file, so it is safe on accept paths.
+func (l *Logger) LogRepeated(event Event) {
+    if l == nil {
+        return
+    }
+    if event.Time.IsZero() {
+        event.Time = time.Now().UTC()
+    }
+    key := event
+    key.Time, key.Count = time.Time{}, 0
+
+    l.repeatMutex.Lock()
+    defer l.repeatMutex.Unlock()
+
+    pending, exists := l.repeated[key]
+    if !exists && len(l.repeated) >= maxRepeated {
+        key.SourceIP = ""
+        pending, exists = l.repeated[key]
+    }
+    if !exists {
+        pending = &event
+        pending.SourceIP, pending.Count = key.SourceIP, 0
+        l.repeated[key] = pending
+    }
+    pending.Count++
+}
+
+// writeRepeatedPeriodically writes the counted events until the log closes
+func (l *Logger) writeRepeatedPeriodically() {
+    defer close(l.stopped)
+    ticker := time.NewTicker(repeatInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            l.writeRepeated()
+        case <-l.stop:
+            l.writeRepeated()
+            return
+        }
+    }
+}
+
+// writeRepeated writes the events counted since the last call, oldest first
+func (l *Logger) writeRepeated() {
+    l.repeatMutex.Lock()
+    events := make([]Event, 0, len(l.repeated))
+    for _, event := range l.repeated {
+        events = append(events, *event)
+    }
+    clear(l.repeated)
+    l.repeatMutex.Unlock()
+
+    sort.Slice(events, func(i, j int) bool {
+        return events[i].Time.Before(events[j].Time)
+    })
+    for _, event := range events {
+        l.Log(event)
+    }
+}
+
+// rotate shifts the rotated files up by one and starts a new file
+func (l *Logger) rotate() error {
+    if err := l.file.Close(); err != nil {
+        return err
+    }
+    l.file = nil
+
+    if l.maxFiles > 0 {
+        os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+        for i := l.maxFiles - 1; i >= 1; i-- {
+            os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+        }
+        if err := os.Rename(l.path, l.path+".1"); err != nil {
+            return err
+        }
+    } else if err := os.Remove(l.path); err != nil {
+        return err
+    }
+
+    return l.open()
+}
+
+// Close writes the counted events and closes the log
+func (l *Logger) Close() error {
+    if l == nil {
+        return nil
+    }
+    l.closeOnce.Do(func() {
+        close(l.stop)
+        <-l.stopped
+    })
+
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if l.file == nil {
+        return nil
+    }
+    err := l.file.Close()
+    l.file = nil
+    return err
+}
@@ -0,0 +1,137 @@
+package audit
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// readEvents returns the events in the audit log file at path
+func readEvents(t *testing.T, path string) []Event {
+    t.Helper()
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    var events []Event
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        var event Event
+        if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+            t.Fatalf("line %q: %v", scanner.Text(), err)
+        }
+        events = append(events, event)
+    }
+    return events
+}
+
+func TestReopenAppends(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "audit.log")
+    for _, port := range []int{10012, 10013} {
+        l, err := NewLogger(path, 0, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        l.Log(Event{Type: RegistrationAccepted, Port: port})
+        if err := l.Close(); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    events := readEvents(t, path)
+    if len(events) != 2 || events[0].Port != 10012 || events[1].Port != 10013 {
+        t.Fatalf("log holds %+v, want both registrations in order", events)
+    }
+    if events[0].Time.IsZero() {
+        t.Error("event was written without a time")
+    }
+}
+
+func TestRotation(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "audit.log")
+    l, err := NewLogger(path, 200, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 10; i++ {
+        l.Log(Event{Type: TunnelClosed, Identity: fmt.Sprintf("client-%d", i), Reason: "a reason long enough to rotate"})
+    }
+    l.Close()
+
+    // The newest events are in the current file, older ones in path.1
+    current, rotated := readEvents(t, path), readEvents(t, path+".1")
+    if len(current) == 0 || current[len(current)-1].Identity != "client-9" {
+        t.Fatalf("current file holds %+v", current)
+    }
+    if len(rotated) == 0 || rotated[len(rotated)-1].Identity != fmt.Sprintf("client-%d", 9-len(current)) {
+        t.Fatalf("path.1 holds %+v after %d current events", rotated, len(current))
+    }
+    if _, err := os.Stat(path + ".2"); err != nil {
+        t.Errorf("path.2 is missing: %v", err)
+    }
+    if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+        t.Errorf("more than 2 rotated files are kept: %v", err)
+    }
+    for _, name := range []string{path, path + ".1", path + ".2"} {
+        if info, err := os.Stat(name); err == nil && info.Size() > 200 {
+            t.Errorf("%s grew to %d bytes", name, info.Size())
+        }
+    }
+}
+
+func TestRepeatedEventsAreCounted(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "audit.log")
+    l, err := NewLogger(path, 0, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 1000; i++ {
+        l.LogRepeated(Event{Type: UserRejected, SourceIP: "203.0.113.7", Port: 10012, Reason: "source not allowed"})
+    }
+    l.LogRepeated(Event{Type: UserRejected, SourceIP: "198.51.100.1", Port: 10012, Reason: "source not allowed"})
+
+    // Nothing is written until the interval ends or the log closes
+    if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+        t.Fatalf("repeated events were written right away: %v", err)
+    }
+    l.Close()
+
+    events := readEvents(t, path)
+    if len(events) != 2 {
+        t.Fatalf("log holds %+v, want one event per source", events)
+    }
+    counts := map[string]int{}
+    for _, event := range events {
+        counts[event.SourceIP] = event.Count
+    }
+    if counts["203.0.113.7"] != 1000 || counts["198.51.100.1"] != 1 {
+        t.Errorf("counts are %v", counts)
+    }
+}
+
+func TestRepeatedEventsAreBounded(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "audit.log")
+    l, err := NewLogger(path, 0, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < maxRepeated+500; i++ {
+        l.LogRepeated(Event{Type: UserRejected, SourceIP: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Reason: "connection rate exceeded"})
+    }
+    l.Close()
+
+    events := readEvents(t, path)
+    if len(events) != maxRepeated+1 {
+        t.Fatalf("log holds %d events, want %d", len(events), maxRepeated+1)
+    }
+    for _, event := range events {
+        if event.SourceIP == "" && event.Count != 500 {
+            t.Errorf("events past the bound counted %d times, want 500", event.Count)
+        }
+    }
+}
@@ -0,0 +1,62 @@
+package bufpool
+
+import (
+    "math/bits"
+    "sync"
+)
+
+// Buffers are pooled in power of two size classes from 512 bytes to 1 MiB.
+// Larger buffers are rare enough to leave to the garbage collector.
+const (
+    minShift = 9
+    maxShift = 20
+)
+
+var classes [maxShift - minShift + 1]sync.Pool
+
+// headers holds the *[]byte the size classes store buffers in while the
+// buffers are out, so Get and Put pass the same headers around instead of
+// allocating one per Put
+var headers sync.Pool
+
+// class returns the index of the smallest size class holding size bytes
+func class(size int) int {
+    shift := bits.Len(uint(size - 1))
+    if shift < minShift {
+        shift = minShift
+    }
+    return shift - minShift
+}
+
+// Get returns a buffer of size bytes. Its contents are undefined.
+func Get(size int) []byte {
+    if size <= 0 {
+        return []byte{}
+    }
+    if size > 1<<maxShift {
+        return make([]byte, size)
+    }
+    c := class(size)
+    if header, ok := classes[c].Get().(*[]byte); ok {
+        buffer := (*header)[:size]
+        *header = nil
+        headers.Put(header)
+        return buffer
+    }
+    return make([]byte, size, 1<<(c+minShift))
+}
+
+// Put returns a buffer from Get for reuse. The caller must not touch it
+// afterwards. Buffers Get did not hand out are ignored.
+func Put(buffer []byte) {
+    size := cap(buffer)
+    if size < 1<<minShift || size > 1<<maxShift || size&(size-1) != 0 {
+        return
+    }
+    header, ok := headers.Get().(*[]byte)
+    if !ok {
+        header = new([]byte)
+    }
+    *header = buffer[:0]
+    classes[class(size)].Put(header)
+}
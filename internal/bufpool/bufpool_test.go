@@ -0,0 +1,86 @@
+package bufpool
+
+import "testing"
+
+func TestClass(t *testing.T) {
+    tests := []struct {
+        size  int
+        class int
+    }{
+        {1, 0},
+        {512, 0},
+        {513, 1},
+        {1024, 1},
+        {1025, 2},
+        {32 << 10, 6},
+        {1 << 20, maxShift - minShift},
+    }
+    for _, tt := range tests {
+        if got := class(tt.size); got != tt.class {
+            t.Errorf("class(%d) = %d, want %d", tt.size, got, tt.class)
+        }
+    }
+}
+
+func TestGet(t *testing.T) {
+    tests := []struct {
+        size     int
+        capacity int
+    }{
+        {-1, 0},
+        {0, 0},
+        {1, 512},
+        {512, 512},
+        {513, 1024},
+        {1 << 20, 1 << 20},
+        {1<<20 + 1, 1<<20 + 1},
+    }
+    for _, tt := range tests {
+        buffer := Get(tt.size)
+        if tt.size > 0 && len(buffer) != tt.size {
+            t.Errorf("Get(%d) has length %d", tt.size, len(buffer))
+        }
+        if tt.size <= 0 && (buffer == nil || len(buffer) != 0) {
+            t.Errorf("Get(%d) = %v, want an empty buffer", tt.size, buffer)
+        }
+        if cap(buffer) != tt.capacity {
+            t.Errorf("Get(%d) has capacity %d, want %d", tt.size, cap(buffer), tt.capacity)
+        }
+        Put(buffer)
+    }
+}
+
+func TestPutIgnoresForeignBuffers(t *testing.T) {
+    // None of these may end up in a size class and be handed out again
+    for _, buffer := range [][]byte{
+        nil,
+        make([]byte, 0),
+        make([]byte, 100),
+        make([]byte, 600),
+        make([]byte, 2<<20),
+    } {
+        Put(buffer)
+    }
+    for size := 1; size <= 1<<20; size <<= 1 {
+        if buffer := Get(size); cap(buffer)&(cap(buffer)-1) != 0 || cap(buffer) < 512 {
+            t.Fatalf("Get(%d) returned a buffer of capacity %d", size, cap(buffer))
+        }
+    }
+}
+
+func TestGetPutDoesNotAllocate(t *testing.T) {
+    Put(Get(32 << 10))
+    allocs := testing.AllocsPerRun(1000, func() {
+        Put(Get(32 << 10))
+    })
+    if allocs != 0 {
+        t.Fatalf("Get and Put allocate %.1f times", allocs)
+    }
+}
+
+func BenchmarkGetPut(b *testing.B) {
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        Put(Get(32 << 10))
+    }
+}
@@ -1,14 +1,20 @@
 package client
 
 import (
+    "crypto/tls"
     "encoding/json"
     "fmt"
     "io"
     "log"
     "net"
+    "net/url"
     "sync"
+    "sync/atomic"
     "time"
 
+    "github.com/euphoricair7/tun/internal/bufpool"
+    "github.com/euphoricair7/tun/internal/compress"
+    "github.com/euphoricair7/tun/internal/frame"
     "github.com/euphoricair7/tun/pkg/protocol"
 )
 
@@ -19,47 +25,187 @@ type TunnelClient struct {
     localHost     string
     localPort     int
     conn          net.Conn
+    frames        *frame.Encoder // every message to the relay goes through here
     publicPort    int
     userConns     map[string]*userConnection
     userConnMutex sync.RWMutex
     shutdown      chan struct{}
+    shutdownOnce  sync.Once
+    draining      chan struct{}
+    drainOnce     sync.Once
     wg            sync.WaitGroup
     pingTicker    *time.Ticker
+    forwards      []LocalForward
+    socksAddr     string
+    proxyProtocol int
+    protocol      string
+    httpOptions   HTTPOptions
+    allowCIDRs    []string
+    denyCIDRs     []string
+    maxConns      int
+    connRate      float64
+    requestRate   float64
+    inboundRate   int64
+    outboundRate  int64
+    compression   string // asked for until registered, then what the relay agreed to
+    compressMin   int
+    readSize      int
+    pool          string
+    poolSecret    string
+    balance       string
+    healthCheck   HealthCheck
+    token         string
+    requestedPort int
+    reserve       bool
+    release       bool
+    webSocketURL  string
+    tlsConfig     *tls.Config
+    quicAddr      string
+    proxyURL      *url.URL
+    noiseAddr     string
+    noiseKey      []byte
+    endToEndTLS   *tls.Config
+    listeners     []net.Listener
+    pendingOpens  map[string]*pendingOpen
+    pendingMutex  sync.Mutex
+    nextOpenID    atomic.Uint64
 }
 
+// maxPendingBytes bounds the data kept for a user while its local service
+// is being dialed. A user sending more before the dial completes is closed.
+const maxPendingBytes = 1 << 20
+
 type userConnection struct {
-    localConn net.Conn
+    localConn    net.Conn
+    pending      [][]byte // data that arrived while the local service was being dialed
+    pendingBytes int
+    closed       bool
+    localDone    bool // the local side finished writing
+    relayDone    bool          // the user finished writing
+    resumed      chan struct{} // closed when the relay resumes a paused user, nil while flowing
+    mutex        sync.Mutex
+}
+
+// pause stops readLocal reading the local service until resume, for a user
+// the relay can't keep up with
+func (uc *userConnection) pause() {
+    uc.mutex.Lock()
+    defer uc.mutex.Unlock()
+
+    if uc.resumed == nil && !uc.closed {
+        uc.resumed = make(chan struct{})
+    }
+}
+
+// resume lets readLocal read the local service again
+func (uc *userConnection) resume() {
+    uc.mutex.Lock()
+    defer uc.mutex.Unlock()
+
+    if uc.resumed != nil {
+        close(uc.resumed)
+        uc.resumed = nil
+    }
+}
+
+// paused returns a channel closed once the user is resumed, nil if the user
+// is not paused
+func (uc *userConnection) paused() chan struct{} {
+    if uc == nil {
+        return nil
+    }
+    uc.mutex.Lock()
+    defer uc.mutex.Unlock()
+    return uc.resumed
+}
+
+// close closes the local connection, or makes sure it is closed as soon as
+// the dial in progress completes
+func (uc *userConnection) close() {
+    uc.mutex.Lock()
+    defer uc.mutex.Unlock()
+
+    uc.closed = true
+    uc.pending = nil
+    uc.pendingBytes = 0
+    if uc.resumed != nil {
+        close(uc.resumed)
+        uc.resumed = nil
+    }
+    if uc.localConn != nil {
+        uc.localConn.Close()
+    }
 }
 
 // NewTunnelClient creates a new tunnel client
 func NewTunnelClient(relayHost string, relayPort int, localHost string, localPort int) (*TunnelClient, error) {
     return &TunnelClient{
-        relayHost:  relayHost,
-        relayPort:  relayPort,
-        localHost:  localHost,
-        localPort:  localPort,
-        userConns:  make(map[string]*userConnection),
-        shutdown:   make(chan struct{}),
-        pingTicker: time.NewTicker(30 * time.Second),
+        relayHost:    relayHost,
+        relayPort:    relayPort,
+        localHost:    localHost,
+        localPort:    localPort,
+        userConns:    make(map[string]*userConnection),
+        shutdown:     make(chan struct{}),
+        draining:     make(chan struct{}),
+        pingTicker:   time.NewTicker(30 * time.Second),
+        pendingOpens: make(map[string]*pendingOpen),
+        readSize:     protocol.DefaultReadSize,
     }, nil
 }
 
 // Start initiates connection to the relay server
 func (c *TunnelClient) Start() error {
+    if c.endToEndTLS != nil && c.protocol == protocol.ProtocolHTTP {
+        return fmt.Errorf("end-to-end TLS needs a TCP tunnel, the relay has to read HTTP tunnels")
+    }
+    if c.socksAddr != "" && !loopbackAddr(c.socksAddr) {
+        return fmt.Errorf("the SOCKS5 proxy has no authentication and may only listen on a loopback address, not %s", c.socksAddr)
+    }
+
     var err error
-    c.conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", c.relayHost, c.relayPort))
+    c.conn, err = c.dialRelay()
     if err != nil {
         return fmt.Errorf("failed to connect to relay server: %w", err)
     }
+    c.frames = frame.NewEncoder(c.conn)
+    if _, ok := c.conn.(streamAccepter); ok && c.compression != "" {
+        log.Printf("Not compressing over QUIC, user connections get streams of their own")
+        c.compression = ""
+    }
 
     // Send registration request
     req := protocol.RegistrationRequest{
-        LocalHost: c.localHost,
-        LocalPort: c.localPort,
+        LocalHost:       c.localHost,
+        LocalPort:       c.localPort,
+        Protocol:        c.protocol,
+        Token:           c.token,
+        Port:            c.requestedPort,
+        Hostname:        c.httpOptions.Hostname,
+        Reserve:         c.reserve,
+        Release:         c.release,
+        AllowCIDRs:      c.allowCIDRs,
+        DenyCIDRs:       c.denyCIDRs,
+        HostHeader:      c.httpOptions.HostHeader,
+        RequestHeaders:  c.httpOptions.RequestHeaders,
+        ResponseHeaders: c.httpOptions.ResponseHeaders,
+        BasicAuth:       c.httpOptions.BasicAuth,
+        BearerToken:     c.httpOptions.BearerToken,
+        OIDCAllow:       c.httpOptions.OIDCAllow,
+        MaxConns:        c.maxConns,
+        ConnRate:        c.connRate,
+        RequestRate:     c.requestRate,
+        InboundRate:     c.inboundRate,
+        OutboundRate:    c.outboundRate,
+
+        Compression:          c.compression,
+        CompressionThreshold: c.compressMin,
+
+        Pool:       c.pool,
+        Balance:    c.balance,
+        PoolSecret: c.poolSecret,
     }
 
-    encoder := json.NewEncoder(c.conn)
-    if err := encoder.Encode(req); err != nil {
+    if err := c.frames.Encode(req); err != nil {
         c.conn.Close()
         return fmt.Errorf("failed to send registration request: %w", err)
     }
@@ -78,8 +224,18 @@ func (c *TunnelClient) Start() error {
     }
 
     c.publicPort = resp.PublicPort
+    if c.compression != "" && resp.Compression == "" {
+        log.Printf("Relay does not support %s compression, sending data uncompressed", c.compression)
+    }
+    c.compression = resp.Compression
     log.Printf("Successfully registered! Your service is now available at: %s:%d",
         c.relayHost, c.publicPort)
+    if c.pool != "" {
+        log.Printf("Serving users of pool %s", c.pool)
+    }
+    if resp.Hostname != "" {
+        log.Printf("Also serving requests for %s on the relay's HTTP address", resp.Hostname)
+    }
 
     // Start processing messages from relay
     c.wg.Add(1)
@@ -89,32 +245,158 @@ func (c *TunnelClient) Start() error {
     c.wg.Add(1)
     go c.keepAlive()
 
+    // Tell the relay when the local service goes down
+    if c.healthCheck.Interval > 0 {
+        c.wg.Add(1)
+        go c.checkHealth()
+    }
+
+    // Over QUIC user connections arrive as streams of their own
+    if streams, ok := c.conn.(streamAccepter); ok {
+        c.wg.Add(1)
+        go c.acceptUserStreams(streams)
+    }
+
+    // Start local listeners for connections the relay dials for us
+    for _, forward := range c.forwards {
+        listener, err := net.Listen("tcp", forward.ListenAddr)
+        if err != nil {
+            c.Shutdown()
+            return fmt.Errorf("failed to listen on %s: %w", forward.ListenAddr, err)
+        }
+        c.listeners = append(c.listeners, listener)
+        log.Printf("Forwarding %s to %s through the relay", forward.ListenAddr, forward.Target)
+
+        c.wg.Add(1)
+        go c.acceptForwardConnections(listener, forward.Target)
+    }
+
+    // Start the SOCKS5 server whose connections the relay dials for us
+    if c.socksAddr != "" {
+        listener, err := net.Listen("tcp", c.socksAddr)
+        if err != nil {
+            c.Shutdown()
+            return fmt.Errorf("failed to listen on %s: %w", c.socksAddr, err)
+        }
+        c.listeners = append(c.listeners, listener)
+        log.Printf("SOCKS5 proxy through the relay listening on %s", c.socksAddr)
+
+        c.wg.Add(1)
+        go c.acceptSOCKSConnections(listener)
+    }
+
     return nil
 }
 
+// SetSourceACL asks the relay to only let users whose address matches allow
+// and not deny reach the tunnel. Entries are CIDRs or IPs. Must be called
+// before Start.
+func (c *TunnelClient) SetSourceACL(allow, deny []string) {
+    c.allowCIDRs = allow
+    c.denyCIDRs = deny
+}
+
+// SetToken sets the token identifying the client's account on relays that
+// have accounts. Must be called before Start.
+func (c *TunnelClient) SetToken(token string) {
+    c.token = token
+}
+
+// SetPublicPort asks the relay for a specific public port, 0 takes any free
+// one. Must be called before Start.
+func (c *TunnelClient) SetPublicPort(port int) {
+    c.requestedPort = port
+}
+
+// SetReserve asks the relay to keep the tunnel's port and hostname for the
+// client's account for good. Must be called before Start.
+func (c *TunnelClient) SetReserve(reserve bool) {
+    c.reserve = reserve
+}
+
+// SetRelease asks the relay to give up the account's reservation of the
+// tunnel's port and hostname. Must be called before Start.
+func (c *TunnelClient) SetRelease(release bool) {
+    c.release = release
+}
+
+// SetLimits asks the relay to cap concurrent user connections, new
+// connections per second from each source IP and, for HTTP tunnels,
+// requests per second. Zero leaves a limit to the relay. Must be called
+// before Start.
+func (c *TunnelClient) SetLimits(maxConns int, connRate, requestRate float64) {
+    c.maxConns = maxConns
+    c.connRate = connRate
+    c.requestRate = requestRate
+}
+
+// SetBandwidth asks the relay to shape the tunnel to inbound bytes per
+// second from users and outbound bytes per second towards them. Zero leaves
+// a rate to the relay. Must be called before Start.
+func (c *TunnelClient) SetBandwidth(inbound, outbound int64) {
+    c.inboundRate = inbound
+    c.outboundRate = outbound
+}
+
+// SetCompression asks the relay to deflate data frames of at least
+// threshold bytes in both directions, zero leaving the threshold to the
+// relay. It has no effect over QUIC. Must be called before Start.
+func (c *TunnelClient) SetCompression(threshold int) {
+    c.compression = protocol.CompressionDeflate
+    c.compressMin = threshold
+}
+
+// SetPool registers the client as one of a pool of clients serving the same
+// service behind one tunnel. Clients of an account registering the same name
+// and secret share the tunnel of the first, which spreads new users over
+// them as balance decides, empty for round robin. Relays without accounts
+// need a secret. Must be called before Start.
+func (c *TunnelClient) SetPool(name, secret, balance string) {
+    c.pool = name
+    c.poolSecret = secret
+    c.balance = balance
+}
+
+// Draining returns a channel that is closed once the relay announces it is
+// draining. Existing user connections keep working, but no new ones will
+// arrive, so callers should register with another relay.
+func (c *TunnelClient) Draining() <-chan struct{} {
+    return c.draining
+}
+
+// Done returns a channel that is closed once the client has shut down,
+// either because Shutdown was called or the relay closed the connection.
+func (c *TunnelClient) Done() <-chan struct{} {
+    return c.shutdown
+}
+
 // Shutdown closes the client connection
 func (c *TunnelClient) Shutdown() {
-    close(c.shutdown)
-    c.pingTicker.Stop()
+    c.shutdownOnce.Do(func() {
+        close(c.shutdown)
+        c.pingTicker.Stop()
+
+        // Notify the server we're disconnecting
+        if c.conn != nil {
+            disconnectMsg := protocol.ClientMessage{
+                Type: protocol.MessageTypeDisconnect,
+            }
+            c.frames.Encode(disconnectMsg)
+            c.conn.Close()
+        }
 
-    // Notify the server we're disconnecting
-    if c.conn != nil {
-        disconnectMsg := protocol.ClientMessage{
-            Type: protocol.MessageTypeDisconnect,
+        // Stop accepting local forwards
+        for _, listener := range c.listeners {
+            listener.Close()
         }
-        encoder := json.NewEncoder(c.conn)
-        encoder.Encode(disconnectMsg)
-        c.conn.Close()
-    }
 
-    // Close all user connections
-    c.userConnMutex.Lock()
-    for _, uc := range c.userConns {
-        if uc.localConn != nil {
-            uc.localConn.Close()
+        // Close all user connections
+        c.userConnMutex.Lock()
+        for _, uc := range c.userConns {
+            uc.close()
         }
-    }
-    c.userConnMutex.Unlock()
+        c.userConnMutex.Unlock()
+    })
 
     // Wait for goroutines to finish
     c.wg.Wait()
@@ -136,7 +418,8 @@ func (c *TunnelClient) handleRelayMessages() {
                     log.Printf("Error decoding message from relay: %v", err)
                 }
                 log.Println("Connection to relay server closed")
-                c.Shutdown()
+                // Shut down from a separate goroutine, Shutdown waits for this one
+                go c.Shutdown()
                 return
             }
 
@@ -147,14 +430,39 @@ func (c *TunnelClient) handleRelayMessages() {
                 if msg.UserID == "" {
                     continue
                 }
-                go c.handleUserConnection(msg.UserID)
+                // Register right away so data arriving during the dial is kept
+                c.userConnMutex.Lock()
+                c.userConns[msg.UserID] = &userConnection{}
+                c.userConnMutex.Unlock()
+                go c.handleUserConnection(msg)
 
             case protocol.MessageTypeData:
                 // Data for an existing user connection
                 if msg.UserID == "" || msg.Data == nil {
                     continue
                 }
-                c.forwardToLocalService(msg.UserID, msg.Data)
+                data := msg.Data
+                if msg.Compressed {
+                    var err error
+                    if data, err = compress.Decompress(msg.Data); err != nil {
+                        log.Printf("Dropping user connection %s: %v", msg.UserID, err)
+                        msg.Data.Release()
+                        c.closeUserConnection(msg.UserID)
+                        continue
+                    }
+                }
+                c.forwardToLocalService(msg.UserID, data)
+                if msg.Compressed {
+                    bufpool.Put(data)
+                }
+                msg.Data.Release()
+
+            case protocol.MessageTypeCloseWrite:
+                // User finished writing but may still read
+                if msg.UserID == "" {
+                    continue
+                }
+                c.relayFinished(msg.UserID)
 
             case protocol.MessageTypeDisconnect:
                 // User disconnected
@@ -163,67 +471,166 @@ func (c *TunnelClient) handleRelayMessages() {
                 }
                 c.closeUserConnection(msg.UserID)
 
+            case protocol.MessageTypePause, protocol.MessageTypeResume:
+                // The user fell behind or caught up
+                c.userConnMutex.RLock()
+                userConn, exists := c.userConns[msg.UserID]
+                c.userConnMutex.RUnlock()
+                switch {
+                case !exists:
+                case msg.Type == protocol.MessageTypePause:
+                    userConn.pause()
+                default:
+                    userConn.resume()
+                }
+
             case protocol.MessageTypePong:
                 // Server responded to our ping
                 log.Println("Received pong from relay server")
+
+            case protocol.MessageTypeOpenResult:
+                // Relay dialed, or failed to dial, a destination we asked for
+                c.pendingMutex.Lock()
+                pending, exists := c.pendingOpens[msg.UserID]
+                delete(c.pendingOpens, msg.UserID)
+                c.pendingMutex.Unlock()
+                if !exists {
+                    continue
+                }
+                errMsg := msg.Error
+                if pending.reply != nil {
+                    if err := pending.reply(errMsg); err != nil && errMsg == "" {
+                        errMsg = err.Error()
+                    }
+                }
+                pending.result <- errMsg
+
+            case protocol.MessageTypeDraining:
+                // Relay is going away, existing users keep flowing until it closes
+                log.Println("Relay server is draining, no new user connections will arrive")
+                c.drainOnce.Do(func() {
+                    close(c.draining)
+                })
+
+            case protocol.MessageTypeSuspended:
+                // Relay is closing the tunnel for good, reconnecting won't help
+                log.Printf("Tunnel suspended by relay server: %s", msg.Error)
             }
         }
     }
 }
 
 // handleUserConnection creates a connection to the local service for a new user
-func (c *TunnelClient) handleUserConnection(userID string) {
-    log.Printf("New user connection: %s", userID)
+func (c *TunnelClient) handleUserConnection(msg protocol.ClientMessage) {
+    userID := msg.UserID
+    log.Printf("New user connection: %s from %s", userID, msg.SourceAddr)
 
     // Connect to local service
-    localConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", c.localHost, c.localPort))
+    localConn, err := c.dialLocal(msg)
     if err != nil {
         log.Printf("Failed to connect to local service for user %s: %v", userID, err)
+        c.failUserConnection(userID, err.Error())
         return
     }
 
-    // Save the connection
-    userConn := &userConnection{
-        localConn: localConn,
+    // Save the connection, passing on whatever arrived while dialing
+    c.userConnMutex.RLock()
+    userConn, exists := c.userConns[userID]
+    c.userConnMutex.RUnlock()
+    if !exists {
+        localConn.Close()
+        return
+    }
+
+    userConn.mutex.Lock()
+    if userConn.closed {
+        userConn.mutex.Unlock()
+        localConn.Close()
+        return
+    }
+    for _, data := range userConn.pending {
+        if _, err := localConn.Write(data); err != nil {
+            log.Printf("Error writing to local service for user %s: %v", userID, err)
+            break
+        }
+    }
+    userConn.pending = nil
+    userConn.pendingBytes = 0
+    userConn.localConn = localConn
+    relayDone := userConn.relayDone
+    userConn.mutex.Unlock()
+
+    // The user may have finished writing while we were dialing
+    if relayDone {
+        if err := closeWrite(localConn); err != nil {
+            c.closeUserConnection(userID)
+            return
+        }
     }
-    c.userConnMutex.Lock()
-    c.userConns[userID] = userConn
-    c.userConnMutex.Unlock()
 
     // Read responses from local service and send to relay
     c.wg.Add(1)
-    go func() {
-        defer c.wg.Done()
-        buffer := make([]byte, 4096)
-        for {
+    go c.readLocal(userID, localConn)
+}
+
+// readLocal forwards data read from a local connection to the relay until
+// either side closes
+func (c *TunnelClient) readLocal(userID string, localConn net.Conn) {
+    defer c.wg.Done()
+    var compressor *compress.Compressor
+    if c.compression != "" {
+        compressor = compress.NewCompressor(c.compressMin)
+    }
+    c.userConnMutex.RLock()
+    userConn := c.userConns[userID]
+    c.userConnMutex.RUnlock()
+    buffer := bufpool.Get(c.readSize)
+    defer bufpool.Put(buffer)
+    for {
+        if resumed := userConn.paused(); resumed != nil {
             select {
             case <-c.shutdown:
                 return
-            default:
-                n, err := localConn.Read(buffer)
-                if err != nil {
-                    if err != io.EOF {
-                        log.Printf("Error reading from local service for user %s: %v", userID, err)
-                    }
+            case <-resumed:
+            }
+        }
+        select {
+        case <-c.shutdown:
+            return
+        default:
+            n, err := localConn.Read(buffer)
+            if err == io.EOF && !c.localFinished(userID) {
+                // The user may still be writing, only pass on the EOF
+                if err := c.sendCloseWrite(userID); err != nil {
+                    log.Printf("Error sending close for user %s to relay: %v", userID, err)
                     c.closeUserConnection(userID)
-                    return
-                }
-
-                // Send data back to relay
-                dataMsg := protocol.ClientMessage{
-                    Type:   protocol.MessageTypeData,
-                    UserID: userID,
-                    Data:   buffer[:n],
                 }
-                encoder := json.NewEncoder(c.conn)
-                if err := encoder.Encode(dataMsg); err != nil {
-                    log.Printf("Error sending data to relay: %v", err)
-                    c.closeUserConnection(userID)
-                    return
+                return
+            }
+            if err != nil {
+                if err != io.EOF {
+                    log.Printf("Error reading from local service for user %s: %v", userID, err)
                 }
+                // Tell the relay unless it closed the connection itself
+                c.finishUserConnection(userID)
+                return
+            }
+
+            // Send data back to relay
+            data, compressed := compressor.Compress(buffer[:n])
+            dataMsg := protocol.ClientMessage{
+                Type:       protocol.MessageTypeData,
+                UserID:     userID,
+                Data:       data,
+                Compressed: compressed,
+            }
+            if err := c.frames.Encode(dataMsg); err != nil {
+                log.Printf("Error sending data to relay: %v", err)
+                c.closeUserConnection(userID)
+                return
             }
         }
-    }()
+    }
 }
 
 // forwardToLocalService sends data to the local service
@@ -237,27 +644,64 @@ func (c *TunnelClient) forwardToLocalService(userID string, data []byte) {
         return
     }
 
-    if _, err := userConn.localConn.Write(data); err != nil {
+    userConn.mutex.Lock()
+    localConn := userConn.localConn
+    if localConn == nil {
+        // Still dialing the local service
+        if userConn.closed {
+            userConn.mutex.Unlock()
+            return
+        }
+        if userConn.pendingBytes+len(data) > maxPendingBytes {
+            userConn.mutex.Unlock()
+            log.Printf("Dropping user connection %s: more than %d bytes arrived before the local service answered", userID, maxPendingBytes)
+            c.failUserConnection(userID, "local service did not accept the connection in time")
+            return
+        }
+        userConn.pending = append(userConn.pending, append([]byte(nil), data...))
+        userConn.pendingBytes += len(data)
+        userConn.mutex.Unlock()
+        return
+    }
+    userConn.mutex.Unlock()
+
+    if _, err := localConn.Write(data); err != nil {
         log.Printf("Error writing to local service for user %s: %v", userID, err)
         c.closeUserConnection(userID)
     }
 }
 
-// closeUserConnection closes and cleans up a user connection
-func (c *TunnelClient) closeUserConnection(userID string) {
+// failUserConnection closes a user connection whose local service could not
+// take it and lets the relay close the user instead of leaving it hanging
+func (c *TunnelClient) failUserConnection(userID, reason string) {
+    if !c.closeUserConnection(userID) {
+        return // The relay closed it first
+    }
+    result := protocol.ClientMessage{
+        Type:   protocol.MessageTypeConnectResult,
+        UserID: userID,
+        Error:  reason,
+    }
+    if err := c.frames.Encode(result); err != nil {
+        log.Printf("Error sending connect result to relay: %v", err)
+    }
+}
+
+// closeUserConnection closes and cleans up a user connection, reporting
+// whether it was still open
+func (c *TunnelClient) closeUserConnection(userID string) bool {
     c.userConnMutex.Lock()
     defer c.userConnMutex.Unlock()
 
     userConn, exists := c.userConns[userID]
     if !exists {
-        return
+        return false
     }
 
-    if userConn.localConn != nil {
-        userConn.localConn.Close()
-    }
+    userConn.close()
     delete(c.userConns, userID)
     log.Printf("Closed connection for user %s", userID)
+    return true
 }
 
 // keepAlive sends periodic pings to keep the connection alive
@@ -271,8 +715,7 @@ func (c *TunnelClient) keepAlive() {
             pingMsg := protocol.ClientMessage{
                 Type: protocol.MessageTypePing,
             }
-            encoder := json.NewEncoder(c.conn)
-            if err := encoder.Encode(pingMsg); err != nil {
+            if err := c.frames.Encode(pingMsg); err != nil {
                 log.Printf("Error sending ping: %v", err)
             } else {
                 log.Println("Ping sent to relay server")
@@ -0,0 +1,156 @@
+package client
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "net"
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/frame"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// newTestClient returns a client for the local service at localAddr whose
+// messages to the relay arrive on the returned channel
+func newTestClient(t *testing.T, localAddr string) (*TunnelClient, <-chan protocol.ClientMessage) {
+    t.Helper()
+    host, portString, _ := net.SplitHostPort(localAddr)
+    port, _ := strconv.Atoi(portString)
+    c, err := NewTunnelClient("127.0.0.1", 0, host, port)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    clientSide, relaySide := net.Pipe()
+    c.frames = frame.NewEncoder(clientSide)
+    messages := make(chan protocol.ClientMessage, 16)
+    go func() {
+        decoder := json.NewDecoder(relaySide)
+        for {
+            var msg protocol.ClientMessage
+            if err := decoder.Decode(&msg); err != nil {
+                close(messages)
+                return
+            }
+            messages <- msg
+        }
+    }()
+    t.Cleanup(func() {
+        c.Shutdown()
+        clientSide.Close()
+        relaySide.Close()
+        c.wg.Wait()
+    })
+    return c, messages
+}
+
+// dialing registers a user whose local connection is still being dialed,
+// like handleRelayMessages does on connect
+func dialing(c *TunnelClient, userID string) {
+    c.userConnMutex.Lock()
+    c.userConns[userID] = &userConnection{}
+    c.userConnMutex.Unlock()
+}
+
+func TestDataArrivingDuringDialIsKept(t *testing.T) {
+    local, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer local.Close()
+    c, _ := newTestClient(t, local.Addr().String())
+
+    dialing(c, "user")
+    c.forwardToLocalService("user", []byte("hello "))
+    c.forwardToLocalService("user", []byte("world"))
+
+    c.handleUserConnection(protocol.ClientMessage{Type: protocol.MessageTypeConnect, UserID: "user"})
+    conn, err := local.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    // What was kept comes first, then data arriving afterwards
+    c.forwardToLocalService("user", []byte("!"))
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    got := make([]byte, len("hello world!"))
+    if _, err := io.ReadFull(conn, got); err != nil {
+        t.Fatal(err)
+    }
+    if string(got) != "hello world!" {
+        t.Errorf("local service got %q, want %q", got, "hello world!")
+    }
+}
+
+func TestDataArrivingDuringDialIsCapped(t *testing.T) {
+    c, messages := newTestClient(t, "127.0.0.1:1")
+    dialing(c, "user")
+
+    chunk := bytes.Repeat([]byte("x"), maxPendingBytes/4)
+    for i := 0; i < 4; i++ {
+        c.forwardToLocalService("user", chunk)
+    }
+    c.userConnMutex.RLock()
+    userConn := c.userConns["user"]
+    c.userConnMutex.RUnlock()
+    if userConn == nil || userConn.pendingBytes != maxPendingBytes {
+        t.Fatalf("kept %+v, want %d bytes", userConn, maxPendingBytes)
+    }
+
+    // One byte too many closes the user and tells the relay why
+    c.forwardToLocalService("user", []byte("x"))
+    select {
+    case msg := <-messages:
+        if msg.Type != protocol.MessageTypeConnectResult || msg.UserID != "user" || msg.Error == "" {
+            t.Errorf("relay was sent %+v, want a failed connect result", msg)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("relay was not told about the dropped user")
+    }
+
+    c.userConnMutex.RLock()
+    _, exists := c.userConns["user"]
+    c.userConnMutex.RUnlock()
+    if exists {
+        t.Error("user is still registered")
+    }
+    userConn.mutex.Lock()
+    defer userConn.mutex.Unlock()
+    if userConn.pending != nil || !userConn.closed {
+        t.Error("kept data was not released")
+    }
+}
+
+func TestPausedUserIsNotRead(t *testing.T) {
+    c, messages := newTestClient(t, "127.0.0.1:1")
+    localConn, service := net.Pipe()
+    defer service.Close()
+    userConn := &userConnection{localConn: localConn}
+    c.userConnMutex.Lock()
+    c.userConns["user"] = userConn
+    c.userConnMutex.Unlock()
+
+    userConn.pause()
+    c.wg.Add(1)
+    go c.readLocal("user", localConn)
+    go service.Write([]byte("response"))
+    select {
+    case msg := <-messages:
+        t.Fatalf("paused user sent %+v", msg)
+    case <-time.After(100 * time.Millisecond):
+    }
+
+    userConn.resume()
+    select {
+    case msg := <-messages:
+        if msg.Type != protocol.MessageTypeData || string(msg.Data) != "response" {
+            t.Errorf("relay was sent %+v, want the response", msg)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("resumed user was not read")
+    }
+}
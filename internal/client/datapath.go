@@ -0,0 +1,18 @@
+package client
+
+import (
+    "fmt"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// SetReadSize sets how many bytes are read from the local service at once,
+// and so the largest data frame sent to the relay. Must be called before
+// Start.
+func (c *TunnelClient) SetReadSize(size int) error {
+    if size <= 0 || size > protocol.MaxReadSize {
+        return fmt.Errorf("read size must be between 1 and %d bytes", protocol.MaxReadSize)
+    }
+    c.readSize = size
+    return nil
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+    "crypto/tls"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "strconv"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// tlsHandshakeTimeout bounds how long a user may take to finish the TLS
+// handshake with the client
+const tlsHandshakeTimeout = 30 * time.Second
+
+// SetEndToEndTLS makes the client terminate TLS for public users itself
+// with tlsConfig, so the relay only ever forwards encrypted bytes. Only TCP
+// tunnels can be end-to-end, the relay has to read HTTP tunnels. Must be
+// called before Start.
+func (c *TunnelClient) SetEndToEndTLS(tlsConfig *tls.Config) {
+    c.endToEndTLS = tlsConfig
+}
+
+// dialLocal connects a user to the local service. The PROXY header, if any,
+// is sent right away, and with end-to-end TLS the returned connection takes
+// the user's encrypted bytes and decrypts them on their way.
+func (c *TunnelClient) dialLocal(msg protocol.ClientMessage) (net.Conn, error) {
+    localConn, err := net.Dial("tcp", net.JoinHostPort(c.localHost, strconv.Itoa(c.localPort)))
+    if err != nil {
+        return nil, err
+    }
+
+    // Tell the local service who the user really is
+    if c.proxyProtocol != 0 {
+        if _, err := localConn.Write(proxyHeader(c.proxyProtocol, msg.SourceAddr, msg.DestAddr)); err != nil {
+            localConn.Close()
+            return nil, fmt.Errorf("failed to send PROXY header: %w", err)
+        }
+    }
+
+    if c.endToEndTLS == nil {
+        return localConn, nil
+    }
+    userSide, tlsSide := halfClosePipe()
+    c.wg.Add(1)
+    go c.terminateTLS(msg.UserID, tls.Server(tlsSide, c.endToEndTLS), localConn)
+    return userSide, nil
+}
+
+// terminateTLS decrypts a user's connection and passes it on to the local
+// service. Either side finishing only ends its direction, so a user that is
+// done sending still gets the response.
+func (c *TunnelClient) terminateTLS(userID string, tlsConn *tls.Conn, localConn net.Conn) {
+    defer c.wg.Done()
+    defer localConn.Close()
+    defer tlsConn.Close()
+
+    tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+    if err := tlsConn.Handshake(); err != nil {
+        log.Printf("TLS handshake with user %s failed: %v", userID, err)
+        return
+    }
+    tlsConn.SetDeadline(time.Time{})
+
+    // A direction that ends cleanly only shuts down its write side, the
+    // other keeps flowing. Anything else closes both.
+    done := make(chan struct{})
+    go func() {
+        _, err := io.Copy(localConn, tlsConn)
+        if err != nil || closeWrite(localConn) != nil {
+            tlsConn.Close()
+            localConn.Close()
+        }
+        close(done)
+    }()
+    _, err := io.Copy(tlsConn, localConn)
+    if err != nil || tlsConn.CloseWrite() != nil || closeWrite(tlsConn.NetConn()) != nil {
+        tlsConn.Close()
+        localConn.Close()
+    }
+    <-done
+}
+
+// pipeConn is one end of a halfClosePipe
+type pipeConn struct {
+    reader net.Conn // carries what the other end writes
+    writer net.Conn // carries what this end writes
+}
+
+// halfClosePipe is like net.Pipe but either end may finish writing with
+// CloseWrite and keep reading, as TLS users do after their last request
+func halfClosePipe() (net.Conn, net.Conn) {
+    aReader, bWriter := net.Pipe()
+    bReader, aWriter := net.Pipe()
+    return &pipeConn{reader: aReader, writer: aWriter}, &pipeConn{reader: bReader, writer: bWriter}
+}
+
+func (p *pipeConn) Read(b []byte) (int, error)  { return p.reader.Read(b) }
+func (p *pipeConn) Write(b []byte) (int, error) { return p.writer.Write(b) }
+func (p *pipeConn) CloseWrite() error           { return p.writer.Close() }
+func (p *pipeConn) LocalAddr() net.Addr         { return p.reader.LocalAddr() }
+func (p *pipeConn) RemoteAddr() net.Addr        { return p.reader.RemoteAddr() }
+
+func (p *pipeConn) Close() error {
+    p.writer.Close()
+    return p.reader.Close()
+}
+
+func (p *pipeConn) SetDeadline(t time.Time) error {
+    p.writer.SetDeadline(t)
+    return p.reader.SetDeadline(t)
+}
+
+func (p *pipeConn) SetReadDeadline(t time.Time) error  { return p.reader.SetReadDeadline(t) }
+func (p *pipeConn) SetWriteDeadline(t time.Time) error { return p.writer.SetWriteDeadline(t) }
@@ -0,0 +1,97 @@
+package client
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "io"
+    "math/big"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// selfSigned returns a certificate for 127.0.0.1 and a pool trusting it
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    leaf, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    roots := x509.NewCertPool()
+    roots.AddCert(leaf)
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+func TestEndToEndTLSKeepsHalfClose(t *testing.T) {
+    // A local service that answers once the user finished sending
+    local, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer local.Close()
+    received := make(chan string, 1)
+    go func() {
+        conn, err := local.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        request, _ := io.ReadAll(conn)
+        received <- string(request)
+        conn.Write([]byte("bye"))
+    }()
+
+    c, _ := newTestClient(t, local.Addr().String())
+    cert, roots := selfSigned(t)
+    c.SetEndToEndTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+    userSide, err := c.dialLocal(protocol.ClientMessage{Type: protocol.MessageTypeConnect, UserID: "user"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer userSide.Close()
+
+    // The relay side carries the user's TLS bytes and passes on its close
+    user := tls.Client(userSide, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+    user.SetDeadline(time.Now().Add(5 * time.Second))
+    if _, err := user.Write([]byte("hello")); err != nil {
+        t.Fatal(err)
+    }
+    if err := user.CloseWrite(); err != nil {
+        t.Fatal(err)
+    }
+    if err := closeWrite(userSide); err != nil {
+        t.Fatal(err)
+    }
+
+    select {
+    case request := <-received:
+        if request != "hello" {
+            t.Errorf("local service got %q, want hello", request)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("local service did not see the user finish")
+    }
+    response, err := io.ReadAll(user)
+    if err != nil || string(response) != "bye" {
+        t.Errorf("user got %q, %v, want bye", response, err)
+    }
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "strings"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// openTimeout bounds how long we wait for the relay to dial a destination
+const openTimeout = 30 * time.Second
+
+// LocalForward exposes a destination reachable from the relay as a local
+// listener, like ssh -L
+type LocalForward struct {
+    ListenAddr string // local address to listen on
+    Target     string // host:port the relay dials
+}
+
+// ParseLocalForward parses a forward spec in ssh -L form,
+// [bind_address:]port:host:hostport
+func ParseLocalForward(spec string) (LocalForward, error) {
+    // The bind address may contain colons itself, so count from the right
+    parts := strings.Split(spec, ":")
+    if len(parts) < 3 {
+        return LocalForward{}, fmt.Errorf("invalid forward %q, expected [bind_address:]port:host:hostport", spec)
+    }
+
+    n := len(parts)
+    target := net.JoinHostPort(strings.Trim(parts[n-2], "[]"), parts[n-1])
+    bind := "localhost"
+    if n > 3 {
+        bind = strings.Trim(strings.Join(parts[:n-3], ":"), "[]")
+    }
+
+    return LocalForward{
+        ListenAddr: net.JoinHostPort(bind, parts[n-3]),
+        Target:     target,
+    }, nil
+}
+
+// pendingOpen is an open request awaiting the relay's result
+type pendingOpen struct {
+    result chan string
+    reply  func(errMsg string) error // runs before any data for the connection is delivered
+}
+
+// AddLocalForward asks the relay to dial forward.Target for every connection
+// accepted on forward.ListenAddr. Must be called before Start.
+func (c *TunnelClient) AddLocalForward(forward LocalForward) {
+    c.forwards = append(c.forwards, forward)
+}
+
+// acceptForwardConnections handles connections on a local forward listener
+func (c *TunnelClient) acceptForwardConnections(listener net.Listener, target string) {
+    defer c.wg.Done()
+
+    for {
+        localConn, err := listener.Accept()
+        if err != nil {
+            select {
+            case <-c.shutdown:
+                return
+            default:
+                log.Printf("Error accepting local connection for %s: %v", target, err)
+                return
+            }
+        }
+
+        go func() {
+            if err := c.openThroughRelay(localConn, target, nil); err != nil {
+                log.Printf("Failed to open %s through relay: %v", target, err)
+                localConn.Close()
+            }
+        }()
+    }
+}
+
+// openThroughRelay asks the relay to dial target and, once it has, streams
+// localConn over the tunnel. If reply is set it is called with the relay's
+// result before any data from target is written to localConn.
+func (c *TunnelClient) openThroughRelay(localConn net.Conn, target string, reply func(errMsg string) error) error {
+    userID := fmt.Sprintf("local-%d", c.nextOpenID.Add(1))
+
+    // Register before asking so data the destination sends right after
+    // connecting is not dropped
+    pending := &pendingOpen{
+        result: make(chan string, 1),
+        reply:  reply,
+    }
+    c.pendingMutex.Lock()
+    c.pendingOpens[userID] = pending
+    c.pendingMutex.Unlock()
+
+    c.userConnMutex.Lock()
+    c.userConns[userID] = &userConnection{localConn: localConn}
+    c.userConnMutex.Unlock()
+
+    openMsg := protocol.ClientMessage{
+        Type:   protocol.MessageTypeOpen,
+        UserID: userID,
+        Target: target,
+    }
+    err := c.frames.Encode(openMsg)
+
+    if err == nil {
+        select {
+        case errMsg := <-pending.result:
+            if errMsg != "" {
+                err = fmt.Errorf("relay refused: %s", errMsg)
+            }
+        case <-time.After(openTimeout):
+            err = fmt.Errorf("timed out waiting for relay")
+        case <-c.shutdown:
+            err = fmt.Errorf("client is shutting down")
+        }
+
+        // Make sure the relay side does not stay open, it ignores unknown IDs
+        if err != nil {
+            disconnectMsg := protocol.ClientMessage{
+                Type:   protocol.MessageTypeDisconnect,
+                UserID: userID,
+            }
+            c.frames.Encode(disconnectMsg)
+        }
+    }
+
+    if err != nil {
+        c.pendingMutex.Lock()
+        delete(c.pendingOpens, userID)
+        c.pendingMutex.Unlock()
+        c.userConnMutex.Lock()
+        delete(c.userConns, userID)
+        c.userConnMutex.Unlock()
+        return err
+    }
+
+    log.Printf("Opened connection %s to %s through relay", userID, target)
+
+    c.wg.Add(1)
+    go c.readLocal(userID, localConn)
+    return nil
+}
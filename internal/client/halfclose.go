@@ -0,0 +1,83 @@
+package client
+
+import (
+    "net"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// localFinished records that the local side of a user connection finished
+// writing and reports whether the relay side had too
+func (c *TunnelClient) localFinished(userID string) bool {
+    c.userConnMutex.RLock()
+    userConn, exists := c.userConns[userID]
+    c.userConnMutex.RUnlock()
+    if !exists {
+        return true
+    }
+
+    userConn.mutex.Lock()
+    defer userConn.mutex.Unlock()
+    userConn.localDone = true
+    return userConn.relayDone
+}
+
+// relayFinished handles the relay telling us a user finished writing. The
+// local service sees EOF, and the connection closes if it had finished as
+// well.
+func (c *TunnelClient) relayFinished(userID string) {
+    c.userConnMutex.RLock()
+    userConn, exists := c.userConns[userID]
+    c.userConnMutex.RUnlock()
+    if !exists {
+        return
+    }
+
+    userConn.mutex.Lock()
+    userConn.relayDone = true
+    localConn := userConn.localConn
+    both := userConn.localDone
+    userConn.mutex.Unlock()
+
+    if localConn == nil {
+        return // Still dialing, handleUserConnection passes it on
+    }
+    if both {
+        c.finishUserConnection(userID)
+        return
+    }
+    if err := closeWrite(localConn); err != nil {
+        c.finishUserConnection(userID)
+    }
+}
+
+// finishUserConnection closes a user connection and tells the relay,
+// unless the relay closed it first
+func (c *TunnelClient) finishUserConnection(userID string) {
+    if c.closeUserConnection(userID) {
+        disconnectMsg := protocol.ClientMessage{
+            Type:   protocol.MessageTypeDisconnect,
+            UserID: userID,
+        }
+        c.frames.Encode(disconnectMsg)
+    }
+}
+
+// sendCloseWrite tells the relay the local side of a user connection
+// finished writing
+func (c *TunnelClient) sendCloseWrite(userID string) error {
+    closeMsg := protocol.ClientMessage{
+        Type:   protocol.MessageTypeCloseWrite,
+        UserID: userID,
+    }
+    return c.frames.Encode(closeMsg)
+}
+
+// closeWrite shuts down the write side of conn, or all of it if conn can't
+// be half closed
+func closeWrite(conn net.Conn) error {
+    if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+        return halfCloser.CloseWrite()
+    }
+    return conn.Close()
+}
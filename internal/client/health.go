@@ -0,0 +1,144 @@
+package client
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// defaultHealthTimeout bounds a probe when HealthCheck does not
+const defaultHealthTimeout = 5 * time.Second
+
+// HealthCheck probes the local service so the relay stops sending users to
+// the client while it is down. Without an HTTPPath a probe only connects.
+type HealthCheck struct {
+    Interval time.Duration // time between probes, zero disables checks
+    Timeout  time.Duration // defaultHealthTimeout when zero
+
+    // HTTPPath makes each probe a GET of this path, which must answer with
+    // ExpectStatus, or any status below 400 when that is zero
+    HTTPPath     string
+    ExpectStatus int
+}
+
+// SetHealthCheck makes the client probe its local service and tell the
+// relay whenever it goes down or comes back. Must be called before Start.
+func (c *TunnelClient) SetHealthCheck(check HealthCheck) error {
+    if check.Interval < 0 || check.Timeout < 0 {
+        return fmt.Errorf("health check interval and timeout can't be negative")
+    }
+    if check.HTTPPath != "" && !strings.HasPrefix(check.HTTPPath, "/") {
+        return fmt.Errorf("health check path %q must start with /", check.HTTPPath)
+    }
+    if check.ExpectStatus != 0 && (check.ExpectStatus < 100 || check.ExpectStatus > 599) {
+        return fmt.Errorf("invalid health check status %d", check.ExpectStatus)
+    }
+    if check.Timeout == 0 {
+        check.Timeout = defaultHealthTimeout
+    }
+    c.healthCheck = check
+    return nil
+}
+
+// checkHealth probes the local service until shutdown, reporting every
+// change to the relay
+func (c *TunnelClient) checkHealth() {
+    defer c.wg.Done()
+    ticker := time.NewTicker(c.healthCheck.Interval)
+    defer ticker.Stop()
+
+    healthy := true // the relay's view until told otherwise
+    for {
+        err := c.probeLocal()
+        if (err == nil) != healthy {
+            healthy = err == nil
+            healthMsg := protocol.ClientMessage{Type: protocol.MessageTypeHealth}
+            if err != nil {
+                log.Printf("Local service is down, the relay stops sending users: %v", err)
+                healthMsg.Error = err.Error()
+            } else {
+                log.Println("Local service is up again")
+            }
+            if err := c.frames.Encode(healthMsg); err != nil {
+                log.Printf("Error reporting health to relay: %v", err)
+            }
+        }
+
+        select {
+        case <-c.shutdown:
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// probeLocal checks once whether the local service answers
+func (c *TunnelClient) probeLocal() error {
+    ctx, cancel := context.WithTimeout(context.Background(), c.healthCheck.Timeout)
+    defer cancel()
+
+    if c.healthCheck.HTTPPath == "" {
+        conn, err := c.dialProbe(ctx)
+        if err != nil {
+            return err
+        }
+        return conn.Close()
+    }
+
+    addr := net.JoinHostPort(c.localHost, strconv.Itoa(c.localPort))
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+c.healthCheck.HTTPPath, nil)
+    if err != nil {
+        return err
+    }
+    probe := &http.Client{
+        Transport: &http.Transport{
+            DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+                return c.dialProbe(ctx)
+            },
+            DisableKeepAlives: true,
+        },
+        // A redirect is an answer of its own
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    resp, err := probe.Do(req)
+    if err != nil {
+        return err
+    }
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+    resp.Body.Close()
+
+    expect := c.healthCheck.ExpectStatus
+    if (expect != 0 && resp.StatusCode != expect) || (expect == 0 && resp.StatusCode >= 400) {
+        return fmt.Errorf("GET %s answered %s", c.healthCheck.HTTPPath, resp.Status)
+    }
+    return nil
+}
+
+// dialProbe connects to the local service like a user would, sending the
+// PROXY header it expects if any. Probes have no user, so the header is
+// UNKNOWN or LOCAL rather than passing the client off as one.
+func (c *TunnelClient) dialProbe(ctx context.Context) (net.Conn, error) {
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.localHost, strconv.Itoa(c.localPort)))
+    if err != nil {
+        return nil, err
+    }
+    if c.proxyProtocol != 0 {
+        header := proxyHeader(c.proxyProtocol, "", "")
+        if _, err := conn.Write(header); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("failed to send PROXY header: %w", err)
+        }
+    }
+    return conn, nil
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// HTTPOptions configures how the relay handles an HTTP tunnel
+type HTTPOptions struct {
+    // HostHeader replaces the Host header sent to the local service,
+    // "rewrite" uses the local service address. Empty keeps the public Host.
+    HostHeader      string
+    RequestHeaders  []protocol.HeaderRule
+    ResponseHeaders []protocol.HeaderRule
+
+    // Credentials the relay checks before letting requests through,
+    // "user:password" entries and/or a static bearer token
+    BasicAuth   []string
+    BearerToken string
+
+    // OIDCAllow makes users log in with the relay's OIDC provider, entries
+    // are email addresses or "@domain". It needs a Hostname.
+    OIDCAllow []string
+
+    // Hostname asks the relay to also serve the tunnel under this name on
+    // its shared HTTP address
+    Hostname string
+}
+
+// EnableHTTP registers the tunnel as an HTTP tunnel, so the relay parses
+// requests, adds X-Forwarded-* headers and applies opts. Must be called
+// before Start.
+func (c *TunnelClient) EnableHTTP(opts HTTPOptions) {
+    c.protocol = protocol.ProtocolHTTP
+    c.httpOptions = opts
+}
+
+// ParseHeaderRule parses a header rule of the form add:Name:Value,
+// set:Name:Value or remove:Name
+func ParseHeaderRule(spec string) (protocol.HeaderRule, error) {
+    parts := strings.SplitN(spec, ":", 3)
+    rule := protocol.HeaderRule{Action: parts[0]}
+    if len(parts) > 1 {
+        rule.Name = strings.TrimSpace(parts[1])
+    }
+    if len(parts) > 2 {
+        rule.Value = strings.TrimSpace(parts[2])
+    }
+
+    switch {
+    case rule.Name == "":
+        return rule, fmt.Errorf("invalid header rule %q, missing header name", spec)
+    case rule.Action == protocol.HeaderActionRemove && len(parts) == 2:
+    case (rule.Action == protocol.HeaderActionAdd || rule.Action == protocol.HeaderActionSet) && len(parts) == 3:
+    default:
+        return rule, fmt.Errorf("invalid header rule %q, expected add:Name:Value, set:Name:Value or remove:Name", spec)
+    }
+    return rule, nil
+}
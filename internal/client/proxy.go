@@ -0,0 +1,248 @@
+package client
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+
+    "golang.org/x/net/http/httpproxy"
+)
+
+// ParseProxyURL parses a proxy to reach the relay through, an http://,
+// https:// (HTTP CONNECT) or socks5:// URL with optional user:password
+func ParseProxyURL(raw string) (*url.URL, error) {
+    proxyURL, err := url.Parse(raw)
+    if err != nil {
+        return nil, fmt.Errorf("invalid proxy URL %q: %w", raw, err)
+    }
+    switch proxyURL.Scheme {
+    case "http", "https", "socks5", "socks5h":
+    default:
+        return nil, fmt.Errorf("unsupported proxy scheme %q, expected http, https or socks5", proxyURL.Scheme)
+    }
+    if proxyURL.Host == "" {
+        return nil, fmt.Errorf("invalid proxy URL %q: missing host", raw)
+    }
+    return proxyURL, nil
+}
+
+// SetProxy makes the client reach the relay through proxyURL instead of the
+// proxy HTTPS_PROXY and NO_PROXY pick, see ParseProxyURL. QUIC connections
+// are never proxied. Must be called before Start.
+func (c *TunnelClient) SetProxy(proxyURL *url.URL) {
+    c.proxyURL = proxyURL
+}
+
+// dialContext connects to addr directly or through the configured proxy
+func (c *TunnelClient) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    proxyURL := c.proxyURL
+    if proxyURL == nil {
+        var err error
+        proxyURL, err = environmentProxy(addr)
+        if err != nil {
+            return nil, fmt.Errorf("invalid proxy in environment: %w", err)
+        }
+    }
+
+    dialer := &net.Dialer{}
+    if proxyURL == nil {
+        return dialer.DialContext(ctx, network, addr)
+    }
+
+    conn, err := dialer.DialContext(ctx, "tcp", proxyAddr(proxyURL))
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyURL.Host, err)
+    }
+
+    // Give up on the handshake when the caller does
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
+    defer stop()
+
+    tunnel := conn
+    switch proxyURL.Scheme {
+    case "socks5", "socks5h":
+        err = socksConnect(conn, proxyURL.User, addr)
+    case "https":
+        tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+        if err = tlsConn.HandshakeContext(ctx); err == nil {
+            tunnel, err = httpConnect(tlsConn, proxyURL.User, addr)
+        }
+    default:
+        tunnel, err = httpConnect(conn, proxyURL.User, addr)
+    }
+    if err != nil {
+        conn.Close()
+        if ctx.Err() != nil {
+            err = ctx.Err()
+        }
+        return nil, fmt.Errorf("proxy %s: %w", proxyURL.Host, err)
+    }
+    return tunnel, nil
+}
+
+// environmentProxy returns the proxy HTTPS_PROXY and NO_PROXY pick for addr,
+// nil for none. The relay connection is tunneled, so HTTPS_PROXY applies.
+// Unlike http.ProxyFromEnvironment the environment is read on every call.
+func environmentProxy(addr string) (*url.URL, error) {
+    return httpproxy.FromEnvironment().ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+}
+
+// proxyAddr returns the host:port of a proxy, filling in the scheme's
+// default port
+func proxyAddr(proxyURL *url.URL) string {
+    if proxyURL.Port() != "" {
+        return proxyURL.Host
+    }
+    port := "80"
+    switch proxyURL.Scheme {
+    case "https":
+        port = "443"
+    case "socks5", "socks5h":
+        port = "1080"
+    }
+    return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// httpConnect asks an HTTP proxy on conn to tunnel to addr
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+    req := &http.Request{
+        Method: http.MethodConnect,
+        URL:    &url.URL{Opaque: addr},
+        Host:   addr,
+        Header: make(http.Header),
+    }
+    if user != nil {
+        password, _ := user.Password()
+        credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+        req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+    }
+    if err := req.Write(conn); err != nil {
+        return nil, err
+    }
+
+    reader := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(reader, req)
+    if err != nil {
+        return nil, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("CONNECT to %s refused: %s", addr, resp.Status)
+    }
+
+    // Keep anything the proxy sent past its response
+    if reader.Buffered() > 0 {
+        return &bufferedConn{Conn: conn, reader: reader}, nil
+    }
+    return conn, nil
+}
+
+// bufferedConn reads through a reader that may hold bytes already read
+// from the connection
+type bufferedConn struct {
+    net.Conn
+    reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+    return b.reader.Read(p)
+}
+
+// socksConnect asks a SOCKS5 proxy on conn to connect to addr, leaving
+// name resolution to the proxy
+func socksConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+    host, portStr, err := net.SplitHostPort(addr)
+    if err != nil {
+        return err
+    }
+    port, err := strconv.Atoi(portStr)
+    if err != nil {
+        return fmt.Errorf("invalid port in %s", addr)
+    }
+    if len(host) > 255 {
+        return fmt.Errorf("hostname %s is too long for SOCKS5", host)
+    }
+
+    methods := []byte{socksAuthNone}
+    if user != nil {
+        methods = []byte{socksAuthNone, socksAuthPassword}
+    }
+    if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+        return err
+    }
+    choice := make([]byte, 2)
+    if _, err := io.ReadFull(conn, choice); err != nil {
+        return err
+    }
+    if choice[0] != socksVersion {
+        return fmt.Errorf("unsupported SOCKS version %d", choice[0])
+    }
+
+    switch choice[1] {
+    case socksAuthNone:
+    case socksAuthPassword:
+        // Username/password authentication from RFC 1929
+        username := user.Username()
+        password, _ := user.Password()
+        if len(username) > 255 || len(password) > 255 {
+            return fmt.Errorf("SOCKS5 credentials are too long")
+        }
+        auth := []byte{0x01, byte(len(username))}
+        auth = append(auth, username...)
+        auth = append(auth, byte(len(password)))
+        auth = append(auth, password...)
+        if _, err := conn.Write(auth); err != nil {
+            return err
+        }
+        status := make([]byte, 2)
+        if _, err := io.ReadFull(conn, status); err != nil {
+            return err
+        }
+        if status[1] != 0x00 {
+            return fmt.Errorf("SOCKS5 authentication failed")
+        }
+    default:
+        return fmt.Errorf("no acceptable SOCKS5 authentication method")
+    }
+
+    request := []byte{socksVersion, socksCmdConnect, 0x00, socksAddrDomain, byte(len(host))}
+    request = append(request, host...)
+    request = binary.BigEndian.AppendUint16(request, uint16(port))
+    if _, err := conn.Write(request); err != nil {
+        return err
+    }
+
+    // Reply header, then the bound address we don't need
+    reply := make([]byte, 4)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        return err
+    }
+    if reply[1] != socksReplySucceeded {
+        return fmt.Errorf("SOCKS5 connect to %s failed with reply %d", addr, reply[1])
+    }
+    var skip int
+    switch reply[3] {
+    case socksAddrIPv4:
+        skip = net.IPv4len
+    case socksAddrIPv6:
+        skip = net.IPv6len
+    case socksAddrDomain:
+        length := make([]byte, 1)
+        if _, err := io.ReadFull(conn, length); err != nil {
+            return err
+        }
+        skip = int(length[0])
+    default:
+        return fmt.Errorf("unsupported SOCKS address type %d", reply[3])
+    }
+    _, err = io.ReadFull(conn, make([]byte, skip+2))
+    return err
+}
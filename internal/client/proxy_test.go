@@ -0,0 +1,234 @@
+package client
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "testing"
+    "time"
+)
+
+// fakeProxy accepts one connection and hands it to serve
+func fakeProxy(t *testing.T, serve func(conn net.Conn)) string {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        conn.SetDeadline(time.Now().Add(5 * time.Second))
+        serve(conn)
+    }()
+    return listener.Addr().String()
+}
+
+// dialThrough dials relay.example.com:7000 through the proxy at raw
+func dialThrough(t *testing.T, raw string) (net.Conn, error) {
+    t.Helper()
+    proxyURL, err := ParseProxyURL(raw)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c, err := NewTunnelClient("relay.example.com", 7000, "127.0.0.1", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.SetProxy(proxyURL)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    return c.dialContext(ctx, "tcp", "relay.example.com:7000")
+}
+
+// connectProxy is an HTTP proxy that answers CONNECT with status, sending
+// greeting in the same write as a successful response
+func connectProxy(t *testing.T, status int, greeting string) string {
+    return fakeProxy(t, func(conn net.Conn) {
+        req, err := http.ReadRequest(bufio.NewReader(conn))
+        if err != nil {
+            t.Errorf("reading CONNECT: %v", err)
+            return
+        }
+        if req.Method != http.MethodConnect || req.Host != "relay.example.com:7000" {
+            t.Errorf("got %s %s", req.Method, req.Host)
+        }
+        credentials := base64.StdEncoding.EncodeToString([]byte("alice:s3cret"))
+        if got := req.Header.Get("Proxy-Authorization"); got != "Basic "+credentials {
+            t.Errorf("Proxy-Authorization = %q", got)
+        }
+
+        resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+        if status == http.StatusOK {
+            resp += greeting
+        }
+        conn.Write([]byte(resp))
+        io.Copy(io.Discard, conn)
+    })
+}
+
+// readN reads n bytes from conn
+func readN(t *testing.T, conn net.Conn, n int) string {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    buf := make([]byte, n)
+    if _, err := io.ReadFull(conn, buf); err != nil {
+        t.Fatal(err)
+    }
+    return string(buf)
+}
+
+func TestHTTPConnect(t *testing.T) {
+    addr := connectProxy(t, http.StatusOK, "hello")
+    conn, err := dialThrough(t, "http://alice:s3cret@"+addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    // The relay's first bytes arrived with the proxy's response
+    if got := readN(t, conn, 5); got != "hello" {
+        t.Fatalf("read %q after CONNECT", got)
+    }
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+    addr := connectProxy(t, http.StatusProxyAuthRequired, "")
+    if conn, err := dialThrough(t, "http://alice:s3cret@"+addr); err == nil {
+        conn.Close()
+        t.Fatal("dial succeeded through a proxy that refused CONNECT")
+    }
+}
+
+// socksProxy is a SOCKS5 proxy requiring alice:s3cret that connects every
+// request to a peer greeting with "hello"
+func socksProxy(t *testing.T) string {
+    return fakeProxy(t, func(conn net.Conn) {
+        greeting := make([]byte, 4)
+        if _, err := io.ReadFull(conn, greeting); err != nil {
+            t.Errorf("reading greeting: %v", err)
+            return
+        }
+        if !bytes.Equal(greeting, []byte{socksVersion, 2, socksAuthNone, socksAuthPassword}) {
+            t.Errorf("greeting %v", greeting)
+            return
+        }
+        conn.Write([]byte{socksVersion, socksAuthPassword})
+
+        // RFC 1929: VER ULEN UNAME PLEN PASSWD
+        reader := bufio.NewReader(conn)
+        field := func() string {
+            length, err := reader.ReadByte()
+            if err != nil {
+                return ""
+            }
+            value := make([]byte, length)
+            io.ReadFull(reader, value)
+            return string(value)
+        }
+        if version, err := reader.ReadByte(); err != nil || version != 0x01 {
+            t.Errorf("auth version %d, %v", version, err)
+            return
+        }
+        if username, password := field(), field(); username != "alice" || password != "s3cret" {
+            conn.Write([]byte{0x01, 0x01})
+            return
+        }
+        conn.Write([]byte{0x01, 0x00})
+
+        host := "relay.example.com"
+        request := make([]byte, 5+len(host)+2)
+        if _, err := io.ReadFull(reader, request); err != nil {
+            t.Errorf("reading request: %v", err)
+            return
+        }
+        want := append([]byte{socksVersion, socksCmdConnect, 0, socksAddrDomain, byte(len(host))}, host...)
+        want = append(want, 0x1b, 0x58)
+        if !bytes.Equal(request, want) {
+            t.Errorf("request %v, want %v", request, want)
+            return
+        }
+        conn.Write([]byte{socksVersion, socksReplySucceeded, 0, socksAddrIPv4, 192, 0, 2, 7, 0x1b, 0x58})
+        conn.Write([]byte("hello"))
+        io.Copy(io.Discard, conn)
+    })
+}
+
+func TestSOCKSConnect(t *testing.T) {
+    conn, err := dialThrough(t, "socks5://alice:s3cret@"+socksProxy(t))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    if got := readN(t, conn, 5); got != "hello" {
+        t.Fatalf("read %q after connecting", got)
+    }
+}
+
+func TestSOCKSConnectBadPassword(t *testing.T) {
+    if conn, err := dialThrough(t, "socks5://alice:wrong@"+socksProxy(t)); err == nil {
+        conn.Close()
+        t.Fatal("dial succeeded with the wrong SOCKS5 password")
+    }
+}
+
+func TestProxyAddr(t *testing.T) {
+    tests := map[string]string{
+        "http://proxy.test":          "proxy.test:80",
+        "https://proxy.test":         "proxy.test:443",
+        "socks5://proxy.test":        "proxy.test:1080",
+        "socks5h://proxy.test":       "proxy.test:1080",
+        "http://proxy.test:3128":     "proxy.test:3128",
+        "https://[2001:db8::1]":      "[2001:db8::1]:443",
+        "socks5://u:p@proxy.test:99": "proxy.test:99",
+    }
+    for raw, want := range tests {
+        proxyURL, err := ParseProxyURL(raw)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := proxyAddr(proxyURL); got != want {
+            t.Errorf("proxyAddr(%s) = %s, want %s", raw, got, want)
+        }
+    }
+
+    for _, raw := range []string{"ftp://proxy.test", "http://", "proxy.test:3128"} {
+        if _, err := ParseProxyURL(raw); err == nil {
+            t.Errorf("ParseProxyURL(%q) succeeded", raw)
+        }
+    }
+}
+
+func TestEnvironmentProxy(t *testing.T) {
+    t.Setenv("HTTPS_PROXY", "http://proxy.test:3128")
+    t.Setenv("NO_PROXY", "relay.internal,.corp.test")
+
+    tests := map[string]*url.URL{
+        "relay.example.com:7000": {Scheme: "http", Host: "proxy.test:3128"},
+        "relay.internal:7000":    nil,
+        "relay.corp.test:7000":   nil,
+        "127.0.0.1:7000":         nil,
+    }
+    for addr, want := range tests {
+        got, err := environmentProxy(addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if (got == nil) != (want == nil) || (got != nil && got.String() != want.String()) {
+            t.Errorf("environmentProxy(%s) = %v, want %v", addr, got, want)
+        }
+    }
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "net"
+    "net/netip"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// SetProxyProtocol makes the client prepend a PROXY protocol header with the
+// public user's address to every connection to the local service. version
+// is 1 for the text format, 2 for the binary one and 0 to disable. Must be
+// called before Start.
+func (c *TunnelClient) SetProxyProtocol(version int) error {
+    if version < 0 || version > 2 {
+        return fmt.Errorf("unsupported PROXY protocol version %d", version)
+    }
+    c.proxyProtocol = version
+    return nil
+}
+
+// proxyHeader builds a PROXY protocol header for a connection from source
+// to dest. Addresses that cannot be parsed produce an UNKNOWN/LOCAL header,
+// which tells the service to use the connection's own addresses.
+func proxyHeader(version int, source, dest string) []byte {
+    srcIP, srcPort, srcOK := splitAddr(source)
+    dstIP, dstPort, dstOK := splitAddr(dest)
+    known := srcOK && dstOK
+
+    // Both addresses must be of the same family, widen IPv4 if they differ
+    ipv4 := known && srcIP.To4() != nil && dstIP.To4() != nil
+    if ipv4 {
+        srcIP, dstIP = srcIP.To4(), dstIP.To4()
+    } else if known {
+        srcIP, dstIP = srcIP.To16(), dstIP.To16()
+    }
+
+    if version == 1 {
+        if !known {
+            return []byte("PROXY UNKNOWN\r\n")
+        }
+        if ipv4 {
+            return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcPort, dstPort))
+        }
+        // net.IP prints widened IPv4 dotted, which TCP6 lines can't hold
+        src, dst := netip.AddrFrom16([16]byte(srcIP)), netip.AddrFrom16([16]byte(dstIP))
+        return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", src, dst, srcPort, dstPort))
+    }
+
+    var header bytes.Buffer
+    header.Write(proxyV2Signature)
+    if !known {
+        // LOCAL command, unspecified family, no addresses
+        header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+        return header.Bytes()
+    }
+
+    family := byte(0x21) // TCP over IPv6
+    if ipv4 {
+        family = 0x11 // TCP over IPv4
+    }
+    header.Write([]byte{0x21, family}) // version 2, PROXY command
+
+    addrs := make([]byte, 0, 2*len(srcIP)+4)
+    addrs = append(addrs, srcIP...)
+    addrs = append(addrs, dstIP...)
+    addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+    addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+
+    binary.Write(&header, binary.BigEndian, uint16(len(addrs)))
+    header.Write(addrs)
+    return header.Bytes()
+}
+
+// splitAddr parses an ip:port address
+func splitAddr(addr string) (net.IP, int, bool) {
+    addrPort, err := netip.ParseAddrPort(addr)
+    if err != nil {
+        return nil, 0, false
+    }
+    return net.IP(addrPort.Addr().Unmap().AsSlice()), int(addrPort.Port()), true
+}
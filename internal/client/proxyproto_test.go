@@ -0,0 +1,70 @@
+package client
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestProxyHeader(t *testing.T) {
+    v2 := func(rest ...byte) []byte {
+        return append(append([]byte{}, proxyV2Signature...), rest...)
+    }
+    tests := []struct {
+        name         string
+        version      int
+        source, dest string
+        want         []byte
+    }{
+        {"v1 IPv4", 1, "203.0.113.7:4000", "198.51.100.1:80", []byte("PROXY TCP4 203.0.113.7 198.51.100.1 4000 80\r\n")},
+        {"v1 IPv6", 1, "[2001:db8::7]:4000", "[2001:db8::1]:80", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 4000 80\r\n")},
+        {"v1 mixed", 1, "[2001:db8::7]:4000", "198.51.100.1:80", []byte("PROXY TCP6 2001:db8::7 ::ffff:198.51.100.1 4000 80\r\n")},
+        {"v1 unknown", 1, "", "", []byte("PROXY UNKNOWN\r\n")},
+        {"v2 IPv4", 2, "203.0.113.7:4000", "198.51.100.1:80", v2(0x21, 0x11, 0, 12, 203, 0, 113, 7, 198, 51, 100, 1, 0x0f, 0xa0, 0, 80)},
+        {"v2 local", 2, "", "", v2Local()},
+    }
+    for _, test := range tests {
+        if got := proxyHeader(test.version, test.source, test.dest); !bytes.Equal(got, test.want) {
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+    }
+}
+
+func TestProbesSendNoUserAddress(t *testing.T) {
+    for version, want := range map[int][]byte{1: []byte("PROXY UNKNOWN\r\n"), 2: v2Local()} {
+        local, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer local.Close()
+        c, _ := newTestClient(t, local.Addr().String())
+        c.SetProxyProtocol(version)
+
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        probe, err := c.dialProbe(ctx)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer probe.Close()
+
+        conn, err := local.Accept()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        got := make([]byte, len(want))
+        if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, want) {
+            t.Errorf("v%d probe sent %q, %v, want %q", version, got, err, want)
+        }
+    }
+}
+
+// v2Local is the PROXY v2 header of a connection made by the proxy itself
+func v2Local() []byte {
+    return append(append([]byte{}, proxyV2Signature...), 0x20, 0, 0, 0)
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "io"
+    "log"
+    "net"
+    "sync"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// streamAccepter is implemented by relay connections that carry each user
+// connection on a stream of its own
+type streamAccepter interface {
+    AcceptStream(ctx context.Context) (net.Conn, error)
+}
+
+// acceptUserStreams handles the streams the relay opens for user
+// connections until the relay connection closes
+func (c *TunnelClient) acceptUserStreams(streams streamAccepter) {
+    defer c.wg.Done()
+    for {
+        stream, err := streams.AcceptStream(context.Background())
+        if err != nil {
+            select {
+            case <-c.shutdown:
+            default:
+                log.Printf("Stopped accepting user streams: %v", err)
+            }
+            return
+        }
+
+        c.wg.Add(1)
+        go c.handleUserStream(stream)
+    }
+}
+
+// handleUserStream reads the connect message a stream starts with, then
+// copies bytes between the stream and the local service
+func (c *TunnelClient) handleUserStream(stream net.Conn) {
+    defer c.wg.Done()
+    defer stream.Close()
+
+    reader := bufio.NewReader(stream)
+    var msg protocol.ClientMessage
+    line, err := reader.ReadBytes('\n')
+    if err == nil {
+        err = json.Unmarshal(line, &msg)
+    }
+    if err != nil {
+        log.Printf("Error reading user stream header: %v", err)
+        return
+    }
+    log.Printf("New user connection: %s from %s", msg.UserID, msg.SourceAddr)
+
+    // Tell the relay whether the user got through before any data
+    localConn, err := c.dialLocal(msg)
+    result := protocol.ClientMessage{Type: protocol.MessageTypeConnectResult}
+    if err != nil {
+        log.Printf("Failed to connect to local service for user %s: %v", msg.UserID, err)
+        result.Error = err.Error()
+    }
+    encoder := json.NewEncoder(stream)
+    if err := encoder.Encode(result); err != nil || result.Error != "" {
+        if localConn != nil {
+            localConn.Close()
+        }
+        return
+    }
+    defer localConn.Close()
+
+    // A direction that ends cleanly only shuts down its write side, the
+    // other keeps flowing. Anything else closes both.
+    finish := func(err error, dst net.Conn) {
+        if err == nil && closeWrite(dst) == nil {
+            return
+        }
+        localConn.Close()
+        stream.Close()
+    }
+
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        _, err := io.Copy(localConn, reader)
+        finish(err, localConn)
+    }()
+    _, err = io.Copy(stream, localConn)
+    finish(err, stream)
+    wg.Wait()
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/quicconn"
+    "github.com/euphoricair7/tun/internal/server"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// freeAddr returns a loopback address nothing listens on right now
+func freeAddr(t *testing.T, network string) string {
+    t.Helper()
+    var addr string
+    switch network {
+    case "udp":
+        conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        addr = conn.LocalAddr().String()
+        conn.Close()
+    default:
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        addr = listener.Addr().String()
+        listener.Close()
+    }
+    return addr
+}
+
+func TestQUICTunnel(t *testing.T) {
+    // A local service that answers once the user finished sending
+    local, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer local.Close()
+    go func() {
+        for {
+            conn, err := local.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                request, _ := io.ReadAll(conn)
+                conn.Write(append([]byte("got "), request...))
+            }()
+        }
+    }()
+
+    cert, roots := selfSigned(t)
+    _, registration, _ := net.SplitHostPort(freeAddr(t, "tcp"))
+    _, public, _ := net.SplitHostPort(freeAddr(t, "tcp"))
+    registrationPort, _ := strconv.Atoi(registration)
+    publicPort, _ := strconv.Atoi(public)
+    quicAddr := freeAddr(t, "udp")
+    relay, err := server.NewRelayServer(registrationPort, publicPort, publicPort)
+    if err != nil {
+        t.Fatal(err)
+    }
+    relay.SetQUICAddr(quicAddr, &tls.Config{Certificates: []tls.Certificate{cert}})
+    go relay.Start()
+    defer relay.Shutdown()
+
+    servicePort := local.Addr().(*net.TCPAddr).Port
+    c, err := NewTunnelClient("127.0.0.1", registrationPort, "127.0.0.1", servicePort)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.SetQUICAddr(quicAddr, &tls.Config{RootCAs: roots})
+    c.SetCompression(0) // dropped, QUIC carries no data frames
+    for deadline := time.Now().Add(5 * time.Second); ; {
+        if err = c.Start(); err == nil {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal(err)
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+    defer c.Shutdown()
+
+    // Users get streams of their own and keep half-closes
+    users := make([]net.Conn, 2)
+    for i := range users {
+        users[i], err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", public))
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer users[i].Close()
+        users[i].SetDeadline(time.Now().Add(5 * time.Second))
+        fmt.Fprintf(users[i], "hello %d", i)
+    }
+    for i, user := range users {
+        user.(*net.TCPConn).CloseWrite()
+        response, err := io.ReadAll(user)
+        if want := fmt.Sprintf("got hello %d", i); err != nil || string(response) != want {
+            t.Errorf("user %d got %q, %v, want %q", i, response, err, want)
+        }
+    }
+    c.userConnMutex.RLock()
+    framed := len(c.userConns)
+    c.userConnMutex.RUnlock()
+    if framed != 0 {
+        t.Errorf("%d users went over the control stream", framed)
+    }
+
+    // A failed connect result on the stream closes the user
+    local.Close()
+    user, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", public))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer user.Close()
+    user.SetDeadline(time.Now().Add(5 * time.Second))
+    if response, err := io.ReadAll(user); err != nil || len(response) != 0 {
+        t.Errorf("user of a down service got %q, %v, want EOF", response, err)
+    }
+
+    // Clients asking for compression anyway are turned away
+    control, err := quicconn.Dial(context.Background(), quicAddr, &tls.Config{RootCAs: roots})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer control.Close()
+    control.SetDeadline(time.Now().Add(5 * time.Second))
+    req := protocol.RegistrationRequest{LocalHost: "127.0.0.1", LocalPort: servicePort, Compression: protocol.CompressionDeflate}
+    if err := json.NewEncoder(control).Encode(req); err != nil {
+        t.Fatal(err)
+    }
+    var resp protocol.RegistrationResponse
+    if err := json.NewDecoder(control).Decode(&resp); err != nil || resp.Success {
+        t.Errorf("compressed registration over QUIC got %+v, %v", resp, err)
+    }
+}
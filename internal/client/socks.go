@@ -0,0 +1,180 @@
+package client
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// SOCKS5 constants from RFC 1928
+const (
+    socksVersion      = 0x05
+    socksAuthNone     = 0x00
+    socksAuthPassword = 0x02
+    socksNoAcceptable = 0xff
+    socksCmdConnect   = 0x01
+    socksAddrIPv4     = 0x01
+    socksAddrDomain   = 0x03
+    socksAddrIPv6     = 0x04
+
+    socksReplySucceeded       = 0x00
+    socksReplyNotAllowed      = 0x02
+    socksReplyHostUnreachable = 0x04
+    socksReplyCmdUnsupported  = 0x07
+    socksReplyAddrUnsupported = 0x08
+)
+
+// SetSOCKSListenAddr runs a SOCKS5 server on addr whose CONNECT requests are
+// dialed by the relay. Anyone who reaches it can use the relay, so addr has
+// to be a loopback address. Must be called before Start.
+func (c *TunnelClient) SetSOCKSListenAddr(addr string) {
+    c.socksAddr = addr
+}
+
+// loopbackAddr reports whether a listen address only accepts connections
+// from the local machine
+func loopbackAddr(addr string) bool {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return false
+    }
+    if strings.EqualFold(host, "localhost") {
+        return true
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.IsLoopback()
+}
+
+// acceptSOCKSConnections handles connections on the local SOCKS5 listener
+func (c *TunnelClient) acceptSOCKSConnections(listener net.Listener) {
+    defer c.wg.Done()
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            select {
+            case <-c.shutdown:
+                return
+            default:
+                log.Printf("Error accepting SOCKS connection: %v", err)
+                return
+            }
+        }
+
+        go c.handleSOCKSConnection(conn)
+    }
+}
+
+// handleSOCKSConnection negotiates a SOCKS5 CONNECT and streams the
+// connection through the relay
+func (c *TunnelClient) handleSOCKSConnection(conn net.Conn) {
+    target, err := socksHandshake(conn)
+    if err != nil {
+        log.Printf("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+        conn.Close()
+        return
+    }
+
+    // The reply has to go out before any relayed data, so it is sent from
+    // the open callback rather than after openThroughRelay returns
+    err = c.openThroughRelay(conn, target, func(openErr string) error {
+        reply := byte(socksReplySucceeded)
+        if openErr != "" {
+            reply = socksReplyHostUnreachable
+            if strings.Contains(openErr, "not allowed") {
+                reply = socksReplyNotAllowed
+            }
+        }
+        return writeSOCKSReply(conn, reply)
+    })
+    if err != nil {
+        log.Printf("Failed to open %s through relay: %v", target, err)
+        conn.Close()
+    }
+}
+
+// socksHandshake reads the method negotiation and request and returns the
+// host:port of a CONNECT request
+func socksHandshake(conn net.Conn) (string, error) {
+    // Method negotiation, we only offer "no authentication" since the
+    // listener is meant for the local machine
+    header := make([]byte, 2)
+    if _, err := io.ReadFull(conn, header); err != nil {
+        return "", err
+    }
+    if header[0] != socksVersion {
+        return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+    }
+    methods := make([]byte, header[1])
+    if _, err := io.ReadFull(conn, methods); err != nil {
+        return "", err
+    }
+    method := byte(socksNoAcceptable)
+    for _, m := range methods {
+        if m == socksAuthNone {
+            method = socksAuthNone
+        }
+    }
+    if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+        return "", err
+    }
+    if method == socksNoAcceptable {
+        return "", errors.New("client offered no supported authentication method")
+    }
+
+    // Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+    request := make([]byte, 4)
+    if _, err := io.ReadFull(conn, request); err != nil {
+        return "", err
+    }
+    if request[1] != socksCmdConnect {
+        writeSOCKSReply(conn, socksReplyCmdUnsupported)
+        return "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+    }
+
+    var host string
+    switch request[3] {
+    case socksAddrIPv4, socksAddrIPv6:
+        size := net.IPv4len
+        if request[3] == socksAddrIPv6 {
+            size = net.IPv6len
+        }
+        ip := make([]byte, size)
+        if _, err := io.ReadFull(conn, ip); err != nil {
+            return "", err
+        }
+        host = net.IP(ip).String()
+    case socksAddrDomain:
+        length := make([]byte, 1)
+        if _, err := io.ReadFull(conn, length); err != nil {
+            return "", err
+        }
+        domain := make([]byte, length[0])
+        if _, err := io.ReadFull(conn, domain); err != nil {
+            return "", err
+        }
+        host = string(domain)
+    default:
+        writeSOCKSReply(conn, socksReplyAddrUnsupported)
+        return "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+    }
+
+    port := make([]byte, 2)
+    if _, err := io.ReadFull(conn, port); err != nil {
+        return "", err
+    }
+
+    return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKSReply sends a reply with an unspecified bound address, the
+// real one lives on the relay and means nothing to the local client
+func writeSOCKSReply(conn net.Conn, reply byte) error {
+    _, err := conn.Write([]byte{socksVersion, reply, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+    return err
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+    "bytes"
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+// socksExchange runs socksHandshake against what a SOCKS client sends and
+// returns its result and everything written back
+func socksExchange(t *testing.T, sent []byte) (string, []byte, error) {
+    t.Helper()
+    server, client := net.Pipe()
+    defer client.Close()
+
+    type result struct {
+        target string
+        err    error
+    }
+    done := make(chan result, 1)
+    go func() {
+        target, err := socksHandshake(server)
+        server.Close()
+        done <- result{target, err}
+    }()
+
+    client.SetDeadline(time.Now().Add(5 * time.Second))
+    go client.Write(sent)
+    reply, _ := io.ReadAll(client)
+    r := <-done
+    return r.target, reply, r.err
+}
+
+func TestSOCKSHandshake(t *testing.T) {
+    greeting := []byte{socksVersion, 2, socksAuthPassword, socksAuthNone}
+    connect := func(addr ...byte) []byte {
+        request := append(append([]byte{}, greeting...), socksVersion, socksCmdConnect, 0)
+        return append(request, addr...)
+    }
+    tests := []struct {
+        name string
+        sent []byte
+        want string
+    }{
+        {"IPv4", connect(socksAddrIPv4, 192, 0, 2, 7, 0, 22), "192.0.2.7:22"},
+        {"IPv6", connect(socksAddrIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb), "[2001:db8::1]:443"},
+        {"domain", connect(socksAddrDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80), "example.com:80"},
+    }
+    for _, test := range tests {
+        target, reply, err := socksExchange(t, test.sent)
+        if err != nil || target != test.want {
+            t.Errorf("%s: got %q, %v, want %s", test.name, target, err, test.want)
+        }
+        // Only the method choice is sent, the reply waits for the relay
+        if !bytes.Equal(reply, []byte{socksVersion, socksAuthNone}) {
+            t.Errorf("%s: replied %v", test.name, reply)
+        }
+    }
+}
+
+func TestSOCKSHandshakeRefusals(t *testing.T) {
+    tests := []struct {
+        name  string
+        sent  []byte
+        reply []byte
+    }{
+        {"SOCKS4", []byte{0x04, 1, 0, 80}, nil},
+        {"password only", []byte{socksVersion, 1, socksAuthPassword}, []byte{socksVersion, socksNoAcceptable}},
+        {"BIND", []byte{socksVersion, 1, socksAuthNone, socksVersion, 0x02, 0, socksAddrIPv4, 192, 0, 2, 7, 0, 22},
+            []byte{socksVersion, socksAuthNone, socksVersion, socksReplyCmdUnsupported, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0}},
+        {"address type", []byte{socksVersion, 1, socksAuthNone, socksVersion, socksCmdConnect, 0, 0x05},
+            []byte{socksVersion, socksAuthNone, socksVersion, socksReplyAddrUnsupported, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0}},
+    }
+    for _, test := range tests {
+        _, reply, err := socksExchange(t, test.sent)
+        if err == nil {
+            t.Errorf("%s: handshake succeeded", test.name)
+        }
+        if !bytes.Equal(reply, test.reply) {
+            t.Errorf("%s: replied %v, want %v", test.name, reply, test.reply)
+        }
+    }
+}
+
+func TestSOCKSListensOnLoopbackOnly(t *testing.T) {
+    tests := map[string]bool{
+        "127.0.0.1:1080": true,
+        "[::1]:1080":     true,
+        "localhost:1080": true,
+        ":1080":          false,
+        "0.0.0.0:1080":   false,
+        "192.0.2.7:1080": false,
+        "1080":           false,
+    }
+    for addr, want := range tests {
+        if got := loopbackAddr(addr); got != want {
+            t.Errorf("loopbackAddr(%q) = %v, want %v", addr, got, want)
+        }
+    }
+
+    c, err := NewTunnelClient("127.0.0.1", 1, "127.0.0.1", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.SetSOCKSListenAddr(":1080")
+    if err := c.Start(); err == nil {
+        c.Shutdown()
+        t.Fatal("started a SOCKS proxy on every interface")
+    }
+}
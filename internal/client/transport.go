@@ -0,0 +1,69 @@
+package client
+
+import (
+    "context"
+    "crypto/tls"
+    "net"
+    "strconv"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/noiseconn"
+    "github.com/euphoricair7/tun/internal/quicconn"
+    "github.com/euphoricair7/tun/internal/websocket"
+)
+
+// relayDialTimeout bounds connecting to the relay, including handshakes
+const relayDialTimeout = 30 * time.Second
+
+// SetWebSocketURL makes the client reach the relay through a WebSocket
+// upgrade at rawURL, e.g. wss://relay.example.com/.tun/control, instead of
+// the raw registration port. tlsConfig is used for wss:// URLs and may be
+// nil. Must be called before Start.
+func (c *TunnelClient) SetWebSocketURL(rawURL string, tlsConfig *tls.Config) {
+    c.webSocketURL = rawURL
+    c.tlsConfig = tlsConfig
+}
+
+// SetQUICAddr makes the client reach the relay over QUIC at addr, the
+// relay's UDP host:port, instead of the raw registration port. Each user
+// connection then gets its own stream. tlsConfig may be nil to trust the
+// system roots. Must be called before Start.
+func (c *TunnelClient) SetQUICAddr(addr string, tlsConfig *tls.Config) {
+    c.quicAddr = addr
+    c.tlsConfig = tlsConfig
+}
+
+// SetNoise makes the client reach the relay at addr, its Noise address,
+// over a control connection encrypted with Noise. relayKey is the relay's
+// public key, the handshake fails against anyone else. Must be called
+// before Start.
+func (c *TunnelClient) SetNoise(addr string, relayKey []byte) {
+    c.noiseAddr = addr
+    c.noiseKey = relayKey
+}
+
+// dialRelay opens the control connection to the relay
+func (c *TunnelClient) dialRelay() (net.Conn, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), relayDialTimeout)
+    defer cancel()
+
+    if c.quicAddr != "" {
+        return quicconn.Dial(ctx, c.quicAddr, c.tlsConfig)
+    }
+    if c.noiseAddr != "" {
+        conn, err := c.dialContext(ctx, "tcp", c.noiseAddr)
+        if err != nil {
+            return nil, err
+        }
+        noiseConn, err := noiseconn.Client(conn, c.noiseKey)
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        return noiseConn, nil
+    }
+    if c.webSocketURL != "" {
+        return websocket.Dial(ctx, c.webSocketURL, c.dialContext, c.tlsConfig)
+    }
+    return c.dialContext(ctx, "tcp", net.JoinHostPort(c.relayHost, strconv.Itoa(c.relayPort)))
+}
@@ -0,0 +1,177 @@
+package cluster
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const (
+    lockRetryInterval = 10 * time.Millisecond
+    lockTimeout       = 5 * time.Second
+    staleLockAge      = 30 * time.Second
+)
+
+// FileRegistry keeps the registry in a JSON file on storage shared by all
+// relay instances, for example an NFS mount. Updates are serialized with a
+// lock file next to it.
+type FileRegistry struct {
+    path string
+    ttl  time.Duration
+}
+
+// NewFileRegistry creates a registry backed by the file at path
+func NewFileRegistry(path string, ttl time.Duration) *FileRegistry {
+    return &FileRegistry{
+        path: path,
+        ttl:  ttl,
+    }
+}
+
+// Claim records or refreshes the claim of entry.Instance on entry.Port
+func (r *FileRegistry) Claim(entry Entry) error {
+    return r.update(func(entries map[int]Entry) error {
+        existing, exists := entries[entry.Port]
+        if exists && existing.Instance != entry.Instance && live(existing, r.ttl) {
+            return ErrPortClaimed
+        }
+
+        entry.UpdatedAt = time.Now()
+        entries[entry.Port] = entry
+        return nil
+    })
+}
+
+// Release removes the claim instance holds on port
+func (r *FileRegistry) Release(port int, instance string) error {
+    return r.update(func(entries map[int]Entry) error {
+        if existing, exists := entries[port]; exists && existing.Instance == instance {
+            delete(entries, port)
+        }
+        return nil
+    })
+}
+
+// List returns all live entries
+func (r *FileRegistry) List() ([]Entry, error) {
+    entries, err := r.read()
+    if err != nil {
+        return nil, err
+    }
+
+    result := make([]Entry, 0, len(entries))
+    for _, entry := range entries {
+        if live(entry, r.ttl) {
+            result = append(result, entry)
+        }
+    }
+    return result, nil
+}
+
+// update applies fn to the registry contents while holding the lock
+func (r *FileRegistry) update(fn func(entries map[int]Entry) error) error {
+    unlock, err := r.lock()
+    if err != nil {
+        return err
+    }
+    defer unlock()
+
+    entries, err := r.read()
+    if err != nil {
+        return err
+    }
+
+    if err := fn(entries); err != nil {
+        return err
+    }
+
+    // Drop expired entries so the file does not grow forever
+    for port, entry := range entries {
+        if !live(entry, r.ttl) {
+            delete(entries, port)
+        }
+    }
+
+    return r.write(entries)
+}
+
+// read loads the registry file, a missing file is an empty registry
+func (r *FileRegistry) read() (map[int]Entry, error) {
+    entries := make(map[int]Entry)
+
+    data, err := os.ReadFile(r.path)
+    if err != nil {
+        if errors.Is(err, os.ErrNotExist) {
+            return entries, nil
+        }
+        return nil, fmt.Errorf("failed to read registry file: %w", err)
+    }
+
+    var list []Entry
+    if err := json.Unmarshal(data, &list); err != nil {
+        return nil, fmt.Errorf("failed to parse registry file: %w", err)
+    }
+    for _, entry := range list {
+        entries[entry.Port] = entry
+    }
+    return entries, nil
+}
+
+// write replaces the registry file atomically
+func (r *FileRegistry) write(entries map[int]Entry) error {
+    list := make([]Entry, 0, len(entries))
+    for _, entry := range entries {
+        list = append(list, entry)
+    }
+
+    data, err := json.MarshalIndent(list, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".tmp*")
+    if err != nil {
+        return fmt.Errorf("failed to write registry file: %w", err)
+    }
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return fmt.Errorf("failed to write registry file: %w", err)
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return fmt.Errorf("failed to write registry file: %w", err)
+    }
+    return os.Rename(tmp.Name(), r.path)
+}
+
+// lock acquires the registry lock file, breaking locks left behind by
+// instances that crashed while holding them
+func (r *FileRegistry) lock() (func(), error) {
+    lockPath := r.path + ".lock"
+    deadline := time.Now().Add(lockTimeout)
+
+    for {
+        f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+        if err == nil {
+            f.Close()
+            return func() { os.Remove(lockPath) }, nil
+        }
+        if !errors.Is(err, os.ErrExist) {
+            return nil, fmt.Errorf("failed to lock registry file: %w", err)
+        }
+
+        if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+            os.Remove(lockPath)
+            continue
+        }
+
+        if time.Now().After(deadline) {
+            return nil, fmt.Errorf("timed out waiting for registry lock %s", lockPath)
+        }
+        time.Sleep(lockRetryInterval)
+    }
+}
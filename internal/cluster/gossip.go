@@ -0,0 +1,179 @@
+package cluster
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/noiseconn"
+)
+
+// GossipInterval is how often a GossipRegistry pushes its claims to peers
+const GossipInterval = 2 * time.Second
+
+// GossipRegistry keeps a local copy of the registry and periodically pushes
+// the claims of this instance to every peer, which replace whatever they
+// knew about it. It needs no shared storage, but claims only propagate
+// after a gossip round, so instances should be given disjoint port ranges.
+// Gossip is exchanged over Noise keyed with the cluster secret, so only
+// relays holding it can announce claims.
+type GossipRegistry struct {
+    instance string
+    peers    []string
+    secret   []byte
+    state    *MemoryRegistry
+    listener net.Listener
+    shutdown chan struct{}
+    wg       sync.WaitGroup
+}
+
+// gossipMessage carries every claim an instance currently holds
+type gossipMessage struct {
+    Instance string  `json:"instance"`
+    Entries  []Entry `json:"entries"`
+}
+
+// NewGossipRegistry creates a registry for instance that listens for gossip
+// on listenAddr and pushes its own claims to peers. Every relay of the
+// cluster must be given the same secret.
+func NewGossipRegistry(instance, listenAddr string, peers []string, ttl time.Duration, secret []byte) (*GossipRegistry, error) {
+    if len(secret) == 0 {
+        return nil, fmt.Errorf("gossip needs a cluster secret")
+    }
+    listener, err := net.Listen("tcp", listenAddr)
+    if err != nil {
+        return nil, fmt.Errorf("failed to start gossip listener: %w", err)
+    }
+
+    r := &GossipRegistry{
+        instance: instance,
+        peers:    peers,
+        secret:   secret,
+        state:    NewMemoryRegistry(ttl),
+        listener: listener,
+        shutdown: make(chan struct{}),
+    }
+
+    r.wg.Add(2)
+    go r.acceptGossip()
+    go r.pushLoop()
+
+    return r, nil
+}
+
+// Claim records or refreshes a claim in the local copy
+func (r *GossipRegistry) Claim(entry Entry) error {
+    return r.state.Claim(entry)
+}
+
+// Release removes a claim from the local copy, peers learn about it on the
+// next push
+func (r *GossipRegistry) Release(port int, instance string) error {
+    return r.state.Release(port, instance)
+}
+
+// List returns all live entries known to this instance
+func (r *GossipRegistry) List() ([]Entry, error) {
+    return r.state.List()
+}
+
+// Close stops gossiping
+func (r *GossipRegistry) Close() error {
+    close(r.shutdown)
+    err := r.listener.Close()
+    r.wg.Wait()
+    return err
+}
+
+// acceptGossip merges the claims pushed by peers
+func (r *GossipRegistry) acceptGossip() {
+    defer r.wg.Done()
+
+    for {
+        conn, err := r.listener.Accept()
+        if err != nil {
+            select {
+            case <-r.shutdown:
+                return
+            default:
+                log.Printf("Error accepting gossip connection: %v", err)
+                time.Sleep(100 * time.Millisecond)
+                continue
+            }
+        }
+
+        go func() {
+            defer conn.Close()
+
+            peerConn, err := noiseconn.PeerServer(conn, r.secret)
+            if err != nil {
+                log.Printf("Rejected gossip from %s: %v", conn.RemoteAddr(), err)
+                return
+            }
+            conn.SetReadDeadline(time.Now().Add(GossipInterval))
+
+            var msg gossipMessage
+            if err := json.NewDecoder(peerConn).Decode(&msg); err != nil {
+                log.Printf("Error decoding gossip from %s: %v", conn.RemoteAddr(), err)
+                return
+            }
+            if msg.Instance == "" || msg.Instance == r.instance {
+                return
+            }
+            if rejected := r.state.replaceInstance(msg.Instance, msg.Entries); rejected > 0 {
+                log.Printf("Ignored %d claims from instance %s at %s for tunnels it does not own",
+                    rejected, msg.Instance, conn.RemoteAddr())
+            }
+        }()
+    }
+}
+
+// pushLoop periodically sends the claims of this instance to every peer
+func (r *GossipRegistry) pushLoop() {
+    defer r.wg.Done()
+
+    ticker := time.NewTicker(GossipInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-r.shutdown:
+            return
+        case <-ticker.C:
+            r.push()
+        }
+    }
+}
+
+// push sends the claims of this instance to every peer
+func (r *GossipRegistry) push() {
+    all, _ := r.state.List()
+    msg := gossipMessage{Instance: r.instance, Entries: []Entry{}}
+    for _, entry := range all {
+        if entry.Instance == r.instance {
+            msg.Entries = append(msg.Entries, entry)
+        }
+    }
+
+    for _, peer := range r.peers {
+        conn, err := net.DialTimeout("tcp", peer, GossipInterval)
+        if err != nil {
+            log.Printf("Error gossiping to %s: %v", peer, err)
+            continue
+        }
+        peerConn, err := noiseconn.PeerClient(conn, r.secret)
+        if err != nil {
+            log.Printf("Error gossiping to %s: %v", peer, err)
+            conn.Close()
+            continue
+        }
+        conn.SetWriteDeadline(time.Now().Add(GossipInterval))
+        if err := json.NewEncoder(peerConn).Encode(msg); err != nil {
+            log.Printf("Error gossiping to %s: %v", peer, err)
+        }
+        conn.Close()
+    }
+}
@@ -0,0 +1,58 @@
+package cluster
+
+import (
+    "testing"
+    "time"
+)
+
+// newTestGossip starts a gossip registry on a free loopback port
+func newTestGossip(t *testing.T, instance string, secret string, peers ...string) *GossipRegistry {
+    t.Helper()
+    r, err := NewGossipRegistry(instance, "127.0.0.1:0", peers, DefaultTTL, []byte(secret))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { r.Close() })
+    return r
+}
+
+// waitForEntry polls r until port is routed or the wait is over
+func waitForEntry(r Registry, port int, wait time.Duration) (Entry, bool) {
+    for deadline := time.Now().Add(wait); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        if entry, found, _ := Lookup(r, port); found {
+            return entry, true
+        }
+    }
+    return Entry{}, false
+}
+
+func TestGossipSharesClaims(t *testing.T) {
+    receiver := newTestGossip(t, "b", "secret")
+    sender := newTestGossip(t, "a", "secret", receiver.listener.Addr().String())
+
+    sender.Claim(Entry{Port: 10000, Instance: "a", Addr: "10.0.0.1:5679"})
+    sender.push()
+
+    entry, found := waitForEntry(receiver, 10000, 2*time.Second)
+    if !found || entry.Instance != "a" {
+        t.Fatalf("receiver routes port 10000 to %+v, %v", entry, found)
+    }
+}
+
+func TestGossipRejectsOtherSecrets(t *testing.T) {
+    receiver := newTestGossip(t, "b", "secret")
+    intruder := newTestGossip(t, "evil", "guessed", receiver.listener.Addr().String())
+
+    intruder.Claim(Entry{Port: 10000, Instance: "evil", Addr: "10.0.0.66:5679"})
+    intruder.push()
+
+    if entry, found := waitForEntry(receiver, 10000, 300*time.Millisecond); found {
+        t.Fatalf("receiver accepted gossip without the secret: %+v", entry)
+    }
+}
+
+func TestGossipNeedsSecret(t *testing.T) {
+    if _, err := NewGossipRegistry("a", "127.0.0.1:0", nil, DefaultTTL, nil); err == nil {
+        t.Error("gossip registry started without a secret")
+    }
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+    "sync"
+    "time"
+)
+
+// MemoryRegistry keeps the registry in process memory. It is shared by
+// relays running in the same process and backs GossipRegistry.
+type MemoryRegistry struct {
+    ttl     time.Duration
+    entries map[int]Entry
+    mutex   sync.RWMutex
+}
+
+// NewMemoryRegistry creates an empty in-memory registry
+func NewMemoryRegistry(ttl time.Duration) *MemoryRegistry {
+    return &MemoryRegistry{
+        ttl:     ttl,
+        entries: make(map[int]Entry),
+    }
+}
+
+// Claim records or refreshes the claim of entry.Instance on entry.Port
+func (r *MemoryRegistry) Claim(entry Entry) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    existing, exists := r.entries[entry.Port]
+    if exists && existing.Instance != entry.Instance && live(existing, r.ttl) {
+        return ErrPortClaimed
+    }
+
+    entry.UpdatedAt = time.Now()
+    r.entries[entry.Port] = entry
+    return nil
+}
+
+// Release removes the claim instance holds on port
+func (r *MemoryRegistry) Release(port int, instance string) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if existing, exists := r.entries[port]; exists && existing.Instance == instance {
+        delete(r.entries, port)
+    }
+    return nil
+}
+
+// List returns all live entries
+func (r *MemoryRegistry) List() ([]Entry, error) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+
+    entries := make([]Entry, 0, len(r.entries))
+    for _, entry := range r.entries {
+        if live(entry, r.ttl) {
+            entries = append(entries, entry)
+        }
+    }
+    return entries, nil
+}
+
+// replaceInstance swaps every entry of instance for entries. An instance
+// only speaks for its own claims, entries naming another instance or a
+// port another instance holds are dropped and counted in rejected.
+func (r *MemoryRegistry) replaceInstance(instance string, entries []Entry) (rejected int) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    for port, existing := range r.entries {
+        if existing.Instance == instance {
+            delete(r.entries, port)
+        }
+    }
+    for _, entry := range entries {
+        if entry.Instance != instance || entry.Addr == "" {
+            rejected++
+            continue
+        }
+        // The first live claim on a port wins
+        if existing, exists := r.entries[entry.Port]; exists && live(existing, r.ttl) {
+            rejected++
+            continue
+        }
+        entry.UpdatedAt = time.Now()
+        r.entries[entry.Port] = entry
+    }
+    return rejected
+}
@@ -0,0 +1,53 @@
+package cluster
+
+import (
+    "errors"
+    "time"
+)
+
+// DefaultTTL is how long an entry stays valid without being refreshed by its owner
+const DefaultTTL = 15 * time.Second
+
+// ErrPortClaimed is returned when another live instance already holds a port
+var ErrPortClaimed = errors.New("port is claimed by another relay instance")
+
+// Entry records which relay instance holds the control connection for a tunnel
+type Entry struct {
+    Port      int       `json:"port"`
+    Instance  string    `json:"instance"`
+    Addr      string    `json:"addr"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Registry is the tunnel registry shared by all relay instances of a cluster
+type Registry interface {
+    // Claim records that entry.Instance owns the tunnel on entry.Port, or
+    // refreshes an existing claim. It fails with ErrPortClaimed if another
+    // instance holds a live claim on the port.
+    Claim(entry Entry) error
+
+    // Release removes the claim instance holds on port, if any
+    Release(port int, instance string) error
+
+    // List returns all live entries
+    List() ([]Entry, error)
+}
+
+// Lookup returns the live entry for port, if any
+func Lookup(r Registry, port int) (Entry, bool, error) {
+    entries, err := r.List()
+    if err != nil {
+        return Entry{}, false, err
+    }
+    for _, entry := range entries {
+        if entry.Port == port {
+            return entry, true, nil
+        }
+    }
+    return Entry{}, false, nil
+}
+
+// live reports whether an entry has been refreshed within ttl
+func live(entry Entry, ttl time.Duration) bool {
+    return time.Since(entry.UpdatedAt) < ttl
+}
@@ -0,0 +1,104 @@
+package cluster
+
+import (
+    "errors"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// registries returns every backend that can run inside a test
+func registries(t *testing.T, ttl time.Duration) map[string]Registry {
+    return map[string]Registry{
+        "memory": NewMemoryRegistry(ttl),
+        "file":   NewFileRegistry(filepath.Join(t.TempDir(), "registry.json"), ttl),
+    }
+}
+
+func TestRegistryRoutesToOwner(t *testing.T) {
+    for name, registry := range registries(t, DefaultTTL) {
+        t.Run(name, func(t *testing.T) {
+            if err := registry.Claim(Entry{Port: 10000, Instance: "a", Addr: "10.0.0.1:5679"}); err != nil {
+                t.Fatal(err)
+            }
+            if err := registry.Claim(Entry{Port: 10000, Instance: "b", Addr: "10.0.0.2:5679"}); !errors.Is(err, ErrPortClaimed) {
+                t.Fatalf("second claim on a live port: %v", err)
+            }
+
+            entry, found, err := Lookup(registry, 10000)
+            if err != nil || !found {
+                t.Fatalf("Lookup = %v, %v", found, err)
+            }
+            if entry.Instance != "a" || entry.Addr != "10.0.0.1:5679" {
+                t.Errorf("port routes to %s at %s, want a at 10.0.0.1:5679", entry.Instance, entry.Addr)
+            }
+
+            // Only the owner can release a claim
+            registry.Release(10000, "b")
+            if _, found, _ := Lookup(registry, 10000); !found {
+                t.Error("another instance released the claim")
+            }
+            registry.Release(10000, "a")
+            if _, found, _ := Lookup(registry, 10000); found {
+                t.Error("claim survived its release")
+            }
+            if err := registry.Claim(Entry{Port: 10000, Instance: "b", Addr: "10.0.0.2:5679"}); err != nil {
+                t.Errorf("claim on a released port: %v", err)
+            }
+        })
+    }
+}
+
+func TestRegistryStaleEntriesExpire(t *testing.T) {
+    const ttl = 50 * time.Millisecond
+    for name, registry := range registries(t, ttl) {
+        t.Run(name, func(t *testing.T) {
+            if err := registry.Claim(Entry{Port: 10001, Instance: "a", Addr: "10.0.0.1:5679"}); err != nil {
+                t.Fatal(err)
+            }
+            time.Sleep(2 * ttl)
+
+            // The owner stopped refreshing its claim, so it no longer routes
+            // and another instance can take over
+            if _, found, _ := Lookup(registry, 10001); found {
+                t.Error("stale entry still routes")
+            }
+            if err := registry.Claim(Entry{Port: 10001, Instance: "b", Addr: "10.0.0.2:5679"}); err != nil {
+                t.Fatalf("claim over a stale entry: %v", err)
+            }
+            if entry, _, _ := Lookup(registry, 10001); entry.Instance != "b" {
+                t.Errorf("port routes to %q, want b", entry.Instance)
+            }
+        })
+    }
+}
+
+func TestReplaceInstanceOnlyAcceptsOwnClaims(t *testing.T) {
+    registry := NewMemoryRegistry(DefaultTTL)
+    registry.Claim(Entry{Port: 10000, Instance: "local", Addr: "10.0.0.1:5679"})
+
+    rejected := registry.replaceInstance("peer", []Entry{
+        {Port: 10000, Instance: "peer", Addr: "10.0.0.66:5679"},  // held by another instance
+        {Port: 10001, Instance: "local", Addr: "10.0.0.66:5679"}, // speaks for another instance
+        {Port: 10002, Instance: "peer"},                          // nowhere to route to
+        {Port: 10003, Instance: "peer", Addr: "10.0.0.2:5679"},
+    })
+    if rejected != 3 {
+        t.Errorf("rejected %d entries, want 3", rejected)
+    }
+    if entry, _, _ := Lookup(registry, 10000); entry.Instance != "local" {
+        t.Errorf("port 10000 routes to %q, want local", entry.Instance)
+    }
+    if _, found, _ := Lookup(registry, 10001); found {
+        t.Error("peer announced a claim for another instance")
+    }
+    if entry, _, _ := Lookup(registry, 10003); entry.Instance != "peer" {
+        t.Errorf("port 10003 routes to %q, want peer", entry.Instance)
+    }
+
+    // A new round of gossip replaces what the peer said before
+    registry.replaceInstance("peer", nil)
+    if _, found, _ := Lookup(registry, 10003); found {
+        t.Error("claim the peer dropped is still routed")
+    }
+}
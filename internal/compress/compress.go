@@ -0,0 +1,164 @@
+package compress
+
+import (
+    "bytes"
+    "compress/flate"
+    "fmt"
+    "io"
+    "sync"
+
+    "github.com/euphoricair7/tun/internal/bufpool"
+)
+
+// DefaultThreshold is the smallest frame worth compressing when the client
+// does not pick a threshold
+const DefaultThreshold = 512
+
+// maxFrameSize bounds a decompressed frame, real frames are a few KiB
+const maxFrameSize = 1 << 20
+
+// After maxMisses frames in a row that barely shrink, a stream's frames are
+// sent as is for the next skipFrames frames before compression is tried again
+const (
+    maxMisses  = 3
+    skipFrames = 64
+)
+
+// Writers are large, so streams share them
+var writers = sync.Pool{
+    New: func() any {
+        writer, _ := flate.NewWriter(nil, flate.DefaultCompression)
+        return writer
+    },
+}
+
+// Readers keep a window of their own, so they are reused as well
+var readers sync.Pool
+
+// Compressor deflates the frames of one stream. Frames below the threshold
+// and content that does not shrink, such as images or gzip responses, are
+// left alone. A nil Compressor leaves every frame alone.
+type Compressor struct {
+    threshold int
+    misses    int // frames in a row that did not shrink
+    skip      int // frames left to send as is
+    buffer    bytes.Buffer
+}
+
+// NewCompressor returns a Compressor for frames of at least threshold bytes
+func NewCompressor(threshold int) *Compressor {
+    if threshold <= 0 {
+        threshold = DefaultThreshold
+    }
+    return &Compressor{threshold: threshold}
+}
+
+// Compress returns data deflated and true, or data itself and false when
+// compressing would not pay off. The result is valid until the next call.
+func (c *Compressor) Compress(data []byte) ([]byte, bool) {
+    if c == nil || len(data) < c.threshold {
+        return data, false
+    }
+    if c.skip > 0 {
+        c.skip--
+        return data, false
+    }
+    if alreadyCompressed(data) {
+        c.miss()
+        return data, false
+    }
+
+    c.buffer.Reset()
+    writer := writers.Get().(*flate.Writer)
+    writer.Reset(&c.buffer)
+    writer.Write(data)
+    writer.Close()
+    writers.Put(writer)
+
+    // Not worth the receiver's time unless it saves a tenth
+    if c.buffer.Len() > len(data)-len(data)/10 {
+        c.miss()
+        return data, false
+    }
+    c.misses = 0
+    return c.buffer.Bytes(), true
+}
+
+// miss counts a frame that did not shrink
+func (c *Compressor) miss() {
+    c.misses++
+    if c.misses >= maxMisses {
+        c.misses = 0
+        c.skip = skipFrames
+    }
+}
+
+// Decompress inflates a frame produced by Compress. The result comes from
+// bufpool and may be handed back with bufpool.Put once used.
+func Decompress(data []byte) ([]byte, error) {
+    source := bytes.NewReader(data)
+    reader, ok := readers.Get().(io.ReadCloser)
+    if ok {
+        reader.(flate.Resetter).Reset(source, nil)
+    } else {
+        reader = flate.NewReader(source)
+    }
+    defer readers.Put(reader)
+
+    out := bufpool.Get(max(4*len(data), 4096))
+    n := 0
+    for {
+        if n == len(out) {
+            if n > maxFrameSize {
+                bufpool.Put(out)
+                return nil, fmt.Errorf("compressed frame exceeds %d bytes", maxFrameSize)
+            }
+            grown := bufpool.Get(2 * n)
+            copy(grown, out)
+            bufpool.Put(out)
+            out = grown
+        }
+        read, err := reader.Read(out[n:])
+        n += read
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            bufpool.Put(out)
+            return nil, fmt.Errorf("invalid compressed frame: %w", err)
+        }
+    }
+    if n > maxFrameSize {
+        bufpool.Put(out)
+        return nil, fmt.Errorf("compressed frame exceeds %d bytes", maxFrameSize)
+    }
+    return out[:n], nil
+}
+
+// Signatures of formats that are compressed already
+var compressedSignatures = [][]byte{
+    {0x1f, 0x8b},                         // gzip
+    {0x28, 0xb5, 0x2f, 0xfd},             // zstd
+    {0xfd, '7', 'z', 'X', 'Z', 0x00},     // xz
+    []byte("BZh"),                        // bzip2
+    []byte("PK\x03\x04"),                 // zip, jar, docx
+    {'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},   // 7z
+    {0x89, 'P', 'N', 'G'},                // png
+    {0xff, 0xd8, 0xff},                   // jpeg
+    []byte("GIF8"),                       // gif
+    []byte("wOF2"),                       // woff2
+}
+
+// alreadyCompressed reports whether data starts like a compressed format
+func alreadyCompressed(data []byte) bool {
+    for _, signature := range compressedSignatures {
+        if bytes.HasPrefix(data, signature) {
+            return true
+        }
+    }
+    // RIFF containers such as webp, and ISO media such as mp4
+    if len(data) >= 12 && (bytes.Equal(data[8:12], []byte("WEBP")) || bytes.Equal(data[4:8], []byte("ftyp"))) {
+        return true
+    }
+    return false
+}
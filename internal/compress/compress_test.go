@@ -0,0 +1,85 @@
+package compress
+
+import (
+    "bytes"
+    "compress/flate"
+    "crypto/rand"
+    "testing"
+)
+
+// deflate compresses data without a Compressor's checks
+func deflate(t *testing.T, data []byte) []byte {
+    t.Helper()
+    var buffer bytes.Buffer
+    writer, _ := flate.NewWriter(&buffer, flate.BestCompression)
+    writer.Write(data)
+    writer.Close()
+    return buffer.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+    c := NewCompressor(0)
+    for _, size := range []int{DefaultThreshold, 4096, 64 << 10, maxFrameSize} {
+        data := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\n"), size/26+1)[:size]
+        compressed, ok := c.Compress(data)
+        if !ok || len(compressed) >= len(data) {
+            t.Fatalf("%d bytes of text were not compressed", size)
+        }
+        got, err := Decompress(compressed)
+        if err != nil || !bytes.Equal(got, data) {
+            t.Fatalf("%d bytes came back as %d bytes, %v", size, len(got), err)
+        }
+    }
+}
+
+func TestFramesLeftAlone(t *testing.T) {
+    var nilCompressor *Compressor
+    if _, ok := nilCompressor.Compress(make([]byte, 4096)); ok {
+        t.Error("a nil Compressor compressed")
+    }
+
+    c := NewCompressor(1024)
+    if _, ok := c.Compress(make([]byte, 1023)); ok {
+        t.Error("a frame below the threshold was compressed")
+    }
+
+    gzipped := append([]byte{0x1f, 0x8b}, make([]byte, 4096)...)
+    if _, ok := NewCompressor(0).Compress(gzipped); ok {
+        t.Error("a gzip frame was compressed again")
+    }
+}
+
+func TestIncompressibleStreamsAreSkipped(t *testing.T) {
+    c := NewCompressor(0)
+    random := make([]byte, 4096)
+    rand.Read(random)
+    for i := 0; i < maxMisses; i++ {
+        if _, ok := c.Compress(random); ok {
+            t.Fatal("random data was compressed")
+        }
+    }
+
+    // Even text goes through as is until the skip is over
+    text := bytes.Repeat([]byte("a"), 4096)
+    for i := 0; i < skipFrames; i++ {
+        if _, ok := c.Compress(text); ok {
+            t.Fatalf("frame %d of the skip was compressed", i)
+        }
+    }
+    if _, ok := c.Compress(text); !ok {
+        t.Error("compression did not resume after the skip")
+    }
+}
+
+func TestDecompressRefusesBadInput(t *testing.T) {
+    tests := map[string][]byte{
+        "corrupt":   {0xff, 0xff, 0xff, 0xff},
+        "truncated": deflate(t, bytes.Repeat([]byte("abc"), 1000))[:20],
+        "bomb":      deflate(t, make([]byte, 8*maxFrameSize)),
+    }
+    for name, data := range tests {
+        if out, err := Decompress(data); err == nil {
+            t.Errorf("%s: decompressed to %d bytes", name, len(out))
+        }
+    }
+}
@@ -0,0 +1,49 @@
+// Package flagutil holds flag types and helpers shared by the commands
+package flagutil
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// ByteSize is a flag holding a number of bytes such as 512K, 10M or 50G
+type ByteSize int64
+
+func (b *ByteSize) String() string {
+    return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *ByteSize) Set(value string) error {
+    units := []struct {
+        suffix     string
+        multiplier float64
+    }{
+        {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+    }
+
+    number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+    multiplier := 1.0
+    for _, unit := range units {
+        if strings.HasSuffix(number, unit.suffix) {
+            number = strings.TrimSuffix(number, unit.suffix)
+            multiplier = unit.multiplier
+            break
+        }
+    }
+
+    n, err := strconv.ParseFloat(number, 64)
+    if err != nil || n < 0 {
+        return fmt.Errorf("invalid size %q", value)
+    }
+    *b = ByteSize(n * multiplier)
+    return nil
+}
+
+// SplitList splits a comma-separated flag value, empty means no entries
+func SplitList(value string) []string {
+    if value == "" {
+        return nil
+    }
+    return strings.Split(value, ",")
+}
@@ -0,0 +1,40 @@
+package flagutil
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestByteSize(t *testing.T) {
+    tests := map[string]ByteSize{
+        "0":    0,
+        "512":  512,
+        "512K": 512 << 10,
+        "10mb": 10 << 20,
+        "1.5G": 3 << 29,
+        " 2T ": 2 << 40,
+        "64KB": 64 << 10,
+    }
+    for value, want := range tests {
+        var size ByteSize
+        if err := size.Set(value); err != nil || size != want {
+            t.Errorf("Set(%q) = %d, %v, want %d", value, size, err, want)
+        }
+    }
+
+    for _, value := range []string{"", "K", "-1M", "ten"} {
+        var size ByteSize
+        if err := size.Set(value); err == nil {
+            t.Errorf("Set(%q) accepted %d", value, size)
+        }
+    }
+}
+
+func TestSplitList(t *testing.T) {
+    if got := SplitList(""); got != nil {
+        t.Errorf("SplitList(\"\") = %q, want nil", got)
+    }
+    if got := SplitList("a,b"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+        t.Errorf("SplitList(\"a,b\") = %q", got)
+    }
+}
@@ -0,0 +1,27 @@
+package frame
+
+import (
+    "encoding/json"
+    "io"
+    "sync"
+)
+
+// Encoder writes messages to a control connection as JSON lines. Unlike a
+// json.Encoder it is safe for concurrent use, so one Encoder serves every
+// goroutine writing to a connection and messages never interleave.
+type Encoder struct {
+    mutex   sync.Mutex
+    encoder *json.Encoder
+}
+
+// NewEncoder returns an Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+    return &Encoder{encoder: json.NewEncoder(w)}
+}
+
+// Encode writes v to the connection in a single write
+func (e *Encoder) Encode(v any) error {
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    return e.encoder.Encode(v)
+}
@@ -0,0 +1,85 @@
+package frame
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "io"
+    "sync"
+    "testing"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// lockedBuffer collects what the encoder writes from many goroutines
+type lockedBuffer struct {
+    mutex sync.Mutex
+    bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.Buffer.Write(p)
+}
+
+func TestEncoderConcurrentMessagesStayWhole(t *testing.T) {
+    var out lockedBuffer
+    frames := NewEncoder(&out)
+    data := bytes.Repeat([]byte("x"), 10<<10)
+
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 50; j++ {
+                frames.Encode(protocol.ClientMessage{Type: protocol.MessageTypeData, UserID: "u", Data: data})
+            }
+        }()
+    }
+    wg.Wait()
+
+    scanner := bufio.NewScanner(&out.Buffer)
+    scanner.Buffer(nil, 1<<20)
+    lines := 0
+    for scanner.Scan() {
+        var msg protocol.ClientMessage
+        if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+            t.Fatalf("line %d is not a whole message: %v", lines, err)
+        }
+        if !bytes.Equal(msg.Data, data) {
+            t.Fatalf("line %d carries %d bytes, want %d", lines, len(msg.Data), len(data))
+        }
+        lines++
+    }
+    if lines != 8*50 {
+        t.Errorf("got %d messages, want %d", lines, 8*50)
+    }
+}
+
+// BenchmarkFrameEncoder compares a json.Encoder made per message, as the
+// data path did before, with one shared Encoder per connection
+func BenchmarkFrameEncoder(b *testing.B) {
+    msg := protocol.ClientMessage{
+        Type:   protocol.MessageTypeData,
+        UserID: "user-1",
+        Data:   bytes.Repeat([]byte{0xa5}, protocol.DefaultReadSize),
+    }
+
+    b.Run("per-message", func(b *testing.B) {
+        b.ReportAllocs()
+        b.SetBytes(int64(len(msg.Data)))
+        for i := 0; i < b.N; i++ {
+            json.NewEncoder(io.Discard).Encode(msg)
+        }
+    })
+    b.Run("shared", func(b *testing.B) {
+        frames := NewEncoder(io.Discard)
+        b.ReportAllocs()
+        b.SetBytes(int64(len(msg.Data)))
+        for i := 0; i < b.N; i++ {
+            frames.Encode(msg)
+        }
+    })
+}
@@ -0,0 +1,340 @@
+package noiseconn
+
+import (
+    "crypto/ecdh"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/flynn/noise"
+)
+
+// Noise_NK_25519_ChaChaPoly_SHA256: clients know the relay's static key in
+// advance, the relay learns nothing about clients beyond the handshake
+var cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// prologue binds handshakes to this protocol
+const prologue = "tun control v1"
+
+// peerPrologue binds handshakes between relays of a cluster, so a control
+// handshake can't be passed off as one
+const peerPrologue = "tun cluster v1"
+
+// handshakeTimeout bounds how long a peer may take to finish the handshake
+const handshakeTimeout = 30 * time.Second
+
+// maxPlaintext is the most payload one transport message carries
+const maxPlaintext = noise.MaxMsgLen - 16
+
+// Key is a relay's static Curve25519 key pair
+type Key struct {
+    Private []byte
+    Public  []byte
+}
+
+// PublicString returns the public key in the form clients are given it
+func (k Key) PublicString() string {
+    return base64.StdEncoding.EncodeToString(k.Public)
+}
+
+// LoadKey reads a base64 private key from path, writing a new one there if
+// the file does not exist
+func LoadKey(path string) (Key, error) {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        private := make([]byte, 32)
+        if _, err := rand.Read(private); err != nil {
+            return Key{}, err
+        }
+        encoded := base64.StdEncoding.EncodeToString(private) + "\n"
+        if err := os.WriteFile(path, []byte(encoded), 0o600); err != nil {
+            return Key{}, err
+        }
+        return keyFromPrivate(private)
+    }
+    if err != nil {
+        return Key{}, err
+    }
+
+    private, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil {
+        return Key{}, fmt.Errorf("invalid key in %s: %w", path, err)
+    }
+    return keyFromPrivate(private)
+}
+
+// keyFromPrivate derives the public half of a key
+func keyFromPrivate(private []byte) (Key, error) {
+    key, err := ecdh.X25519().NewPrivateKey(private)
+    if err != nil {
+        return Key{}, err
+    }
+    return Key{Private: private, Public: key.PublicKey().Bytes()}, nil
+}
+
+// ParsePublicKey parses a relay public key as printed by the relay
+func ParsePublicKey(s string) ([]byte, error) {
+    public, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+    if err != nil {
+        return nil, fmt.Errorf("invalid public key: %w", err)
+    }
+    if len(public) != 32 {
+        return nil, fmt.Errorf("invalid public key: expected 32 bytes, got %d", len(public))
+    }
+    return public, nil
+}
+
+// Conn is a connection encrypted with Noise. Every Write is sent as one or
+// more length-prefixed transport messages.
+type Conn struct {
+    net.Conn
+
+    readMutex sync.Mutex
+    recv      *noise.CipherState
+    pending   []byte // decrypted bytes not read yet
+    frame     []byte
+
+    writeMutex sync.Mutex
+    send       *noise.CipherState
+}
+
+// Client runs the handshake as a client that expects the relay to hold the
+// private half of relayPublic
+func Client(conn net.Conn, relayPublic []byte) (*Conn, error) {
+    state, err := noise.NewHandshakeState(noise.Config{
+        CipherSuite: cipherSuite,
+        Pattern:     noise.HandshakeNK,
+        Initiator:   true,
+        Prologue:    []byte(prologue),
+        PeerStatic:  relayPublic,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    conn.SetDeadline(time.Now().Add(handshakeTimeout))
+    defer conn.SetDeadline(time.Time{})
+
+    // -> e, es
+    message, _, _, err := state.WriteMessage(nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    if err := writeFrame(conn, message); err != nil {
+        return nil, err
+    }
+
+    // <- e, ee. Relays drop clients holding the wrong key here.
+    message, err = readFrame(conn, nil)
+    if err != nil {
+        return nil, fmt.Errorf("noise handshake failed, check the relay key: %w", err)
+    }
+    _, send, recv, err := state.ReadMessage(nil, message)
+    if err != nil {
+        return nil, fmt.Errorf("noise handshake failed: %w", err)
+    }
+    return &Conn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// Server runs the handshake as the relay holding key
+func Server(conn net.Conn, key Key) (*Conn, error) {
+    state, err := noise.NewHandshakeState(noise.Config{
+        CipherSuite:   cipherSuite,
+        Pattern:       noise.HandshakeNK,
+        Initiator:     false,
+        Prologue:      []byte(prologue),
+        StaticKeypair: noise.DHKey{Private: key.Private, Public: key.Public},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    conn.SetDeadline(time.Now().Add(handshakeTimeout))
+    defer conn.SetDeadline(time.Time{})
+
+    // -> e, es
+    message, err := readFrame(conn, nil)
+    if err != nil {
+        return nil, err
+    }
+    if _, _, _, err := state.ReadMessage(nil, message); err != nil {
+        return nil, fmt.Errorf("noise handshake failed: %w", err)
+    }
+
+    // <- e, ee
+    message, recv, send, err := state.WriteMessage(nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    if err := writeFrame(conn, message); err != nil {
+        return nil, err
+    }
+    return &Conn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// PeerClient runs the handshake as a relay calling another relay of its
+// cluster. Noise_NNpsk0: both sides prove they know secret, and the
+// connection fails before any data is sent if they don't.
+func PeerClient(conn net.Conn, secret []byte) (*Conn, error) {
+    state, err := peerHandshakeState(secret, true)
+    if err != nil {
+        return nil, err
+    }
+
+    conn.SetDeadline(time.Now().Add(handshakeTimeout))
+    defer conn.SetDeadline(time.Time{})
+
+    // -> psk, e
+    message, _, _, err := state.WriteMessage(nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    if err := writeFrame(conn, message); err != nil {
+        return nil, err
+    }
+
+    // <- e, ee. Peers drop relays holding another secret here.
+    message, err = readFrame(conn, nil)
+    if err != nil {
+        return nil, fmt.Errorf("cluster handshake failed, check the cluster secret: %w", err)
+    }
+    _, send, recv, err := state.ReadMessage(nil, message)
+    if err != nil {
+        return nil, fmt.Errorf("cluster handshake failed: %w", err)
+    }
+    return &Conn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// PeerServer runs the handshake as a relay called by another relay of its
+// cluster, both holding secret
+func PeerServer(conn net.Conn, secret []byte) (*Conn, error) {
+    state, err := peerHandshakeState(secret, false)
+    if err != nil {
+        return nil, err
+    }
+
+    conn.SetDeadline(time.Now().Add(handshakeTimeout))
+    defer conn.SetDeadline(time.Time{})
+
+    // -> psk, e
+    message, err := readFrame(conn, nil)
+    if err != nil {
+        return nil, err
+    }
+    if _, _, _, err := state.ReadMessage(nil, message); err != nil {
+        return nil, fmt.Errorf("cluster handshake failed: %w", err)
+    }
+
+    // <- e, ee
+    message, recv, send, err := state.WriteMessage(nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    if err := writeFrame(conn, message); err != nil {
+        return nil, err
+    }
+    return &Conn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// peerHandshakeState sets up a Noise_NNpsk0 handshake keyed with secret
+func peerHandshakeState(secret []byte, initiator bool) (*noise.HandshakeState, error) {
+    if len(secret) == 0 {
+        return nil, errors.New("cluster secret is empty")
+    }
+    psk := sha256.Sum256(secret)
+    return noise.NewHandshakeState(noise.Config{
+        CipherSuite:           cipherSuite,
+        Pattern:               noise.HandshakeNN,
+        Initiator:             initiator,
+        Prologue:              []byte(peerPrologue),
+        PresharedKey:          psk[:],
+        PresharedKeyPlacement: 0,
+    })
+}
+
+// Read decrypts the next bytes from the peer
+func (c *Conn) Read(p []byte) (int, error) {
+    c.readMutex.Lock()
+    defer c.readMutex.Unlock()
+
+    for len(c.pending) == 0 {
+        frame, err := readFrame(c.Conn, c.frame)
+        if err != nil {
+            return 0, err
+        }
+        c.frame = frame
+        // Decrypt in place, the frame buffer is reused for the next message
+        plaintext, err := c.recv.Decrypt(frame[:0], nil, frame)
+        if err != nil {
+            return 0, fmt.Errorf("noise: %w", err)
+        }
+        c.pending = plaintext
+    }
+
+    n := copy(p, c.pending)
+    c.pending = c.pending[n:]
+    return n, nil
+}
+
+// Write encrypts p and sends it to the peer
+func (c *Conn) Write(p []byte) (int, error) {
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+
+    written := 0
+    for len(p) > 0 {
+        chunk := p
+        if len(chunk) > maxPlaintext {
+            chunk = chunk[:maxPlaintext]
+        }
+        ciphertext, err := c.send.Encrypt(nil, nil, chunk)
+        if err != nil {
+            return written, err
+        }
+        if err := writeFrame(c.Conn, ciphertext); err != nil {
+            return written, err
+        }
+        written += len(chunk)
+        p = p[len(chunk):]
+    }
+    return written, nil
+}
+
+// writeFrame sends a message with its length in front
+func writeFrame(conn net.Conn, message []byte) error {
+    frame := make([]byte, 2+len(message))
+    binary.BigEndian.PutUint16(frame, uint16(len(message)))
+    copy(frame[2:], message)
+    _, err := conn.Write(frame)
+    return err
+}
+
+// readFrame reads one length-prefixed message, reusing buffer if it is big
+// enough
+func readFrame(conn net.Conn, buffer []byte) ([]byte, error) {
+    var length [2]byte
+    if _, err := io.ReadFull(conn, length[:]); err != nil {
+        return nil, err
+    }
+    size := int(binary.BigEndian.Uint16(length[:]))
+    if cap(buffer) < size {
+        buffer = make([]byte, size)
+    }
+    buffer = buffer[:size]
+    if _, err := io.ReadFull(conn, buffer); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+    return buffer, nil
+}
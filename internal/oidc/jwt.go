@@ -0,0 +1,191 @@
+package oidc
+
+import (
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "strings"
+)
+
+// jwtHeader is the JOSE header of a signed token
+type jwtHeader struct {
+    Algorithm string `json:"alg"`
+    KeyID     string `json:"kid"`
+}
+
+// jsonWebKey is one key of a JWKS document
+type jsonWebKey struct {
+    KeyType string `json:"kty"`
+    KeyID   string `json:"kid"`
+    Use     string `json:"use"`
+    N       string `json:"n"`
+    E       string `json:"e"`
+    Curve   string `json:"crv"`
+    X       string `json:"x"`
+    Y       string `json:"y"`
+}
+
+// verifySignature checks the signature of a compact JWS against the
+// provider's keys and returns its payload. RS256 and ES256 are supported.
+func (p *Provider) verifySignature(ctx context.Context, rawToken string) ([]byte, error) {
+    parts := strings.Split(rawToken, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("malformed ID token")
+    }
+
+    headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return nil, errors.New("malformed ID token header")
+    }
+    var header jwtHeader
+    if err := json.Unmarshal(headerJSON, &header); err != nil {
+        return nil, errors.New("malformed ID token header")
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, errors.New("malformed ID token payload")
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errors.New("malformed ID token signature")
+    }
+
+    key, err := p.key(ctx, header.KeyID)
+    if err != nil {
+        return nil, err
+    }
+
+    digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+    switch header.Algorithm {
+    case "RS256":
+        rsaKey, ok := key.(*rsa.PublicKey)
+        if !ok {
+            return nil, errors.New("ID token key does not match its algorithm")
+        }
+        if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+            return nil, errors.New("invalid ID token signature")
+        }
+    case "ES256":
+        ecKey, ok := key.(*ecdsa.PublicKey)
+        if !ok || len(signature) != 64 {
+            return nil, errors.New("ID token key does not match its algorithm")
+        }
+        r := new(big.Int).SetBytes(signature[:32])
+        s := new(big.Int).SetBytes(signature[32:])
+        if !ecdsa.Verify(ecKey, digest[:], r, s) {
+            return nil, errors.New("invalid ID token signature")
+        }
+    default:
+        return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Algorithm)
+    }
+
+    return payload, nil
+}
+
+// key returns the verification key with keyID, refreshing the key set once
+// if it is unknown since providers rotate keys
+func (p *Provider) key(ctx context.Context, keyID string) (interface{}, error) {
+    p.keysMutex.RLock()
+    key, exists := p.keys[keyID]
+    p.keysMutex.RUnlock()
+    if exists {
+        return key, nil
+    }
+
+    if err := p.refreshKeys(ctx); err != nil {
+        return nil, err
+    }
+
+    p.keysMutex.RLock()
+    defer p.keysMutex.RUnlock()
+
+    if key, exists := p.keys[keyID]; exists {
+        return key, nil
+    }
+    // Providers with a single key sometimes omit key IDs
+    if keyID == "" && len(p.keys) == 1 {
+        for _, key := range p.keys {
+            return key, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown ID token key %q", keyID)
+}
+
+// refreshKeys fetches the provider's JWKS document
+func (p *Provider) refreshKeys(ctx context.Context) error {
+    var jwks struct {
+        Keys []jsonWebKey `json:"keys"`
+    }
+    if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+        return fmt.Errorf("failed to fetch OIDC keys: %w", err)
+    }
+
+    keys := make(map[string]interface{})
+    for _, jwk := range jwks.Keys {
+        if jwk.Use != "" && jwk.Use != "sig" {
+            continue
+        }
+        key, err := jwk.publicKey()
+        if err != nil {
+            continue // Skip key types we do not support
+        }
+        keys[jwk.KeyID] = key
+    }
+
+    p.keysMutex.Lock()
+    p.keys = keys
+    p.keysMutex.Unlock()
+    return nil
+}
+
+// publicKey decodes an RSA or P-256 key
+func (k jsonWebKey) publicKey() (interface{}, error) {
+    switch k.KeyType {
+    case "RSA":
+        n, err := base64.RawURLEncoding.DecodeString(k.N)
+        if err != nil {
+            return nil, err
+        }
+        e, err := base64.RawURLEncoding.DecodeString(k.E)
+        if err != nil {
+            return nil, err
+        }
+        return &rsa.PublicKey{
+            N: new(big.Int).SetBytes(n),
+            E: int(new(big.Int).SetBytes(e).Int64()),
+        }, nil
+    case "EC":
+        if k.Curve != "P-256" {
+            return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+        }
+        x, err := base64.RawURLEncoding.DecodeString(k.X)
+        if err != nil {
+            return nil, err
+        }
+        y, err := base64.RawURLEncoding.DecodeString(k.Y)
+        if err != nil {
+            return nil, err
+        }
+        key := &ecdsa.PublicKey{
+            Curve: elliptic.P256(),
+            X:     new(big.Int).SetBytes(x),
+            Y:     new(big.Int).SetBytes(y),
+        }
+        if !key.Curve.IsOnCurve(key.X, key.Y) {
+            return nil, errors.New("EC key is not on its curve")
+        }
+        return key, nil
+    default:
+        return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+    }
+}
@@ -0,0 +1,205 @@
+package oidc
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Provider talks to an OpenID Connect identity provider using the
+// authorization code flow
+type Provider struct {
+    issuer        string
+    clientID      string
+    clientSecret  string
+    authEndpoint  string
+    tokenEndpoint string
+    jwksURI       string
+    httpClient    *http.Client
+    keys          map[string]interface{} // verification keys by key ID
+    keysMutex     sync.RWMutex
+}
+
+// discoveryDocument holds the fields we use from the provider metadata
+type discoveryDocument struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the ID token claims the relay cares about
+type Claims struct {
+    Issuer        string   `json:"iss"`
+    Subject       string   `json:"sub"`
+    Audience      audience `json:"aud"`
+    Expiry        int64    `json:"exp"`
+    Nonce         string   `json:"nonce"`
+    Email         string   `json:"email"`
+    EmailVerified *bool    `json:"email_verified"`
+}
+
+// audience accepts both forms of the aud claim, a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+    var single string
+    if err := json.Unmarshal(data, &single); err == nil {
+        *a = audience{single}
+        return nil
+    }
+    var list []string
+    if err := json.Unmarshal(data, &list); err != nil {
+        return err
+    }
+    *a = list
+    return nil
+}
+
+// NewProvider discovers the endpoints of the provider at issuer
+func NewProvider(ctx context.Context, issuer, clientID, clientSecret string) (*Provider, error) {
+    issuer = strings.TrimSuffix(issuer, "/")
+    p := &Provider{
+        issuer:       issuer,
+        clientID:     clientID,
+        clientSecret: clientSecret,
+        httpClient:   &http.Client{Timeout: 10 * time.Second},
+        keys:         make(map[string]interface{}),
+    }
+
+    var doc discoveryDocument
+    if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", &doc); err != nil {
+        return nil, fmt.Errorf("failed to discover OIDC provider: %w", err)
+    }
+    if doc.Issuer != issuer {
+        return nil, fmt.Errorf("OIDC provider reports issuer %q, expected %q", doc.Issuer, issuer)
+    }
+    if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+        return nil, errors.New("OIDC provider metadata is missing endpoints")
+    }
+
+    p.authEndpoint = doc.AuthorizationEndpoint
+    p.tokenEndpoint = doc.TokenEndpoint
+    p.jwksURI = doc.JWKSURI
+    return p, nil
+}
+
+// AuthCodeURL returns the URL to send a user to for logging in
+func (p *Provider) AuthCodeURL(state, nonce, redirectURI string) string {
+    params := url.Values{
+        "response_type": {"code"},
+        "client_id":     {p.clientID},
+        "redirect_uri":  {redirectURI},
+        "scope":         {"openid email"},
+        "state":         {state},
+        "nonce":         {nonce},
+    }
+
+    separator := "?"
+    if strings.Contains(p.authEndpoint, "?") {
+        separator = "&"
+    }
+    return p.authEndpoint + separator + params.Encode()
+}
+
+// Exchange trades an authorization code for an ID token and returns its
+// verified claims. The caller must still compare the nonce.
+func (p *Provider) Exchange(ctx context.Context, code, redirectURI string) (*Claims, error) {
+    form := url.Values{
+        "grant_type":   {"authorization_code"},
+        "code":         {code},
+        "redirect_uri": {redirectURI},
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+    resp, err := p.httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("token request failed: %w", err)
+    }
+    defer resp.Body.Close()
+
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read token response: %w", err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+    }
+
+    var token struct {
+        IDToken string `json:"id_token"`
+    }
+    if err := json.Unmarshal(body, &token); err != nil {
+        return nil, fmt.Errorf("invalid token response: %w", err)
+    }
+    if token.IDToken == "" {
+        return nil, errors.New("token response has no id_token")
+    }
+
+    return p.verifyIDToken(ctx, token.IDToken)
+}
+
+// verifyIDToken checks the signature and standard claims of an ID token
+func (p *Provider) verifyIDToken(ctx context.Context, rawToken string) (*Claims, error) {
+    payload, err := p.verifySignature(ctx, rawToken)
+    if err != nil {
+        return nil, err
+    }
+
+    var claims Claims
+    if err := json.Unmarshal(payload, &claims); err != nil {
+        return nil, fmt.Errorf("invalid ID token claims: %w", err)
+    }
+
+    if claims.Issuer != p.issuer {
+        return nil, fmt.Errorf("ID token issued by %q, expected %q", claims.Issuer, p.issuer)
+    }
+    audienceOK := false
+    for _, aud := range claims.Audience {
+        if aud == p.clientID {
+            audienceOK = true
+        }
+    }
+    if !audienceOK {
+        return nil, errors.New("ID token is not meant for this client")
+    }
+    if time.Now().After(time.Unix(claims.Expiry, 0).Add(time.Minute)) {
+        return nil, errors.New("ID token has expired")
+    }
+
+    return &claims, nil
+}
+
+// getJSON fetches target and decodes the JSON response into v
+func (p *Provider) getJSON(ctx context.Context, target string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Accept", "application/json")
+
+    resp, err := p.httpClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("%s returned %s", target, resp.Status)
+    }
+    return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
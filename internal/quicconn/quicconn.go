@@ -0,0 +1,159 @@
+package quicconn
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "io"
+    "net"
+    "time"
+
+    "github.com/quic-go/quic-go"
+)
+
+// ALPN is the application protocol relays and clients negotiate over QUIC
+const ALPN = "tun"
+
+// Config returns the QUIC settings shared by relays and clients
+func Config() *quic.Config {
+    return &quic.Config{
+        KeepAlivePeriod:    15 * time.Second,
+        MaxIdleTimeout:     60 * time.Second,
+        MaxIncomingStreams: 1 << 16,
+    }
+}
+
+// TLSConfig returns a copy of tlsConfig negotiating ALPN
+func TLSConfig(tlsConfig *tls.Config) *tls.Config {
+    if tlsConfig == nil {
+        tlsConfig = &tls.Config{}
+    }
+    tlsConfig = tlsConfig.Clone()
+    tlsConfig.NextProtos = []string{ALPN}
+    return tlsConfig
+}
+
+// Stream is a QUIC stream used as a net.Conn. Close ends both directions.
+type Stream struct {
+    *quic.Stream
+    conn *quic.Conn
+}
+
+// NewStream wraps a stream of conn
+func NewStream(stream *quic.Stream, conn *quic.Conn) *Stream {
+    return &Stream{Stream: stream, conn: conn}
+}
+
+// LocalAddr returns the local address of the QUIC connection
+func (s *Stream) LocalAddr() net.Addr {
+    return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the QUIC connection
+func (s *Stream) RemoteAddr() net.Addr {
+    return s.conn.RemoteAddr()
+}
+
+// Read reads from the stream, reporting a cleanly closed connection as io.EOF
+func (s *Stream) Read(p []byte) (int, error) {
+    n, err := s.Stream.Read(p)
+    var appErr *quic.ApplicationError
+    if errors.As(err, &appErr) && appErr.ErrorCode == 0 {
+        err = io.EOF
+    }
+    return n, err
+}
+
+// CloseWrite finishes writing, the peer sees EOF
+func (s *Stream) CloseWrite() error {
+    return s.Stream.Close()
+}
+
+// Close stops reading and finishes writing
+func (s *Stream) Close() error {
+    s.CancelRead(0)
+    return s.Stream.Close()
+}
+
+// Control is the control stream of a QUIC connection. Closing it closes the
+// whole connection, and it opens and accepts the streams carrying user
+// connections.
+type Control struct {
+    Stream
+    closed   context.Context // done once Close was called
+    setClose context.CancelFunc
+}
+
+// NewControl wraps the control stream of conn
+func NewControl(stream *quic.Stream, conn *quic.Conn) *Control {
+    closed, setClose := context.WithCancel(context.Background())
+    return &Control{Stream: Stream{Stream: stream, conn: conn}, closed: closed, setClose: setClose}
+}
+
+// closeTimeout is how long a closed control stream keeps its connection
+// open for what was written last to arrive
+const closeTimeout = 5 * time.Second
+
+// Close finishes the control stream and closes the QUIC connection once
+// the peer closed it too or closeTimeout passed. Closing the connection
+// right away would drop what was written last, such as why a registration
+// was rejected.
+func (c *Control) Close() error {
+    c.setClose()
+    err := c.Stream.Close()
+    go func() {
+        select {
+        case <-c.conn.Context().Done():
+        case <-time.After(closeTimeout):
+        }
+        c.conn.CloseWithError(0, "")
+    }()
+    return err
+}
+
+// OpenStream opens a new stream to the peer
+func (c *Control) OpenStream(ctx context.Context) (net.Conn, error) {
+    ctx, cancel := c.untilClosed(ctx)
+    defer cancel()
+    stream, err := c.conn.OpenStreamSync(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return NewStream(stream, c.conn), nil
+}
+
+// AcceptStream waits for the peer to open a stream
+func (c *Control) AcceptStream(ctx context.Context) (net.Conn, error) {
+    ctx, cancel := c.untilClosed(ctx)
+    defer cancel()
+    stream, err := c.conn.AcceptStream(ctx)
+    if err != nil {
+        return nil, err
+    }
+    return NewStream(stream, c.conn), nil
+}
+
+// untilClosed returns a context that also ends when the control stream is
+// closed, while its connection may still linger
+func (c *Control) untilClosed(ctx context.Context) (context.Context, context.CancelFunc) {
+    ctx, cancel := context.WithCancel(ctx)
+    stop := context.AfterFunc(c.closed, cancel)
+    return ctx, func() {
+        stop()
+        cancel()
+    }
+}
+
+// Dial connects to a relay at addr and opens the control stream
+func Dial(ctx context.Context, addr string, tlsConfig *tls.Config) (*Control, error) {
+    conn, err := quic.DialAddr(ctx, addr, TLSConfig(tlsConfig), Config())
+    if err != nil {
+        return nil, err
+    }
+    stream, err := conn.OpenStreamSync(ctx)
+    if err != nil {
+        conn.CloseWithError(0, "")
+        return nil, err
+    }
+    return NewControl(stream, conn), nil
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// Features an account can be granted besides its tunnel protocols
+const (
+    FeatureForward = "forward" // local forwards and SOCKS through the relay
+)
+
+// Account is a tenant of the relay, identified by the token its clients
+// register with
+type Account struct {
+    Name string `json:"name"`
+
+    // TokenSHA256 is the hex SHA-256 of the account's token, so the
+    // accounts file does not hold usable secrets
+    TokenSHA256 string `json:"token_sha256"`
+
+    // MaxTunnels caps simultaneous tunnels on this relay, zero for unlimited
+    MaxTunnels int `json:"max_tunnels,omitempty"`
+
+    // Ports are the public ports the account may use, as "port" or
+    // "first-last". Empty allows the whole range of the relay.
+    Ports []string `json:"ports,omitempty"`
+
+    // Hostnames the account's HTTP tunnels may serve, exact names or
+    // "*.domain" patterns matching any name under domain but not domain
+    // itself. Empty means no hostnames.
+    Hostnames []string `json:"hostnames,omitempty"`
+
+    // MaxReservations is how many ports and hostnames the account may
+    // reserve permanently, zero for none
+    MaxReservations int `json:"max_reservations,omitempty"`
+
+    // Features the account may use: "tcp", "http" and "forward". Empty
+    // allows everything.
+    Features []string `json:"features,omitempty"`
+}
+
+// account is an Account ready for checks
+type account struct {
+    Account
+    tokenHash  []byte
+    portRanges [][2]int
+    hostnames  []string // normalized Hostnames
+    tunnels    int      // guarded by accountsMutex
+}
+
+// LoadAccounts reads a JSON list of accounts
+func LoadAccounts(path string) ([]Account, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var accounts []Account
+    if err := json.Unmarshal(data, &accounts); err != nil {
+        return nil, fmt.Errorf("invalid accounts file %s: %w", path, err)
+    }
+    return accounts, nil
+}
+
+// SetAccounts requires every client to register with the token of one of
+// accounts and holds it to the account's limits. Must be called before
+// Start.
+func (s *RelayServer) SetAccounts(accounts []Account) error {
+    parsed := make([]*account, 0, len(accounts))
+    names := make(map[string]bool)
+    for _, a := range accounts {
+        if a.Name == "" {
+            return fmt.Errorf("account without a name")
+        }
+        if names[a.Name] {
+            return fmt.Errorf("duplicate account %q", a.Name)
+        }
+        names[a.Name] = true
+
+        tokenHash, err := hex.DecodeString(a.TokenSHA256)
+        if err != nil || len(tokenHash) != sha256.Size {
+            return fmt.Errorf("account %s: token_sha256 must be a hex SHA-256", a.Name)
+        }
+        if a.MaxTunnels < 0 || a.MaxReservations < 0 {
+            return fmt.Errorf("account %s: limits must not be negative", a.Name)
+        }
+
+        portRanges, err := parsePortRanges(a.Ports)
+        if err != nil {
+            return fmt.Errorf("account %s: %w", a.Name, err)
+        }
+        hostnames, err := parseHostnamePatterns(a.Hostnames)
+        if err != nil {
+            return fmt.Errorf("account %s: %w", a.Name, err)
+        }
+        for _, feature := range a.Features {
+            switch feature {
+            case protocol.ProtocolTCP, protocol.ProtocolHTTP, FeatureForward:
+            default:
+                return fmt.Errorf("account %s: unknown feature %q", a.Name, feature)
+            }
+        }
+
+        parsed = append(parsed, &account{
+            Account:    a,
+            tokenHash:  tokenHash,
+            portRanges: portRanges,
+            hostnames:  hostnames,
+        })
+    }
+
+    s.accounts = parsed
+    return nil
+}
+
+// parsePortRanges parses "port" and "first-last" entries
+func parsePortRanges(entries []string) ([][2]int, error) {
+    ranges := make([][2]int, 0, len(entries))
+    for _, entry := range entries {
+        first, last, isRange := strings.Cut(strings.TrimSpace(entry), "-")
+        if !isRange {
+            last = first
+        }
+        low, err := strconv.Atoi(first)
+        if err != nil {
+            return nil, fmt.Errorf("invalid port range %q", entry)
+        }
+        high, err := strconv.Atoi(last)
+        if err != nil || low < 1 || high > 65535 || low > high {
+            return nil, fmt.Errorf("invalid port range %q", entry)
+        }
+        ranges = append(ranges, [2]int{low, high})
+    }
+    return ranges, nil
+}
+
+// parseHostnamePatterns validates exact hostnames and "*.domain" patterns
+func parseHostnamePatterns(patterns []string) ([]string, error) {
+    parsed := make([]string, 0, len(patterns))
+    for _, pattern := range patterns {
+        domain, isWildcard := strings.CutPrefix(strings.TrimSpace(pattern), "*.")
+        hostname, err := normalizeHostname(domain)
+        if err != nil {
+            return nil, fmt.Errorf("invalid hostname pattern %q, want a hostname or *.domain", pattern)
+        }
+        if isWildcard {
+            hostname = "*." + hostname
+        }
+        parsed = append(parsed, hostname)
+    }
+    return parsed, nil
+}
+
+// authenticate finds the account a registration token belongs to
+func (s *RelayServer) authenticate(token string) (*account, error) {
+    if token == "" {
+        return nil, fmt.Errorf("this relay requires a token")
+    }
+
+    hash := sha256.Sum256([]byte(token))
+    for _, a := range s.accounts {
+        if subtle.ConstantTimeCompare(hash[:], a.tokenHash) == 1 {
+            return a, nil
+        }
+    }
+    return nil, fmt.Errorf("invalid token")
+}
+
+// allowsFeature reports whether the account may use feature. A nil account
+// means the relay has no accounts, so everything is allowed.
+func (a *account) allowsFeature(feature string) bool {
+    if a == nil || len(a.Features) == 0 {
+        return true
+    }
+    for _, allowed := range a.Features {
+        if allowed == feature {
+            return true
+        }
+    }
+    return false
+}
+
+// allowsPort reports whether the account may use a public port
+func (a *account) allowsPort(port int) bool {
+    if a == nil || len(a.portRanges) == 0 {
+        return true
+    }
+    for _, r := range a.portRanges {
+        if port >= r[0] && port <= r[1] {
+            return true
+        }
+    }
+    return false
+}
+
+// allowsHostname reports whether the account may serve hostname
+func (a *account) allowsHostname(hostname string) bool {
+    if a == nil {
+        return true
+    }
+    for _, pattern := range a.hostnames {
+        // "*.example.com" stops at a label, so evilexample.com is not under it
+        if domain, isWildcard := strings.CutPrefix(pattern, "*."); isWildcard {
+            if strings.HasSuffix(hostname, "."+domain) {
+                return true
+            }
+        } else if hostname == pattern {
+            return true
+        }
+    }
+    return false
+}
+
+// checkRegistration applies the account's limits to a registration and
+// takes a tunnel slot, which releaseTunnel gives back
+func (s *RelayServer) checkRegistration(a *account, req protocol.RegistrationRequest) error {
+    if a == nil {
+        return nil
+    }
+
+    if !a.allowsFeature(req.Protocol) {
+        return fmt.Errorf("%s tunnels are not enabled for account %s", req.Protocol, a.Name)
+    }
+    if req.Port != 0 && !a.allowsPort(req.Port) {
+        return fmt.Errorf("port %d is not allowed for account %s", req.Port, a.Name)
+    }
+    if req.Hostname != "" && !a.allowsHostname(req.Hostname) {
+        return fmt.Errorf("hostname %s is not allowed for account %s", req.Hostname, a.Name)
+    }
+
+    s.accountsMutex.Lock()
+    defer s.accountsMutex.Unlock()
+
+    if a.MaxTunnels > 0 && a.tunnels >= a.MaxTunnels {
+        return fmt.Errorf("account %s has reached its limit of %d tunnels", a.Name, a.MaxTunnels)
+    }
+    a.tunnels++
+    return nil
+}
+
+// releaseTunnel gives back a tunnel slot taken by checkRegistration
+func (s *RelayServer) releaseTunnel(a *account) {
+    if a == nil {
+        return
+    }
+
+    s.accountsMutex.Lock()
+    a.tunnels--
+    s.accountsMutex.Unlock()
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "testing"
+)
+
+// testAccount is an account with token "token" allowed hostnames
+func testAccount(hostnames ...string) Account {
+    hash := sha256.Sum256([]byte("token"))
+    return Account{Name: "test", TokenSHA256: hex.EncodeToString(hash[:]), Hostnames: hostnames}
+}
+
+func TestAllowsHostname(t *testing.T) {
+    s := &RelayServer{}
+    if err := s.SetAccounts([]Account{testAccount("*.Example.com", "app.test.")}); err != nil {
+        t.Fatal(err)
+    }
+    a := s.accounts[0]
+
+    tests := map[string]bool{
+        "app.example.com":     true,
+        "a.b.example.com":     true,
+        "example.com":         false,
+        "evilexample.com":     false,
+        "app.evilexample.com": false,
+        "example.com.evil":    false,
+        "app.test":            true,
+        "www.app.test":        false,
+    }
+    for hostname, want := range tests {
+        if got := a.allowsHostname(hostname); got != want {
+            t.Errorf("allowsHostname(%q) = %v, want %v", hostname, got, want)
+        }
+    }
+}
+
+func TestSetAccountsRejectsBadHostnamePatterns(t *testing.T) {
+    for _, pattern := range []string{"*example.com", "*", "*.", "app.*.com", "a..b", ""} {
+        s := &RelayServer{}
+        if err := s.SetAccounts([]Account{testAccount(pattern)}); err == nil {
+            t.Errorf("pattern %q was accepted", pattern)
+        }
+    }
+}
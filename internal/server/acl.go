@@ -0,0 +1,127 @@
+package server
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "strings"
+
+    "github.com/euphoricair7/tun/internal/audit"
+)
+
+// sourceACL decides which source addresses may reach a tunnel
+type sourceACL struct {
+    allow []*net.IPNet
+    deny  []*net.IPNet
+}
+
+// parseSourceACL parses lists of CIDRs or bare IPs
+func parseSourceACL(allow, deny []string) (sourceACL, error) {
+    var acl sourceACL
+    var err error
+    if acl.allow, err = parseCIDRs(allow); err != nil {
+        return acl, fmt.Errorf("invalid allow list: %w", err)
+    }
+    if acl.deny, err = parseCIDRs(deny); err != nil {
+        return acl, fmt.Errorf("invalid deny list: %w", err)
+    }
+    return acl, nil
+}
+
+// parseCIDRs parses CIDRs, treating bare IPs as single-address networks
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+    networks := make([]*net.IPNet, 0, len(entries))
+    for _, entry := range entries {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if !strings.Contains(entry, "/") {
+            ip := net.ParseIP(entry)
+            if ip == nil {
+                return nil, fmt.Errorf("%q is not an IP or CIDR", entry)
+            }
+            if ip.To4() != nil {
+                entry += "/32"
+            } else {
+                entry += "/128"
+            }
+        }
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            return nil, err
+        }
+        networks = append(networks, network)
+    }
+    return networks, nil
+}
+
+// permits reports whether ip may connect. Deny entries win over allow
+// entries and an empty allow list allows everyone.
+func (a sourceACL) permits(ip net.IP) bool {
+    for _, network := range a.deny {
+        if network.Contains(ip) {
+            return false
+        }
+    }
+    if len(a.allow) == 0 {
+        return true
+    }
+    for _, network := range a.allow {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// SetSourceACL sets CIDR allow and deny lists enforced on every tunnel in
+// addition to the lists each client registers. Must be called before Start.
+func (s *RelayServer) SetSourceACL(allow, deny []string) error {
+    acl, err := parseSourceACL(allow, deny)
+    if err != nil {
+        return err
+    }
+    s.sourceACL = acl
+    return nil
+}
+
+// permitsSource checks a user address against the global and tunnel lists
+func (s *RelayServer) permitsSource(port int, client *clientConnection, userAddr string) bool {
+    host, _, err := net.SplitHostPort(userAddr)
+    if err != nil {
+        host = userAddr
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+        log.Printf("Rejected user %s on port %d: unparseable source address", userAddr, port)
+        s.auditUser(audit.UserRejected, port, client, userAddr, "unparseable source address")
+        return false
+    }
+
+    if !s.sourceACL.permits(ip) || !client.sourceACL.permits(ip) {
+        log.Printf("Rejected user %s on port %d: source not allowed", userAddr, port)
+        s.auditUser(audit.UserRejected, port, client, userAddr, "source not allowed")
+        return false
+    }
+    return true
+}
+
+// filteredListener drops connections that are not admitted
+type filteredListener struct {
+    net.Listener
+    admit func(conn net.Conn) (net.Conn, bool)
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+    for {
+        conn, err := l.Listener.Accept()
+        if err != nil {
+            return nil, err
+        }
+        if admitted, ok := l.admit(conn); ok {
+            return admitted, nil
+        }
+        conn.Close()
+    }
+}
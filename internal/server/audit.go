@@ -0,0 +1,44 @@
+package server
+
+import (
+    "net"
+
+    "github.com/euphoricair7/tun/internal/audit"
+)
+
+// SetAuditLog records registrations, tunnel closures and policy rejections
+// in logger. Must be called before Start.
+func (s *RelayServer) SetAuditLog(logger *audit.Logger) {
+    s.audit = logger
+}
+
+// auditForward records a rejected request of a client to dial a target
+func (s *RelayServer) auditForward(port int, client *clientConnection, target, reason string) {
+    s.audit.Log(audit.Event{
+        Type:     audit.ForwardRejected,
+        Identity: client.identity,
+        SourceIP: clientIdentity(client.conn),
+        Port:     port,
+        Target:   target,
+        Reason:   reason,
+    })
+}
+
+// auditUser records a rejection or failed login of a public user of a
+// tunnel. Repeats from the same source are counted rather than written one
+// by one, so a scan or flood can't fill the audit log or slow accepts.
+func (s *RelayServer) auditUser(eventType string, port int, client *clientConnection, userAddr, reason string) {
+    sourceIP, _, err := net.SplitHostPort(userAddr)
+    if err != nil {
+        sourceIP = userAddr
+    }
+
+    s.audit.LogRepeated(audit.Event{
+        Type:     eventType,
+        Identity: client.identity,
+        SourceIP: sourceIP,
+        Port:     port,
+        Hostname: client.hostname,
+        Reason:   reason,
+    })
+}
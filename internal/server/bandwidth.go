@@ -0,0 +1,228 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/audit"
+    "github.com/euphoricair7/tun/internal/state"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// byteLimiter shapes a stream of bytes to a rate
+type byteLimiter struct {
+    mutex  sync.Mutex
+    bucket *tokenBucket
+}
+
+// newByteLimiter returns nil for an unlimited rate
+func newByteLimiter(rate int64) *byteLimiter {
+    if rate <= 0 {
+        return nil
+    }
+    return &byteLimiter{bucket: newTokenBucket(float64(rate))}
+}
+
+// wait blocks until n bytes may be sent. Chunks larger than what is left in
+// the bucket go into debt so they are never stuck.
+func (l *byteLimiter) wait(n int) {
+    if l == nil {
+        return
+    }
+
+    l.mutex.Lock()
+    delay := l.bucket.reserve(float64(n), time.Now())
+    l.mutex.Unlock()
+
+    if delay > 0 {
+        time.Sleep(delay)
+    }
+}
+
+// SetQuota sets how many bytes each client identity may move through its
+// tunnels per UTC day and per calendar month, zero for unlimited. Until
+// clients have accounts their identity is their IP address. Must be called
+// before Start.
+func (s *RelayServer) SetQuota(daily, monthly int64) error {
+    if daily < 0 || monthly < 0 {
+        return fmt.Errorf("quotas must not be negative")
+    }
+    if daily == 0 && monthly == 0 {
+        s.quota = nil
+        return nil
+    }
+    s.quota = &quotaTracker{
+        daily:   daily,
+        monthly: monthly,
+        usage:   make(map[string]*quotaUsage),
+        dirty:   make(map[string]bool),
+    }
+    return nil
+}
+
+// quotaBucket is where quota usage lives in the state store
+const quotaBucket = "quota"
+
+// quotaTracker counts the bytes of every client identity
+type quotaTracker struct {
+    daily   int64
+    monthly int64
+    mutex   sync.Mutex
+    usage   map[string]*quotaUsage
+    dirty   map[string]bool // identities whose usage is not saved yet
+}
+
+// quotaUsage is one identity's usage in the current day and month
+type quotaUsage struct {
+    Day        string `json:"day"`
+    DayBytes   int64  `json:"day_bytes"`
+    Month      string `json:"month"`
+    MonthBytes int64  `json:"month_bytes"`
+}
+
+// load reads usage saved before the relay restarted
+func (q *quotaTracker) load(store state.Store) error {
+    values, err := store.List(quotaBucket)
+    if err != nil {
+        return err
+    }
+
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    for identity, value := range values {
+        var usage quotaUsage
+        if err := json.Unmarshal(value, &usage); err != nil {
+            return fmt.Errorf("invalid quota usage of %s: %w", identity, err)
+        }
+        q.usage[identity] = &usage
+    }
+    return nil
+}
+
+// save writes usage that changed since the last save. Usage is only saved
+// periodically, so a crash loses at most the traffic since then.
+func (q *quotaTracker) save(store state.Store) {
+    q.mutex.Lock()
+    changed := make(map[string][]byte, len(q.dirty))
+    for identity := range q.dirty {
+        value, err := json.Marshal(q.usage[identity])
+        if err == nil {
+            changed[identity] = value
+        }
+    }
+    q.dirty = make(map[string]bool)
+    q.mutex.Unlock()
+
+    for identity, value := range changed {
+        if err := store.Put(quotaBucket, identity, value); err != nil {
+            log.Printf("Failed to save quota usage of %s: %v", identity, err)
+        }
+    }
+}
+
+// add records n bytes for identity and returns an error once a quota is
+// exhausted. add(identity, 0) checks without recording.
+func (q *quotaTracker) add(identity string, n int64) error {
+    if q == nil {
+        return nil
+    }
+
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    now := time.Now().UTC()
+    day, month := now.Format("2006-01-02"), now.Format("2006-01")
+
+    usage, exists := q.usage[identity]
+    if !exists {
+        usage = &quotaUsage{}
+        q.usage[identity] = usage
+    }
+    if usage.Day != day {
+        usage.Day, usage.DayBytes = day, 0
+    }
+    if usage.Month != month {
+        usage.Month, usage.MonthBytes = month, 0
+    }
+
+    if n > 0 {
+        usage.DayBytes += n
+        usage.MonthBytes += n
+        q.dirty[identity] = true
+    }
+
+    if q.monthly > 0 && usage.MonthBytes >= q.monthly {
+        return fmt.Errorf("monthly quota of %d bytes exhausted, resets %s",
+            q.monthly, time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339))
+    }
+    if q.daily > 0 && usage.DayBytes >= q.daily {
+        return fmt.Errorf("daily quota of %d bytes exhausted, resets %s",
+            q.daily, time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339))
+    }
+    return nil
+}
+
+// clientIdentity names the owner of a control connection for quotas
+func clientIdentity(conn net.Conn) string {
+    host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+    if err != nil {
+        return conn.RemoteAddr().String()
+    }
+    return host
+}
+
+// accountTraffic shapes and counts n bytes moving through a tunnel, inbound
+// meaning from a user towards the client. It reports false if the tunnel was
+// suspended because its quota ran out.
+func (s *RelayServer) accountTraffic(port int, client *clientConnection, n int, inbound bool) bool {
+    if inbound {
+        client.inboundLimiter.wait(n)
+        client.stats.bytesIn.Add(int64(n))
+    } else {
+        client.outboundLimiter.wait(n)
+        client.stats.bytesOut.Add(int64(n))
+    }
+
+    if err := s.quota.add(client.identity, int64(n)); err != nil {
+        s.suspendClient(port, client, fmt.Sprintf("Quota exhausted: %v", err))
+        return false
+    }
+    return true
+}
+
+// suspendClient tells a client, or every client of its pool, why its tunnel
+// is being closed and closes it
+func (s *RelayServer) suspendClient(port int, client *clientConnection, reason string) {
+    once := &client.suspendOnce
+    if client.pool != nil {
+        once = &client.pool.suspendOnce
+    }
+    once.Do(func() {
+        log.Printf("Suspending tunnel on port %d of %s: %s", port, client.identity, reason)
+        s.audit.Log(audit.Event{
+            Type:     audit.TunnelSuspended,
+            Identity: client.identity,
+            SourceIP: clientIdentity(client.conn),
+            Port:     port,
+            Hostname: client.hostname,
+            Reason:   reason,
+        })
+
+        suspendMsg := protocol.ClientMessage{
+            Type:  protocol.MessageTypeSuspended,
+            Error: reason,
+        }
+        for _, member := range client.members() {
+            if err := member.frames.Encode(suspendMsg); err != nil {
+                log.Printf("Error notifying client on port %d of suspension: %v", port, err)
+            }
+        }
+
+        s.cleanupClient(port)
+    })
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+func TestOutboundShapingKeepsControlFlowing(t *testing.T) {
+    s := startRelay(t, freePort(t), nil)
+    client := mustRegister(t, s, protocol.RegistrationRequest{OutboundRate: 1000})
+    user := dialTunnel(t, client.resp.PublicPort)
+    connect := client.next(protocol.MessageTypeConnect)
+
+    // Three seconds worth of data less the burst, then the end of it
+    response := strings.Repeat("x", 3000)
+    started := time.Now()
+    for i := 0; i < 3; i++ {
+        client.send(protocol.ClientMessage{Type: protocol.MessageTypeData, UserID: connect.UserID, Data: []byte(response[:1000])})
+    }
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypeCloseWrite, UserID: connect.UserID})
+
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypePing})
+    client.next(protocol.MessageTypePong)
+    if elapsed := time.Since(started); elapsed > time.Second {
+        t.Errorf("pong took %v behind shaped data", elapsed)
+    }
+
+    // The data arrives whole, shaped and before the close
+    readString(t, user, response)
+    if elapsed := time.Since(started); elapsed < 1500*time.Millisecond {
+        t.Errorf("shaped data arrived after %v, want about 2s", elapsed)
+    }
+    user.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if n, err := user.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+        t.Errorf("read %d bytes, %v after the client finished, want EOF", n, err)
+    }
+}
+
+func TestStalledUserDoesNotHoldUpOthers(t *testing.T) {
+    s := startRelay(t, freePort(t), nil)
+    client := mustRegister(t, s, protocol.RegistrationRequest{})
+
+    // A user that stops reading, and one that keeps going
+    stalled := dialTunnel(t, client.resp.PublicPort)
+    stalled.(*net.TCPConn).SetReadBuffer(4096)
+    stalledID := client.next(protocol.MessageTypeConnect).UserID
+    active := dialTunnel(t, client.resp.PublicPort)
+    activeID := client.next(protocol.MessageTypeConnect).UserID
+
+    // Flood the stalled user, ignoring pause, until the relay gives up on it
+    stop := make(chan struct{})
+    go func() {
+        chunk := bytes.Repeat([]byte("x"), 256<<10)
+        encoder := json.NewEncoder(client.conn)
+        for i := 0; i < 256; i++ {
+            select {
+            case <-stop:
+                return
+            default:
+            }
+            msg := protocol.ClientMessage{Type: protocol.MessageTypeData, UserID: stalledID, Data: chunk}
+            if err := encoder.Encode(msg); err != nil {
+                return
+            }
+        }
+    }()
+    if msg := client.next(protocol.MessageTypePause); msg.UserID != stalledID {
+        t.Fatalf("paused user %s, want %s", msg.UserID, stalledID)
+    }
+    for {
+        msg := client.next(protocol.MessageTypeDisconnect)
+        if msg.UserID == stalledID {
+            break
+        }
+    }
+    close(stop)
+
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypeData, UserID: activeID, Data: []byte("still here")})
+    readString(t, active, "still here")
+}
+
+func TestSlowUserIsPausedUntilItCatchesUp(t *testing.T) {
+    s := startRelay(t, freePort(t), nil)
+    client := mustRegister(t, s, protocol.RegistrationRequest{})
+    user := dialTunnel(t, client.resp.PublicPort)
+    userID := client.next(protocol.MessageTypeConnect).UserID
+
+    // Send until the relay has more waiting than the user takes in
+    stop, sent := make(chan struct{}), make(chan int64)
+    go func() {
+        chunk := bytes.Repeat([]byte("x"), 256<<10)
+        encoder := json.NewEncoder(client.conn)
+        var total int64
+        defer func() { sent <- total }()
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+            }
+            msg := protocol.ClientMessage{Type: protocol.MessageTypeData, UserID: userID, Data: chunk}
+            if err := encoder.Encode(msg); err != nil {
+                return
+            }
+            total += int64(len(chunk))
+        }
+    }()
+    msg := client.next(protocol.MessageTypePause)
+    close(stop)
+    total := <-sent
+    if msg.UserID != userID {
+        t.Fatalf("paused user %s, want %s", msg.UserID, userID)
+    }
+
+    // Reading it all resumes the user
+    user.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.CopyN(io.Discard, user, total); err != nil {
+        t.Fatal(err)
+    }
+    if msg := client.next(protocol.MessageTypeResume); msg.UserID != userID {
+        t.Fatalf("resumed user %s, want %s", msg.UserID, userID)
+    }
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/netip"
+    "sync"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/cluster"
+    "github.com/euphoricair7/tun/internal/noiseconn"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// clusterSyncInterval is how often the relay refreshes its claims and
+// reconciles the listeners it holds for tunnels of other instances
+const clusterSyncInterval = 5 * time.Second
+
+// forwardHeaderTimeout bounds how long a peer may take to send the header
+// of a forwarded connection once the handshake is done
+const forwardHeaderTimeout = 10 * time.Second
+
+// clusterState holds everything a relay needs to take part in a cluster
+type clusterState struct {
+    registry        cluster.Registry
+    instanceID      string
+    peerAddr        string
+    advertiseAddr   string
+    secret          []byte // shared by every instance, authenticates peers
+    peerListener    net.Listener
+    remoteListeners map[int]net.Listener // public ports of tunnels held by other instances
+    remoteMutex     sync.Mutex
+    stopOnce        sync.Once
+    stop            chan struct{}
+}
+
+// forwardHeader precedes a user connection forwarded between relay
+// instances. It is only trusted from peers that proved they hold the
+// cluster secret.
+type forwardHeader struct {
+    Port       int    `json:"port"`
+    UserAddr   string `json:"user_addr"`
+    PublicAddr string `json:"public_addr"`
+}
+
+// EnableCluster makes the relay share its tunnels with other instances
+// through registry. instanceID must be unique within the cluster, peerAddr
+// is where the relay accepts user connections forwarded by other instances
+// and advertiseAddr is how those instances reach it. Connections between
+// instances are encrypted and authenticated with secret, which every
+// instance must share. Must be called before Start.
+func (s *RelayServer) EnableCluster(registry cluster.Registry, instanceID, peerAddr, advertiseAddr string, secret []byte) {
+    if advertiseAddr == "" {
+        advertiseAddr = peerAddr
+    }
+    s.cluster = &clusterState{
+        registry:        registry,
+        instanceID:      instanceID,
+        peerAddr:        peerAddr,
+        advertiseAddr:   advertiseAddr,
+        secret:          secret,
+        remoteListeners: make(map[int]net.Listener),
+        stop:            make(chan struct{}),
+    }
+}
+
+// startCluster begins accepting forwarded connections and syncing with the registry
+func (s *RelayServer) startCluster() error {
+    if len(s.cluster.secret) == 0 {
+        return fmt.Errorf("clustering needs a cluster secret")
+    }
+
+    var err error
+    s.cluster.peerListener, err = net.Listen("tcp", s.cluster.peerAddr)
+    if err != nil {
+        return fmt.Errorf("failed to start cluster listener: %w", err)
+    }
+
+    log.Printf("Cluster instance %s accepting forwarded connections on %s",
+        s.cluster.instanceID, s.cluster.peerAddr)
+
+    go s.acceptPeerConnections()
+    go s.syncCluster()
+    return nil
+}
+
+// stopCluster releases every claim and stops accepting forwarded connections
+func (s *RelayServer) stopCluster() {
+    s.cluster.stopOnce.Do(func() {
+        close(s.cluster.stop)
+        if s.cluster.peerListener != nil {
+            s.cluster.peerListener.Close()
+        }
+
+        s.cluster.remoteMutex.Lock()
+        for port, listener := range s.cluster.remoteListeners {
+            listener.Close()
+            delete(s.cluster.remoteListeners, port)
+        }
+        s.cluster.remoteMutex.Unlock()
+
+        s.clientsMutex.RLock()
+        for port := range s.clients {
+            if err := s.cluster.registry.Release(port, s.cluster.instanceID); err != nil {
+                log.Printf("Error releasing port %d in registry: %v", port, err)
+            }
+        }
+        s.clientsMutex.RUnlock()
+    })
+}
+
+// claimPort records this instance as the owner of port in the registry
+func (s *RelayServer) claimPort(port int) error {
+    if s.cluster == nil {
+        return nil
+    }
+
+    return s.cluster.registry.Claim(cluster.Entry{
+        Port:     port,
+        Instance: s.cluster.instanceID,
+        Addr:     s.cluster.advertiseAddr,
+    })
+}
+
+// unclaimPort removes the claim of this instance on port from the registry
+func (s *RelayServer) unclaimPort(port int) {
+    if s.cluster == nil {
+        return
+    }
+
+    if err := s.cluster.registry.Release(port, s.cluster.instanceID); err != nil {
+        log.Printf("Error releasing port %d in registry: %v", port, err)
+    }
+}
+
+// syncCluster periodically refreshes our claims and listens on the public
+// ports of tunnels held by other instances
+func (s *RelayServer) syncCluster() {
+    ticker := time.NewTicker(clusterSyncInterval)
+    defer ticker.Stop()
+
+    for {
+        s.refreshClaims()
+        s.reconcileRemoteListeners()
+
+        select {
+        case <-s.cluster.stop:
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// refreshClaims keeps the claims of our connected clients alive
+func (s *RelayServer) refreshClaims() {
+    s.clientsMutex.RLock()
+    ports := make([]int, 0, len(s.clients))
+    for port := range s.clients {
+        ports = append(ports, port)
+    }
+    s.clientsMutex.RUnlock()
+
+    for _, port := range ports {
+        if err := s.claimPort(port); err != nil {
+            log.Printf("Error refreshing claim on port %d: %v", port, err)
+        }
+    }
+}
+
+// reconcileRemoteListeners opens listeners for tunnels held by other
+// instances and closes the ones whose tunnels went away
+func (s *RelayServer) reconcileRemoteListeners() {
+    entries, err := s.cluster.registry.List()
+    if err != nil {
+        log.Printf("Error listing cluster registry: %v", err)
+        return
+    }
+
+    remote := make(map[int]bool)
+    for _, entry := range entries {
+        if entry.Instance != s.cluster.instanceID {
+            remote[entry.Port] = true
+        }
+    }
+
+    s.cluster.remoteMutex.Lock()
+    defer s.cluster.remoteMutex.Unlock()
+
+    select {
+    case <-s.cluster.stop:
+        return
+    default:
+    }
+
+    for port, listener := range s.cluster.remoteListeners {
+        if !remote[port] {
+            listener.Close()
+            delete(s.cluster.remoteListeners, port)
+        }
+    }
+
+    for port := range remote {
+        if _, exists := s.cluster.remoteListeners[port]; exists {
+            continue
+        }
+
+        listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+        if err != nil {
+            log.Printf("Failed to listen on port %d for remote tunnel: %v", port, err)
+            continue
+        }
+        s.cluster.remoteListeners[port] = listener
+        go s.acceptRemoteUsers(port, listener)
+    }
+}
+
+// acceptRemoteUsers forwards user connections for a tunnel held by another instance
+func (s *RelayServer) acceptRemoteUsers(port int, listener net.Listener) {
+    defer listener.Close()
+
+    for {
+        userConn, err := listener.Accept()
+        if err != nil {
+            return // Listener closed by reconcile or shutdown
+        }
+
+        s.activeUsers.add()
+        go s.forwardToPeer(port, userConn)
+    }
+}
+
+// forwardToPeer relays a user connection to the instance holding the tunnel
+func (s *RelayServer) forwardToPeer(port int, userConn net.Conn) {
+    defer s.activeUsers.done()
+    defer userConn.Close()
+
+    entry, found, err := cluster.Lookup(s.cluster.registry, port)
+    if err != nil || !found || entry.Instance == s.cluster.instanceID {
+        log.Printf("No remote relay holds port %d, dropping user %s", port, userConn.RemoteAddr())
+        return
+    }
+
+    conn, err := net.DialTimeout("tcp", entry.Addr, 10*time.Second)
+    if err != nil {
+        log.Printf("Failed to reach relay %s for port %d: %v", entry.Instance, port, err)
+        return
+    }
+    defer conn.Close()
+
+    peerConn, err := noiseconn.PeerClient(conn, s.cluster.secret)
+    if err != nil {
+        log.Printf("Failed to reach relay %s for port %d: %v", entry.Instance, port, err)
+        return
+    }
+
+    header := forwardHeader{
+        Port:       port,
+        UserAddr:   userConn.RemoteAddr().String(),
+        PublicAddr: userConn.LocalAddr().String(),
+    }
+    if err := json.NewEncoder(peerConn).Encode(header); err != nil {
+        log.Printf("Error forwarding user to relay %s: %v", entry.Instance, err)
+        return
+    }
+
+    // Copy both directions until either side closes. The peer connection
+    // can't be half closed, so the first side to finish ends both and the
+    // other copy is waited for before returning.
+    done := make(chan struct{}, 2)
+    go func() {
+        io.Copy(peerConn, userConn)
+        done <- struct{}{}
+    }()
+    go func() {
+        io.Copy(userConn, peerConn)
+        done <- struct{}{}
+    }()
+    <-done
+    userConn.Close()
+    conn.Close()
+    <-done
+}
+
+// acceptPeerConnections handles user connections forwarded by other instances
+func (s *RelayServer) acceptPeerConnections() {
+    for {
+        conn, err := s.cluster.peerListener.Accept()
+        if err != nil {
+            return // Listener closed by drain or shutdown
+        }
+
+        go s.handlePeerConnection(conn)
+    }
+}
+
+// handlePeerConnection hands a forwarded user connection to the local client
+func (s *RelayServer) handlePeerConnection(rawConn net.Conn) {
+    // Only peers holding the cluster secret may speak for users
+    conn, err := noiseconn.PeerServer(rawConn, s.cluster.secret)
+    if err != nil {
+        log.Printf("Rejected cluster connection from %s: %v", rawConn.RemoteAddr(), err)
+        rawConn.Close()
+        return
+    }
+
+    conn.SetReadDeadline(time.Now().Add(forwardHeaderTimeout))
+    reader := bufio.NewReader(conn)
+    line, err := reader.ReadBytes('\n')
+    if err != nil {
+        log.Printf("Error reading forward header from %s: %v", conn.RemoteAddr(), err)
+        conn.Close()
+        return
+    }
+
+    var header forwardHeader
+    if err := json.Unmarshal(line, &header); err != nil {
+        log.Printf("Invalid forward header from %s: %v", conn.RemoteAddr(), err)
+        conn.Close()
+        return
+    }
+    conn.SetReadDeadline(time.Time{})
+
+    s.clientsMutex.RLock()
+    client, exists := s.clients[header.Port]
+    s.clientsMutex.RUnlock()
+
+    if !exists {
+        log.Printf("Forwarded user for port %d but no client holds it here", header.Port)
+        conn.Close()
+        return
+    }
+
+    // The reader may already hold data the user sent after the header
+    var userConn net.Conn = &bufferedConn{
+        Conn:       conn,
+        reader:     reader,
+        remoteAddr: parseAddr(header.UserAddr),
+        localAddr:  parseAddr(header.PublicAddr),
+    }
+
+    userConn, ok := s.admitUser(header.Port, client, userConn, header.UserAddr)
+    if !ok {
+        conn.Close()
+        return
+    }
+
+    if client.protocol == protocol.ProtocolHTTP {
+        client.httpListener.inject(userConn)
+        return
+    }
+    s.startUserSession(header.Port, client, userConn, header.UserAddr, header.PublicAddr)
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader. It
+// reports the addresses of the original user connection when they are known.
+type bufferedConn struct {
+    net.Conn
+    reader     *bufio.Reader
+    remoteAddr net.Addr
+    localAddr  net.Addr
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+    return c.reader.Read(p)
+}
+
+func (c *bufferedConn) RemoteAddr() net.Addr {
+    if c.remoteAddr != nil {
+        return c.remoteAddr
+    }
+    return c.Conn.RemoteAddr()
+}
+
+func (c *bufferedConn) LocalAddr() net.Addr {
+    if c.localAddr != nil {
+        return c.localAddr
+    }
+    return c.Conn.LocalAddr()
+}
+
+// parseAddr parses an ip:port address, returning nil if it is not one
+func parseAddr(addr string) net.Addr {
+    addrPort, err := netip.ParseAddrPort(addr)
+    if err != nil {
+        return nil
+    }
+    return net.TCPAddrFromAddrPort(addrPort)
+}
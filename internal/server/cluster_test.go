@@ -0,0 +1,114 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/cluster"
+    "github.com/euphoricair7/tun/internal/noiseconn"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+var testClusterSecret = []byte("test cluster secret")
+
+// startClusterRelay starts a relay of a cluster sharing registry
+func startClusterRelay(t *testing.T, registry cluster.Registry, id string, publicPort int) *RelayServer {
+    t.Helper()
+    peerAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+    return startRelay(t, publicPort, func(s *RelayServer) {
+        s.EnableCluster(registry, id, peerAddr, "", testClusterSecret)
+    })
+}
+
+func TestClusterForwardsUsersToOwner(t *testing.T) {
+    registry := cluster.NewMemoryRegistry(cluster.DefaultTTL)
+    owner := startClusterRelay(t, registry, "a", freePort(t))
+    other := startClusterRelay(t, registry, "b", freePort(t))
+
+    client := mustRegister(t, owner, protocol.RegistrationRequest{})
+    port := client.resp.PublicPort
+
+    // A user reaching the other instance on the tunnel's port
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    user, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer user.Close()
+    accepted, err := listener.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    other.activeUsers.add()
+    go other.forwardToPeer(port, accepted)
+
+    connect := client.next(protocol.MessageTypeConnect)
+    if connect.SourceAddr != user.LocalAddr().String() {
+        t.Errorf("owner saw user %s, want %s", connect.SourceAddr, user.LocalAddr())
+    }
+
+    user.Write([]byte("ping"))
+    if data := client.next(protocol.MessageTypeData); string(data.Data) != "ping" {
+        t.Errorf("client got %q, want ping", data.Data)
+    }
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypeData, UserID: connect.UserID, Data: []byte("pong")})
+    readString(t, user, "pong")
+}
+
+func TestClusterRejectsUnauthenticatedPeers(t *testing.T) {
+    registry := cluster.NewMemoryRegistry(cluster.DefaultTTL)
+    owner := startClusterRelay(t, registry, "a", freePort(t))
+    client := mustRegister(t, owner, protocol.RegistrationRequest{})
+    header := forwardHeader{Port: client.resp.PublicPort, UserAddr: "203.0.113.7:4000", PublicAddr: "198.51.100.1:80"}
+
+    // A forged header without a handshake
+    conn, err := net.Dial("tcp", owner.cluster.peerAddr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    json.NewEncoder(conn).Encode(header)
+    conn.Close()
+
+    // A handshake with the wrong secret
+    conn, err = net.Dial("tcp", owner.cluster.peerAddr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := noiseconn.PeerClient(conn, []byte("guessed")); err == nil {
+        t.Error("handshake with the wrong secret succeeded")
+    }
+    conn.Close()
+
+    if !client.quiet(protocol.MessageTypeConnect, 300*time.Millisecond) {
+        t.Error("an unauthenticated peer reached the tunnel")
+    }
+}
+
+func TestClusterFailover(t *testing.T) {
+    registry := cluster.NewMemoryRegistry(cluster.DefaultTTL)
+    port := freePort(t)
+    first := startClusterRelay(t, registry, "a", port)
+    second := startClusterRelay(t, registry, "b", port)
+
+    mustRegister(t, first, protocol.RegistrationRequest{})
+    if c := register(t, second, protocol.RegistrationRequest{}); c.resp.Success {
+        t.Fatal("second instance handed out a port the first one holds")
+    } else if !strings.Contains(c.resp.Error, "no available ports") {
+        t.Fatalf("unexpected rejection: %s", c.resp.Error)
+    }
+
+    // The first instance goes away and releases its claims
+    stopRelay(first)
+    client := mustRegister(t, second, protocol.RegistrationRequest{})
+    if client.resp.PublicPort != port {
+        t.Errorf("second instance took over port %d, want %d", client.resp.PublicPort, port)
+    }
+}
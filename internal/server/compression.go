@@ -0,0 +1,32 @@
+package server
+
+import (
+    "github.com/euphoricair7/tun/internal/compress"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// negotiateCompression returns the compression the relay agrees to for a
+// registration, empty for none
+func negotiateCompression(req protocol.RegistrationRequest) string {
+    if req.Compression == protocol.CompressionDeflate {
+        return protocol.CompressionDeflate
+    }
+    return ""
+}
+
+// newCompressor returns a compressor for the frames of one user sent to the
+// client, nil if the tunnel is not compressed
+func (c *clientConnection) newCompressor() *compress.Compressor {
+    if c.compression == "" {
+        return nil
+    }
+    return compress.NewCompressor(c.compressionThreshold)
+}
+
+// frameData returns the payload of a data frame from the client
+func frameData(msg protocol.ClientMessage) ([]byte, error) {
+    if !msg.Compressed {
+        return msg.Data, nil
+    }
+    return compress.Decompress(msg.Data)
+}
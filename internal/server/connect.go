@@ -0,0 +1,75 @@
+package server
+
+import (
+    "errors"
+    "log"
+    "net"
+    "net/http"
+    "sync/atomic"
+)
+
+// connectFailer is implemented by user connections that want to know when
+// the client could not reach its local service for them
+type connectFailer interface {
+    connectFailed()
+}
+
+// connectFailed handles the client failing to reach its local service for
+// a user, closing the user's connection right away
+func (s *RelayServer) connectFailed(port int, client *clientConnection, userID, reason string) {
+    log.Printf("Client on port %d could not reach its local service for user %s: %s", port, userID, reason)
+    client.stats.dialFailures.Add(1)
+    client.stats.lastDialError.Store(reason)
+
+    client.userConnMutex.Lock()
+    userConn, exists := client.userConns[userID]
+    delete(client.userConns, userID)
+    client.userConnMutex.Unlock()
+    if !exists {
+        return
+    }
+
+    notifyConnectFailed(userConn)
+    userConn.Close()
+}
+
+// notifyConnectFailed tells conn, or the connection it wraps, that the
+// client could not reach its local service
+func notifyConnectFailed(conn net.Conn) {
+    switch c := conn.(type) {
+    case connectFailer:
+        c.connectFailed()
+    case *halfCloseConn:
+        notifyConnectFailed(c.Conn)
+    }
+}
+
+// httpStream is the relay's end of a stream carrying one HTTP request
+type httpStream struct {
+    net.Conn
+    failed *atomic.Bool
+}
+
+func (h *httpStream) connectFailed() {
+    h.failed.Store(true)
+}
+
+// localDownContextKey holds a request's *atomic.Bool that is set when the
+// client could not reach its local service for it
+type localDownContextKey struct{}
+
+// proxyError answers requests the tunnel could not pass on
+func proxyError(port int) func(http.ResponseWriter, *http.Request, error) {
+    return func(w http.ResponseWriter, r *http.Request, err error) {
+        if errors.Is(err, errServiceDown) {
+            serviceUnavailable(w)
+            return
+        }
+        if failed, _ := r.Context().Value(localDownContextKey{}).(*atomic.Bool); failed != nil && failed.Load() {
+            http.Error(w, "Bad gateway: the tunnel client could not reach its local service", http.StatusBadGateway)
+            return
+        }
+        log.Printf("Error proxying request on port %d: %v", port, err)
+        http.Error(w, "Bad gateway", http.StatusBadGateway)
+    }
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "sync"
+
+    "github.com/euphoricair7/tun/internal/bufpool"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// SetReadSize sets how many bytes are read from a user at once, and so the
+// largest data frame sent to clients. Must be called before Start.
+func (s *RelayServer) SetReadSize(size int) error {
+    if size <= 0 || size > protocol.MaxReadSize {
+        return fmt.Errorf("read size must be between 1 and %d bytes", protocol.MaxReadSize)
+    }
+    s.readSize = size
+    return nil
+}
+
+// Data from the client waiting for one user is bounded without the control
+// reader ever waiting for the user, since every other user of the tunnel
+// would wait too. The client is asked to pause the user's local service
+// once pauseQueuedBytes wait and to resume below resumeQueuedBytes. Users
+// more than maxQueuedBytes behind, because the client ignores pause or a lot
+// was in flight, are closed.
+const (
+    pauseQueuedBytes  = 1 << 20
+    resumeQueuedBytes = 256 << 10
+    maxQueuedBytes    = 8 << 20
+)
+
+// queuedFrame is a data, close_write or disconnect message from the client
+// waiting for a user, data being its payload from frameData
+type queuedFrame struct {
+    msg  protocol.ClientMessage
+    data []byte
+}
+
+// userQueue holds what the client sent for a user until the user's writer
+// passes it on, so neither a slow user nor the tunnel's outbound bandwidth
+// limit holds up the client's control connection
+type userQueue struct {
+    mutex  sync.Mutex
+    ready  sync.Cond // signalled when frames are queued or written, or the user closes
+    frames []queuedFrame
+    bytes  int
+    closed bool
+
+    flowMutex sync.Mutex // serializes pause and resume so the last one sent is right
+    paused    bool       // the client was last told to pause
+}
+
+// queue hands a frame to the user's writer, dropping it if the user is
+// gone. It reports false, leaving the frame to the caller, if data would put
+// the user more than maxQueuedBytes behind.
+func (c *halfCloseConn) queue(msg protocol.ClientMessage, data []byte) bool {
+    q := &c.outbound
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+    if q.closed {
+        releaseFrame(msg, data)
+        return true
+    }
+    if len(data) > 0 && q.bytes > 0 && q.bytes+len(data) > maxQueuedBytes {
+        return false
+    }
+    q.frames = append(q.frames, queuedFrame{msg: msg, data: data})
+    q.bytes += len(data)
+    q.ready.Broadcast()
+    return true
+}
+
+// next waits for the next frame for the user, reporting false once the
+// user is closed
+func (c *halfCloseConn) next() (queuedFrame, bool) {
+    q := &c.outbound
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+    for len(q.frames) == 0 && !q.closed {
+        q.ready.Wait()
+    }
+    if q.closed {
+        for _, frame := range q.frames {
+            releaseFrame(frame.msg, frame.data)
+        }
+        q.frames, q.bytes = nil, 0
+        return queuedFrame{}, false
+    }
+
+    frame := q.frames[0]
+    q.frames[0] = queuedFrame{}
+    q.frames = q.frames[1:]
+    return frame, true
+}
+
+// written frees the room taken by n bytes the writer passed on
+func (c *halfCloseConn) written(n int) {
+    q := &c.outbound
+    q.mutex.Lock()
+    q.bytes -= n
+    q.ready.Broadcast()
+    q.mutex.Unlock()
+}
+
+// updateFlow tells the client to pause or resume the user's local service
+// when the data waiting for the user crossed a watermark
+func (c *halfCloseConn) updateFlow(client *clientConnection, userID string) {
+    q := &c.outbound
+    q.flowMutex.Lock()
+    defer q.flowMutex.Unlock()
+
+    q.mutex.Lock()
+    pause := q.paused
+    switch {
+    case q.bytes >= pauseQueuedBytes:
+        pause = true
+    case q.bytes <= resumeQueuedBytes:
+        pause = false
+    }
+    closed := q.closed
+    q.mutex.Unlock()
+    if closed || pause == q.paused {
+        return
+    }
+
+    q.paused = pause
+    msg := protocol.ClientMessage{Type: protocol.MessageTypeResume, UserID: userID}
+    if pause {
+        msg.Type = protocol.MessageTypePause
+    }
+    if err := client.frames.Encode(msg); err != nil {
+        log.Printf("Error sending %s for user %s to client: %v", msg.Type, userID, err)
+    }
+}
+
+// writeToUser passes what the client sent for a user on in order, shaping
+// data to the tunnel's outbound bandwidth limit and resuming the user's
+// local service once it caught up
+func (s *RelayServer) writeToUser(port int, client *clientConnection, userID string, userConn *halfCloseConn) {
+    for {
+        frame, ok := userConn.next()
+        if !ok {
+            return
+        }
+
+        switch frame.msg.Type {
+        case protocol.MessageTypeCloseWrite:
+            userConn.clientFinished()
+            continue
+        case protocol.MessageTypeDisconnect:
+            userConn.Close()
+            return
+        }
+
+        if !s.accountTraffic(port, client, len(frame.data), false) {
+            releaseFrame(frame.msg, frame.data)
+            return
+        }
+        _, err := userConn.Write(frame.data)
+        userConn.written(len(frame.data))
+        releaseFrame(frame.msg, frame.data)
+        userConn.updateFlow(client, userID)
+        if err != nil {
+            select {
+            case <-userConn.closed:
+            default:
+                log.Printf("Error writing to user %s: %v", userID, err)
+            }
+            client.userConnMutex.Lock()
+            if client.userConns[userID] == net.Conn(userConn) {
+                delete(client.userConns, userID)
+            }
+            client.userConnMutex.Unlock()
+            userConn.Close()
+            return
+        }
+    }
+}
+
+// releaseFrame hands the buffers of a data frame from the client back once
+// data, its payload from frameData, has been passed on
+func releaseFrame(msg protocol.ClientMessage, data []byte) {
+    if msg.Compressed {
+        bufpool.Put(data)
+    }
+    msg.Data.Release()
+}
@@ -0,0 +1,115 @@
+package server_test
+
+import (
+    "io"
+    "log"
+    "net"
+    "os"
+    "runtime"
+    "strconv"
+    "testing"
+
+    "github.com/euphoricair7/tun/internal/client"
+    "github.com/euphoricair7/tun/internal/server"
+)
+
+// benchmarkChunk is what one benchmark operation moves, so allocs/op is
+// also allocations per MB
+const benchmarkChunk = 1 << 20
+
+// BenchmarkDataPath moves data between a user and a local service through
+// a relay and a client on loopback. Upload goes through the relay's
+// handleUserData and the client's forwardToLocalService, download through
+// the client's readLocal and the relay's control reader.
+func BenchmarkDataPath(b *testing.B) {
+    log.SetOutput(io.Discard)
+    defer log.SetOutput(os.Stderr)
+
+    b.Run("upload", func(b *testing.B) {
+        benchmarkDataPath(b, func(user, local net.Conn, total int64) error {
+            go writeChunks(user, b.N)
+            _, err := io.CopyN(io.Discard, local, total)
+            return err
+        })
+    })
+    b.Run("download", func(b *testing.B) {
+        benchmarkDataPath(b, func(user, local net.Conn, total int64) error {
+            go writeChunks(local, b.N)
+            _, err := io.CopyN(io.Discard, user, total)
+            return err
+        })
+    })
+}
+
+// benchmarkDataPath connects a user to a local service through a tunnel and
+// times move carrying b.N chunks between them
+func benchmarkDataPath(b *testing.B, move func(user, local net.Conn, total int64) error) {
+    service, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer service.Close()
+
+    registrationPort, publicPort := benchmarkPort(b), benchmarkPort(b)
+    relay, err := server.NewRelayServer(registrationPort, publicPort, publicPort)
+    if err != nil {
+        b.Fatal(err)
+    }
+    go relay.Start()
+    defer relay.Shutdown()
+
+    servicePort := service.Addr().(*net.TCPAddr).Port
+    c, err := client.NewTunnelClient("127.0.0.1", registrationPort, "127.0.0.1", servicePort)
+    if err != nil {
+        b.Fatal(err)
+    }
+    for attempt := 0; ; attempt++ {
+        if err = c.Start(); err == nil {
+            break
+        }
+        if attempt == 100 {
+            b.Fatal(err)
+        }
+        runtime.Gosched()
+    }
+    defer c.Shutdown()
+
+    user, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(publicPort)))
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer user.Close()
+    local, err := service.Accept()
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer local.Close()
+
+    b.SetBytes(benchmarkChunk)
+    b.ReportAllocs()
+    b.ResetTimer()
+    if err := move(user, local, int64(b.N)*benchmarkChunk); err != nil {
+        b.Fatal(err)
+    }
+    b.StopTimer()
+}
+
+// writeChunks writes n chunks of benchmarkChunk bytes to conn
+func writeChunks(conn net.Conn, n int) {
+    chunk := make([]byte, benchmarkChunk)
+    for i := 0; i < n; i++ {
+        if _, err := conn.Write(chunk); err != nil {
+            return
+        }
+    }
+}
+
+// benchmarkPort returns a TCP port nothing listens on right now
+func benchmarkPort(b *testing.B) int {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer listener.Close()
+    return listener.Addr().(*net.TCPAddr).Port
+}
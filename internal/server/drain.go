@@ -0,0 +1,45 @@
+package server
+
+import "sync"
+
+// userCounter counts in-flight user connections. Unlike a sync.WaitGroup
+// users may keep arriving while Drain waits for the count to reach zero.
+type userCounter struct {
+    mutex   sync.Mutex
+    count   int
+    waiters []chan struct{}
+}
+
+// add records a new user connection
+func (c *userCounter) add() {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.count++
+}
+
+// done records that a user connection finished
+func (c *userCounter) done() {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.count--
+    if c.count == 0 {
+        for _, waiter := range c.waiters {
+            close(waiter)
+        }
+        c.waiters = nil
+    }
+}
+
+// idle returns a channel that is closed once no user connection is in
+// flight
+func (c *userCounter) idle() <-chan struct{} {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    waiter := make(chan struct{})
+    if c.count == 0 {
+        close(waiter)
+    } else {
+        c.waiters = append(c.waiters, waiter)
+    }
+    return waiter
+}
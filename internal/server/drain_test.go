@@ -0,0 +1,108 @@
+package server
+
+import (
+    "net"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+func TestUserCounterIdle(t *testing.T) {
+    var users userCounter
+    select {
+    case <-users.idle():
+    default:
+        t.Fatal("counter without users is not idle")
+    }
+
+    users.add()
+    idle := users.idle()
+    users.add()
+    users.done()
+    select {
+    case <-idle:
+        t.Fatal("idle with a user in flight")
+    default:
+    }
+    users.done()
+    select {
+    case <-idle:
+    case <-time.After(time.Second):
+        t.Fatal("not idle after the last user finished")
+    }
+}
+
+func TestUserCounterConcurrentAddWhileWaiting(t *testing.T) {
+    var users userCounter
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 1000; j++ {
+                users.add()
+                users.done()
+            }
+        }()
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 100; j++ {
+                <-users.idle()
+            }
+        }()
+    }
+    wg.Wait()
+}
+
+func TestDrainWaitsForUsers(t *testing.T) {
+    s := startRelay(t, freePort(t), nil)
+    client := mustRegister(t, s, protocol.RegistrationRequest{})
+    user := dialTunnel(t, client.resp.PublicPort)
+    connect := client.next(protocol.MessageTypeConnect)
+
+    drained := make(chan struct{})
+    go func() {
+        s.Drain(5 * time.Second)
+        close(drained)
+    }()
+    client.next(protocol.MessageTypeDraining)
+
+    // The in-flight user keeps working while new users and registrations
+    // are turned away
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypeData, UserID: connect.UserID, Data: []byte("still here")})
+    readString(t, user, "still here")
+    if conn, err := net.DialTimeout("tcp", user.RemoteAddr().String(), time.Second); err == nil {
+        conn.Close()
+        t.Error("draining relay accepted a new user")
+    }
+    select {
+    case <-drained:
+        t.Fatal("Drain returned with a user in flight")
+    case <-time.After(100 * time.Millisecond):
+    }
+
+    // The user hangs up and the client closes its side as well
+    user.Close()
+    client.next(protocol.MessageTypeCloseWrite)
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypeDisconnect, UserID: connect.UserID})
+    select {
+    case <-drained:
+    case <-time.After(3 * time.Second):
+        t.Fatal("Drain did not return once the last user finished")
+    }
+}
+
+func TestDrainTimesOut(t *testing.T) {
+    s := startRelay(t, freePort(t), nil)
+    client := mustRegister(t, s, protocol.RegistrationRequest{})
+    dialTunnel(t, client.resp.PublicPort)
+    client.next(protocol.MessageTypeConnect)
+
+    start := time.Now()
+    s.Drain(200 * time.Millisecond)
+    if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+        t.Errorf("Drain took %s with a timeout of 200ms", elapsed)
+    }
+}
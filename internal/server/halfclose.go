@@ -0,0 +1,84 @@
+package server
+
+import (
+    "net"
+    "sync"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// halfCloseConn is a user connection whose directions can finish one at a
+// time, so a user that shuts down its write side still gets the response
+type halfCloseConn struct {
+    net.Conn
+    mutex      sync.Mutex
+    userDone   bool // the user finished writing
+    clientDone bool // the client finished writing
+    closed     chan struct{}
+    closeOnce  sync.Once
+    outbound   userQueue // what the client sent for the user, see writeToUser
+}
+
+func newHalfCloseConn(conn net.Conn) *halfCloseConn {
+    c := &halfCloseConn{Conn: conn, closed: make(chan struct{})}
+    c.outbound.ready.L = &c.outbound.mutex
+    return c
+}
+
+func (c *halfCloseConn) Close() error {
+    c.closeOnce.Do(func() {
+        close(c.closed)
+        c.outbound.mutex.Lock()
+        c.outbound.closed = true
+        c.outbound.ready.Broadcast()
+        c.outbound.mutex.Unlock()
+    })
+    return c.Conn.Close()
+}
+
+// userFinished records that the user finished writing and reports whether
+// the client had too
+func (c *halfCloseConn) userFinished() bool {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.userDone = true
+    return c.clientDone
+}
+
+// clientFinished records that the client finished writing. The user sees
+// EOF, and the connection closes if the user had finished as well.
+func (c *halfCloseConn) clientFinished() {
+    c.mutex.Lock()
+    c.clientDone = true
+    both := c.userDone
+    c.mutex.Unlock()
+
+    if both {
+        c.Close()
+        return
+    }
+    if err := closeWrite(c.Conn); err != nil {
+        c.Close()
+    }
+}
+
+// closeWrite shuts down the write side of conn, or all of it if conn can't
+// be half closed
+func closeWrite(conn net.Conn) error {
+    switch c := conn.(type) {
+    case interface{ CloseWrite() error }:
+        return c.CloseWrite()
+    case interface{ NetConn() net.Conn }:
+        return closeWrite(c.NetConn())
+    }
+    return conn.Close()
+}
+
+// sendCloseWrite tells the client a user finished writing
+func sendCloseWrite(client *clientConnection, userID string) error {
+    closeMsg := protocol.ClientMessage{
+        Type:   protocol.MessageTypeCloseWrite,
+        UserID: userID,
+    }
+    return client.frames.Encode(closeMsg)
+}
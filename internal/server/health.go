@@ -0,0 +1,59 @@
+package server
+
+import (
+    "errors"
+    "log"
+    "net"
+    "net/http"
+)
+
+// errServiceDown turns users away from a tunnel whose clients all report
+// their local service down
+var errServiceDown = errors.New("the tunnel's local service is down")
+
+// setHealth records what a client reported about its local service, reason
+// being empty once it is up again
+func (c *clientConnection) setHealth(port int, reason string) {
+    previous, _ := c.healthError.Swap(reason).(string)
+    switch {
+    case reason != "" && previous == "":
+        log.Printf("Client %s on port %d reports its local service down: %s", c.conn.RemoteAddr(), port, reason)
+    case reason == "" && previous != "":
+        log.Printf("Client %s on port %d reports its local service up again", c.conn.RemoteAddr(), port)
+    }
+}
+
+// healthy reports whether a client may be sent users
+func (c *clientConnection) healthy() bool {
+    reason, _ := c.healthError.Load().(string)
+    return reason == ""
+}
+
+// downReason returns why a tunnel can't take users when none of its clients
+// can reach its local service, empty while one can
+func (c *clientConnection) downReason() string {
+    reason := ""
+    for _, member := range c.members() {
+        memberReason, _ := member.healthError.Load().(string)
+        if memberReason == "" {
+            return ""
+        }
+        reason = memberReason
+    }
+    return reason
+}
+
+// turnAway closes the connection of a user who arrived while the tunnel's
+// local service is down
+func (s *RelayServer) turnAway(port int, client *clientConnection, userConn net.Conn, userAddr string) error {
+    log.Printf("Turning away user %s from port %d: %v", userAddr, port, errServiceDown)
+    client.stats.rejectedUnhealthy.Add(1)
+    userConn.Close()
+    return errServiceDown
+}
+
+// serviceUnavailable answers a request for a tunnel whose local service is
+// down
+func serviceUnavailable(w http.ResponseWriter) {
+    http.Error(w, "Service unavailable: the tunnel's local service is down for maintenance", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/http/httputil"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/audit"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// hostHeaderRewrite asks for the local service address as Host header
+const hostHeaderRewrite = "rewrite"
+
+// userAddrContextKey carries the public user's address to the stream dialer
+type userAddrContextKey struct{}
+
+// validateHTTPOptions checks the HTTP options of a registration request
+func validateHTTPOptions(req protocol.RegistrationRequest) error {
+    rules := append(append([]protocol.HeaderRule{}, req.RequestHeaders...), req.ResponseHeaders...)
+    for _, rule := range rules {
+        switch rule.Action {
+        case protocol.HeaderActionAdd, protocol.HeaderActionSet, protocol.HeaderActionRemove:
+        default:
+            return fmt.Errorf("invalid header rule action %q", rule.Action)
+        }
+        if rule.Name == "" || strings.ContainsAny(rule.Name, " :\r\n") {
+            return fmt.Errorf("invalid header name %q", rule.Name)
+        }
+        if strings.ContainsAny(rule.Value, "\r\n") {
+            return fmt.Errorf("invalid value for header %s", rule.Name)
+        }
+    }
+    if strings.ContainsAny(req.HostHeader, " /\r\n") {
+        return fmt.Errorf("invalid host header %q", req.HostHeader)
+    }
+    return nil
+}
+
+// newHTTPServer builds the HTTP server that answers on the public port of an
+// HTTP tunnel. Every request is sent to the client over its own stream so
+// the client sees the address of the user who made it.
+func (s *RelayServer) newHTTPServer(port int, client *clientConnection) *http.Server {
+    transport := &http.Transport{
+        DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+            userAddr, _ := ctx.Value(userAddrContextKey{}).(string)
+            publicAddr := ""
+            if localAddr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+                publicAddr = localAddr.String()
+            }
+            failed, _ := ctx.Value(localDownContextKey{}).(*atomic.Bool)
+            return s.openStream(port, client, userAddr, publicAddr, failed)
+        },
+        DisableKeepAlives: true,
+    }
+
+    proxy := &httputil.ReverseProxy{
+        Rewrite: func(pr *httputil.ProxyRequest) {
+            s.rewriteRequest(client, pr)
+        },
+        ModifyResponse: func(resp *http.Response) error {
+            applyHeaderRules(resp.Header, client.responseHeaders)
+            return nil
+        },
+        Transport:    transport,
+        ErrorHandler: proxyError(port),
+    }
+
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !s.allowHTTPRequest(port, client, w, r) {
+            return
+        }
+        if s.oidc != nil {
+            if !s.authorizeOIDC(port, client, w, r) {
+                return
+            }
+            removeRelayCookies(r)
+        }
+        if !client.credentials.authorize(port, w, r) {
+            if r.Header.Get("Authorization") != "" {
+                s.auditUser(audit.AuthFailed, port, client, r.RemoteAddr, "invalid credentials")
+            }
+            return
+        }
+        // Only users who may see the service learn that it is down
+        if client.downReason() != "" {
+            client.stats.rejectedUnhealthy.Add(1)
+            serviceUnavailable(w)
+            return
+        }
+
+        ctx := context.WithValue(r.Context(), userAddrContextKey{}, r.RemoteAddr)
+        ctx = context.WithValue(ctx, localDownContextKey{}, &atomic.Bool{})
+        proxy.ServeHTTP(w, r.WithContext(ctx))
+    })
+
+    return &http.Server{
+        Handler:           handler,
+        ReadHeaderTimeout: 30 * time.Second,
+    }
+}
+
+// rewriteRequest points a request at the tunnel client and applies the
+// tunnel's header rules
+func (s *RelayServer) rewriteRequest(client *clientConnection, pr *httputil.ProxyRequest) {
+    localAddr := net.JoinHostPort(client.targetHost, strconv.Itoa(client.targetPort))
+    pr.SetURL(&url.URL{Scheme: "http", Host: localAddr})
+    pr.SetXForwarded()
+
+    switch client.hostHeader {
+    case "":
+        pr.Out.Host = pr.In.Host
+    case hostHeaderRewrite:
+        pr.Out.Host = localAddr
+    default:
+        pr.Out.Host = client.hostHeader
+    }
+
+    applyHeaderRules(pr.Out.Header, client.requestHeaders)
+}
+
+// applyHeaderRules applies header rules in order
+func applyHeaderRules(header http.Header, rules []protocol.HeaderRule) {
+    for _, rule := range rules {
+        switch rule.Action {
+        case protocol.HeaderActionAdd:
+            header.Add(rule.Name, rule.Value)
+        case protocol.HeaderActionSet:
+            header.Set(rule.Name, rule.Value)
+        case protocol.HeaderActionRemove:
+            header.Del(rule.Name)
+        }
+    }
+}
+
+// serveHTTP answers HTTP requests on the public port of an HTTP tunnel
+func (s *RelayServer) serveHTTP(port int, client *clientConnection) {
+    err := client.httpServer.Serve(client.httpListener)
+    if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+        log.Printf("HTTP server on port %d stopped: %v", port, err)
+    }
+}
+
+// openStream opens a stream to the client as if a user had connected to the
+// public port and returns the relay's end of it. failed, if not nil, is set
+// when the client can't reach its local service.
+func (s *RelayServer) openStream(port int, client *clientConnection, userAddr, publicAddr string, failed *atomic.Bool) (net.Conn, error) {
+    relayEnd, streamEnd := net.Pipe()
+    var userConn net.Conn = streamEnd
+    if failed != nil {
+        userConn = &httpStream{Conn: streamEnd, failed: failed}
+    }
+    if err := s.startUserSession(port, client, userConn, userAddr, publicAddr); err != nil {
+        relayEnd.Close()
+        return nil, err
+    }
+    return relayEnd, nil
+}
+
+// httpListener feeds an HTTP tunnel's server with connections accepted on
+// the public port and with connections forwarded by other relays
+type httpListener struct {
+    net.Listener
+    conns     chan net.Conn
+    errs      chan error
+    closed    chan struct{}
+    closeOnce sync.Once
+}
+
+// newHTTPListener starts accepting on listener
+func newHTTPListener(listener net.Listener) *httpListener {
+    l := &httpListener{
+        Listener: listener,
+        conns:    make(chan net.Conn),
+        errs:     make(chan error, 1),
+        closed:   make(chan struct{}),
+    }
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                l.errs <- err
+                return
+            }
+            if !l.inject(conn) {
+                return
+            }
+        }
+    }()
+
+    return l
+}
+
+// inject hands a connection to the HTTP server, reporting false if the
+// listener is closed
+func (l *httpListener) inject(conn net.Conn) bool {
+    select {
+    case l.conns <- conn:
+        return true
+    case <-l.closed:
+        conn.Close()
+        return false
+    }
+}
+
+func (l *httpListener) Accept() (net.Conn, error) {
+    select {
+    case conn := <-l.conns:
+        return conn, nil
+    case err := <-l.errs:
+        l.Close()
+        return nil, err
+    case <-l.closed:
+        return nil, net.ErrClosed
+    }
+}
+
+func (l *httpListener) Close() error {
+    l.closeOnce.Do(func() {
+        close(l.closed)
+    })
+    return l.Listener.Close()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// httpCredentials are the credentials guarding an HTTP tunnel, kept as
+// SHA-256 hashes so the plain values do not stay in relay memory
+type httpCredentials struct {
+    basicAuth   [][sha256.Size]byte // hashes of "user:password"
+    bearerToken *[sha256.Size]byte
+}
+
+// newHTTPCredentials hashes the credentials of a registration request
+func newHTTPCredentials(req protocol.RegistrationRequest) (httpCredentials, error) {
+    var creds httpCredentials
+    for _, entry := range req.BasicAuth {
+        user, password, ok := strings.Cut(entry, ":")
+        if !ok || user == "" || password == "" {
+            return creds, fmt.Errorf("invalid basic auth entry, expected user:password")
+        }
+        creds.basicAuth = append(creds.basicAuth, sha256.Sum256([]byte(entry)))
+    }
+    if req.BearerToken != "" {
+        hash := sha256.Sum256([]byte(req.BearerToken))
+        creds.bearerToken = &hash
+    }
+    return creds, nil
+}
+
+// enabled reports whether any credentials are required
+func (c httpCredentials) enabled() bool {
+    return len(c.basicAuth) > 0 || c.bearerToken != nil
+}
+
+// authorize checks the Authorization header of r, answering 401 itself if
+// the request may not pass. The header is removed from passing requests so
+// the relay credentials never reach the local service.
+func (c httpCredentials) authorize(port int, w http.ResponseWriter, r *http.Request) bool {
+    if !c.enabled() {
+        return true
+    }
+
+    if user, password, ok := r.BasicAuth(); ok {
+        hash := sha256.Sum256([]byte(user + ":" + password))
+        for _, expected := range c.basicAuth {
+            if subtle.ConstantTimeCompare(hash[:], expected[:]) == 1 {
+                r.Header.Del("Authorization")
+                return true
+            }
+        }
+    } else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && c.bearerToken != nil {
+        hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+        if subtle.ConstantTimeCompare(hash[:], c.bearerToken[:]) == 1 {
+            r.Header.Del("Authorization")
+            return true
+        }
+    }
+
+    if r.Header.Get("Authorization") != "" {
+        log.Printf("Rejected user %s on port %d: invalid credentials", r.RemoteAddr, port)
+    }
+
+    if len(c.basicAuth) > 0 {
+        w.Header().Add("WWW-Authenticate", `Basic realm="tun", charset="UTF-8"`)
+    }
+    if c.bearerToken != nil {
+        w.Header().Add("WWW-Authenticate", `Bearer realm="tun"`)
+    }
+    http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    return false
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/audit"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// limiterIdleTimeout is how long a source IP's rate limiter is kept after
+// its bucket has refilled
+const limiterIdleTimeout = time.Minute
+
+// Limits caps what public users can do to a tunnel. Zero means unlimited.
+type Limits struct {
+    MaxConns    int     // concurrent user connections per tunnel
+    ConnRate    float64 // new connections per second per source IP and tunnel
+    RequestRate float64 // requests per second per HTTP tunnel
+
+    // Bandwidth per tunnel in bytes per second, inbound is from users
+    // towards the client and outbound from the client towards users
+    InboundRate  int64
+    OutboundRate int64
+}
+
+// SetLimits sets limits enforced on every tunnel. Clients can register
+// tighter limits for their own tunnel but not looser ones. Must be called
+// before Start.
+func (s *RelayServer) SetLimits(limits Limits) error {
+    if limits.MaxConns < 0 || limits.ConnRate < 0 || limits.RequestRate < 0 ||
+        limits.InboundRate < 0 || limits.OutboundRate < 0 {
+        return fmt.Errorf("limits must not be negative")
+    }
+    s.limits = limits
+    return nil
+}
+
+// tunnelLimits combines the relay limits with those a client registered
+func (s *RelayServer) tunnelLimits(req protocol.RegistrationRequest) (Limits, error) {
+    if req.MaxConns < 0 || req.ConnRate < 0 || req.RequestRate < 0 ||
+        req.InboundRate < 0 || req.OutboundRate < 0 {
+        return Limits{}, fmt.Errorf("limits must not be negative")
+    }
+    if req.RequestRate > 0 && req.Protocol != protocol.ProtocolHTTP {
+        return Limits{}, fmt.Errorf("request rate limits are only supported for HTTP tunnels")
+    }
+
+    return Limits{
+        MaxConns:    int(tighter(float64(s.limits.MaxConns), float64(req.MaxConns))),
+        ConnRate:    tighter(s.limits.ConnRate, req.ConnRate),
+        RequestRate: tighter(s.limits.RequestRate, req.RequestRate),
+
+        InboundRate:  int64(tighter(float64(s.limits.InboundRate), float64(req.InboundRate))),
+        OutboundRate: int64(tighter(float64(s.limits.OutboundRate), float64(req.OutboundRate))),
+    }, nil
+}
+
+// tighter returns the smaller of two limits where zero means unlimited
+func tighter(a, b float64) float64 {
+    if a == 0 || (b != 0 && b < a) {
+        return b
+    }
+    return a
+}
+
+// tokenBucket allows rate events per second with bursts of up to burst
+type tokenBucket struct {
+    rate   float64
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+// newTokenBucket starts a full bucket. The burst is one second worth of
+// events so short spikes like a browser opening a page are not penalized.
+func newTokenBucket(rate float64) *tokenBucket {
+    burst := math.Max(1, math.Ceil(rate))
+    return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow takes a token if one is available. Callers serialize access.
+func (b *tokenBucket) allow(now time.Time) bool {
+    b.refill(now)
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long
+// to wait until the debt is paid off. Callers serialize access.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+    b.refill(now)
+    b.tokens -= n
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last call. Callers may read the
+// clock before the bucket was made, so time going backwards adds nothing.
+func (b *tokenBucket) refill(now time.Time) {
+    if elapsed := now.Sub(b.last); elapsed > 0 {
+        b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+        b.last = now
+    }
+}
+
+// full reports whether the bucket would be back at its burst size by now
+func (b *tokenBucket) full(now time.Time) bool {
+    return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// tunnelLimiter enforces the limits of one tunnel
+type tunnelLimiter struct {
+    limits      Limits
+    activeConns atomic.Int64
+
+    mutex        sync.Mutex
+    sources      map[string]*tokenBucket // keyed by source IP
+    lastSweep    time.Time
+    requestLimit *tokenBucket
+}
+
+func newTunnelLimiter(limits Limits) *tunnelLimiter {
+    l := &tunnelLimiter{
+        limits:    limits,
+        sources:   make(map[string]*tokenBucket),
+        lastSweep: time.Now(),
+    }
+    if limits.RequestRate > 0 {
+        l.requestLimit = newTokenBucket(limits.RequestRate)
+    }
+    return l
+}
+
+// allowSource reports whether ip may open another connection now
+func (l *tunnelLimiter) allowSource(ip string) bool {
+    if l.limits.ConnRate == 0 {
+        return true
+    }
+
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    now := time.Now()
+    // Forget sources that have been quiet so scanners don't grow the map forever
+    if now.Sub(l.lastSweep) > limiterIdleTimeout {
+        for source, bucket := range l.sources {
+            if bucket.full(now.Add(-limiterIdleTimeout)) {
+                delete(l.sources, source)
+            }
+        }
+        l.lastSweep = now
+    }
+
+    bucket, exists := l.sources[ip]
+    if !exists {
+        bucket = newTokenBucket(l.limits.ConnRate)
+        l.sources[ip] = bucket
+    }
+    return bucket.allow(now)
+}
+
+// acquireConn takes a connection slot, reporting false if the tunnel is full
+func (l *tunnelLimiter) acquireConn() bool {
+    if l.activeConns.Add(1) > int64(l.limits.MaxConns) && l.limits.MaxConns > 0 {
+        l.activeConns.Add(-1)
+        return false
+    }
+    return true
+}
+
+// allowRequest reports whether an HTTP request may go through now
+func (l *tunnelLimiter) allowRequest() bool {
+    if l.requestLimit == nil {
+        return true
+    }
+
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    return l.requestLimit.allow(time.Now())
+}
+
+// Reasons admitSource turns a user away for
+var (
+    errSourceDenied = errors.New("source not allowed")
+    errConnRate     = errors.New("connection rate exceeded")
+    errConnCap      = errors.New("connection limit reached")
+)
+
+// admitUser decides whether a new user connection may reach a tunnel. It
+// returns the connection wrapped so that closing it frees its slot.
+func (s *RelayServer) admitUser(port int, client *clientConnection, conn net.Conn, userAddr string) (net.Conn, bool) {
+    release, err := s.admitSource(port, client, userAddr)
+    if err != nil {
+        return nil, false
+    }
+    return &limitedConn{Conn: conn, release: release}, true
+}
+
+// admitSource applies the source lists, the connection rate and the
+// connection cap of a tunnel to a user at userAddr. The returned release
+// frees the connection slot the user takes.
+func (s *RelayServer) admitSource(port int, client *clientConnection, userAddr string) (release func(), err error) {
+    if !s.permitsSource(port, client, userAddr) {
+        client.stats.rejectedSource.Add(1)
+        return nil, errSourceDenied
+    }
+
+    host, _, err := net.SplitHostPort(userAddr)
+    if err != nil {
+        host = userAddr
+    }
+    if !client.limiter.allowSource(host) {
+        client.stats.rejectedRate.Add(1)
+        log.Printf("Rejected user %s on port %d: connection rate exceeded", userAddr, port)
+        s.auditUser(audit.UserRejected, port, client, userAddr, "connection rate exceeded")
+        return nil, errConnRate
+    }
+    if !client.limiter.acquireConn() {
+        client.stats.rejectedCap.Add(1)
+        log.Printf("Rejected user %s on port %d: connection limit reached", userAddr, port)
+        s.auditUser(audit.UserRejected, port, client, userAddr, "connection limit reached")
+        return nil, errConnCap
+    }
+
+    client.stats.acceptedConns.Add(1)
+    return func() {
+        client.limiter.activeConns.Add(-1)
+    }, nil
+}
+
+// allowHTTPRequest applies the request rate limit of an HTTP tunnel,
+// answering 429 when it is exceeded
+func (s *RelayServer) allowHTTPRequest(port int, client *clientConnection, w http.ResponseWriter, r *http.Request) bool {
+    if client.limiter.allowRequest() {
+        return true
+    }
+
+    client.stats.rejectedRequests.Add(1)
+    log.Printf("Rejected request from %s on port %d: request rate exceeded", r.RemoteAddr, port)
+    s.auditUser(audit.RequestRejected, port, client, r.RemoteAddr, "request rate exceeded")
+    w.Header().Set("Retry-After", "1")
+    http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+    return false
+}
+
+// limitedConn frees its tunnel connection slot when closed
+type limitedConn struct {
+    net.Conn
+    releaseOnce sync.Once
+    release     func()
+}
+
+func (c *limitedConn) Close() error {
+    c.releaseOnce.Do(c.release)
+    return c.Conn.Close()
+}
+
+// NetConn returns the connection being limited
+func (c *limitedConn) NetConn() net.Conn {
+    return c.Conn
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+
+    "github.com/euphoricair7/tun/internal/noiseconn"
+)
+
+// SetNoiseAddr accepts control connections encrypted with Noise on addr,
+// in addition to the raw TCP registration port. Clients must be given the
+// public half of key. Must be called before Start.
+func (s *RelayServer) SetNoiseAddr(addr string, key noiseconn.Key) {
+    s.noiseAddr = addr
+    s.noiseKey = key
+}
+
+// startNoise starts accepting Noise control connections
+func (s *RelayServer) startNoise() error {
+    listener, err := net.Listen("tcp", s.noiseAddr)
+    if err != nil {
+        return fmt.Errorf("failed to start Noise listener: %w", err)
+    }
+    s.noiseListener = listener
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                if !errors.Is(err, net.ErrClosed) {
+                    log.Printf("Noise listener on %s stopped: %v", s.noiseAddr, err)
+                }
+                return
+            }
+            go func() {
+                noiseConn, err := noiseconn.Server(conn, s.noiseKey)
+                if err != nil {
+                    log.Printf("Rejected Noise connection from %s: %v", conn.RemoteAddr(), err)
+                    conn.Close()
+                    return
+                }
+                s.handleClientRegistration(noiseConn)
+            }()
+        }
+    }()
+
+    log.Printf("Accepting Noise control connections on %s with public key %s", s.noiseAddr, s.noiseKey.PublicString())
+    return nil
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/audit"
+    "github.com/euphoricair7/tun/internal/oidc"
+)
+
+const (
+    oidcCookiePrefix = "tun_"
+    oidcSecurePrefix = "__Host-" // cookies browsers only accept over TLS, for the exact host
+    oidcCallbackPath = "/.tun/oidc/callback"
+    oidcStateTTL     = 10 * time.Minute
+    oidcSessionTTL   = 12 * time.Hour
+)
+
+// oidcGate requires users of HTTP tunnels to log in with an OIDC provider
+type oidcGate struct {
+    provider *oidc.Provider
+    key      []byte // signs session and login state cookies
+}
+
+// oidcSession is the content of a session cookie. It is bound to the
+// tunnel's hostname, the only place it is set and accepted.
+type oidcSession struct {
+    Email    string `json:"email"`
+    Hostname string `json:"host"`
+    Port     int    `json:"port"`
+    Expiry   int64  `json:"exp"`
+}
+
+// oidcLoginState is the content of the cookie tying a callback to the login
+// that started it
+type oidcLoginState struct {
+    State    string `json:"state"`
+    Nonce    string `json:"nonce"`
+    Hostname string `json:"host"`
+    Port     int    `json:"port"`
+    Return   string `json:"return"`
+    Expiry   int64  `json:"exp"`
+}
+
+// EnableOIDC lets clients require their HTTP tunnel users to log in with
+// provider. sessionKey signs the session cookies and must be shared by all
+// relays of a cluster, an empty key picks a random one so sessions end when
+// the relay restarts. Must be called before Start.
+func (s *RelayServer) EnableOIDC(provider *oidc.Provider, sessionKey []byte) error {
+    if len(sessionKey) == 0 {
+        sessionKey = make([]byte, 32)
+        if _, err := rand.Read(sessionKey); err != nil {
+            return fmt.Errorf("failed to generate session key: %w", err)
+        }
+    }
+
+    s.oidc = &oidcGate{
+        provider: provider,
+        key:      sessionKey,
+    }
+    if !s.publicHTTPS() {
+        log.Println("OIDC sessions travel over plain HTTP, set a https:// public HTTP URL to keep them from other tunnels on the relay's address")
+    }
+    return nil
+}
+
+// authorizeOIDC lets requests with a valid session for an allowed user
+// through and sends everyone else to log in. It reports whether the request
+// should be passed on to the tunnel. Sessions live on the tunnel's own
+// hostname, browsers would hand cookies of the relay host to every tunnel
+// port on it, raw TCP ones included.
+func (s *RelayServer) authorizeOIDC(port int, client *clientConnection, w http.ResponseWriter, r *http.Request) bool {
+    if len(client.oidcAllow) == 0 {
+        return true
+    }
+
+    if via, _ := r.Context().Value(viaHostnameContextKey{}).(bool); !via {
+        http.Redirect(w, r, s.tunnelURL(client.hostname)+r.URL.RequestURI(), http.StatusFound)
+        return false
+    }
+
+    if r.URL.Path == oidcCallbackPath {
+        s.handleOIDCCallback(port, client, w, r)
+        return false
+    }
+
+    if cookie, err := r.Cookie(s.oidcCookieName("session")); err == nil {
+        var session oidcSession
+        if err := s.oidc.verify(cookie.Value, &session); err == nil &&
+            session.Hostname == client.hostname && session.Port == port &&
+            time.Now().Unix() < session.Expiry && emailAllowed(client.oidcAllow, session.Email) {
+            return true
+        }
+    }
+
+    // Start a login, remembering where the user wanted to go
+    loginState := oidcLoginState{
+        State:    randomToken(),
+        Nonce:    randomToken(),
+        Hostname: client.hostname,
+        Port:     port,
+        Return:   r.URL.RequestURI(),
+        Expiry:   time.Now().Add(oidcStateTTL).Unix(),
+    }
+    value, err := s.oidc.sign(loginState)
+    if err != nil {
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return false
+    }
+
+    http.SetCookie(w, &http.Cookie{
+        Name:     s.oidcCookieName("oidc_state"),
+        Value:    value,
+        Path:     "/",
+        MaxAge:   int(oidcStateTTL.Seconds()),
+        HttpOnly: true,
+        Secure:   s.publicHTTPS(),
+        SameSite: http.SameSiteLaxMode,
+    })
+    http.Redirect(w, r, s.oidc.provider.AuthCodeURL(loginState.State, loginState.Nonce, s.callbackURL(client)), http.StatusFound)
+    return false
+}
+
+// handleOIDCCallback completes a login and sets the session cookie
+func (s *RelayServer) handleOIDCCallback(port int, client *clientConnection, w http.ResponseWriter, r *http.Request) {
+    stateCookie := s.oidcCookieName("oidc_state")
+    cookie, err := r.Cookie(stateCookie)
+    if err != nil {
+        http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+        return
+    }
+
+    var loginState oidcLoginState
+    if err := s.oidc.verify(cookie.Value, &loginState); err != nil ||
+        loginState.Hostname != client.hostname || loginState.Port != port ||
+        time.Now().Unix() >= loginState.Expiry ||
+        !hmac.Equal([]byte(r.URL.Query().Get("state")), []byte(loginState.State)) {
+        http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+        return
+    }
+
+    // Single use
+    http.SetCookie(w, &http.Cookie{Name: stateCookie, Value: "", Path: "/", MaxAge: -1, Secure: s.publicHTTPS()})
+
+    if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+        log.Printf("OIDC login for port %d failed at provider: %s", port, errMsg)
+        s.auditUser(audit.AuthFailed, port, client, r.RemoteAddr, "OIDC provider error: "+errMsg)
+        http.Error(w, "Login failed", http.StatusForbidden)
+        return
+    }
+
+    claims, err := s.oidc.provider.Exchange(r.Context(), r.URL.Query().Get("code"), s.callbackURL(client))
+    if err != nil {
+        log.Printf("OIDC login for port %d failed: %v", port, err)
+        s.auditUser(audit.AuthFailed, port, client, r.RemoteAddr, "OIDC login failed: "+err.Error())
+        http.Error(w, "Login failed", http.StatusForbidden)
+        return
+    }
+    if claims.Nonce != loginState.Nonce {
+        log.Printf("OIDC login for port %d failed: nonce mismatch", port)
+        s.auditUser(audit.AuthFailed, port, client, r.RemoteAddr, "OIDC nonce mismatch")
+        http.Error(w, "Login failed", http.StatusForbidden)
+        return
+    }
+
+    email := strings.ToLower(claims.Email)
+    if email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified) || !emailAllowed(client.oidcAllow, email) {
+        log.Printf("Rejected user %s on port %d: %q is not allowed", r.RemoteAddr, port, email)
+        s.auditUser(audit.AuthFailed, port, client, r.RemoteAddr, fmt.Sprintf("%q is not allowed", email))
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+
+    session := oidcSession{
+        Email:    email,
+        Hostname: client.hostname,
+        Port:     port,
+        Expiry:   time.Now().Add(oidcSessionTTL).Unix(),
+    }
+    value, err := s.oidc.sign(session)
+    if err != nil {
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+
+    http.SetCookie(w, &http.Cookie{
+        Name:     s.oidcCookieName("session"),
+        Value:    value,
+        Path:     "/",
+        MaxAge:   int(oidcSessionTTL.Seconds()),
+        HttpOnly: true,
+        Secure:   s.publicHTTPS(),
+        SameSite: http.SameSiteLaxMode,
+    })
+
+    log.Printf("User %s logged in to port %d as %s", r.RemoteAddr, port, email)
+
+    // Only redirect within the tunnel
+    target := loginState.Return
+    if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+        target = "/"
+    }
+    http.Redirect(w, r, target, http.StatusFound)
+}
+
+// sign encodes v as a cookie value with an HMAC
+func (g *oidcGate) sign(v interface{}) (string, error) {
+    payload, err := json.Marshal(v)
+    if err != nil {
+        return "", err
+    }
+
+    mac := hmac.New(sha256.New, g.key)
+    mac.Write(payload)
+    return base64.RawURLEncoding.EncodeToString(payload) + "." +
+        base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify checks the HMAC of a cookie value and decodes it into v
+func (g *oidcGate) verify(value string, v interface{}) error {
+    encodedPayload, encodedMAC, ok := strings.Cut(value, ".")
+    if !ok {
+        return errors.New("malformed cookie")
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+    if err != nil {
+        return errors.New("malformed cookie")
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+    if err != nil {
+        return errors.New("malformed cookie")
+    }
+
+    mac := hmac.New(sha256.New, g.key)
+    mac.Write(payload)
+    if !hmac.Equal(signature, mac.Sum(nil)) {
+        return errors.New("invalid cookie signature")
+    }
+    return json.Unmarshal(payload, v)
+}
+
+// emailAllowed matches an email against entries that are either complete
+// addresses or "@domain"
+func emailAllowed(allow []string, email string) bool {
+    email = strings.ToLower(email)
+    for _, entry := range allow {
+        entry = strings.ToLower(strings.TrimSpace(entry))
+        switch {
+        case strings.HasPrefix(entry, "@"):
+            if strings.HasSuffix(email, entry) {
+                return true
+            }
+        case email == entry:
+            return true
+        }
+    }
+    return false
+}
+
+// callbackURL is where the provider sends users back to, on the tunnel's
+// public URL so the cookies end up in the right place. It never depends on
+// the request, whose Host the user controls.
+func (s *RelayServer) callbackURL(client *clientConnection) string {
+    return s.tunnelURL(client.hostname) + oidcCallbackPath
+}
+
+// oidcCookieName names one of the relay's cookies. Over TLS they get the
+// __Host- prefix, so browsers keep them to the exact tunnel hostname and
+// never send them over plain connections such as raw TCP tunnels.
+func (s *RelayServer) oidcCookieName(name string) string {
+    if s.publicHTTPS() {
+        return oidcSecurePrefix + oidcCookiePrefix + name
+    }
+    return oidcCookiePrefix + name
+}
+
+// removeRelayCookies drops the relay's cookies from a request, the local
+// service has no business seeing its users' sessions
+func removeRelayCookies(r *http.Request) {
+    cookies := r.Cookies()
+    r.Header.Del("Cookie")
+    for _, cookie := range cookies {
+        name := strings.TrimPrefix(cookie.Name, oidcSecurePrefix)
+        if !strings.HasPrefix(name, oidcCookiePrefix) {
+            r.AddCookie(cookie)
+        }
+    }
+}
+
+// randomToken returns a random hex string for OIDC state and nonce values
+func randomToken() string {
+    buf := make([]byte, 16)
+    rand.Read(buf)
+    return hex.EncodeToString(buf)
+}
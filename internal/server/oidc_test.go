@@ -0,0 +1,334 @@
+package server
+
+import (
+    "context"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/oidc"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+const (
+    testOIDCClientID = "relay"
+    testHostname     = "app.test"
+)
+
+// mockIdP is an OIDC provider issuing ID tokens for codes the test handed
+// out with authorize
+type mockIdP struct {
+    *httptest.Server
+    key *rsa.PrivateKey
+
+    mutex        sync.Mutex
+    codes        map[string]map[string]any // claims by code
+    redirectURIs []string                  // redirect_uri of every token request
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+    t.Helper()
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp := &mockIdP{key: key, codes: make(map[string]map[string]any)}
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]string{
+            "issuer":                 idp.URL,
+            "authorization_endpoint": idp.URL + "/authorize",
+            "token_endpoint":         idp.URL + "/token",
+            "jwks_uri":               idp.URL + "/jwks",
+        })
+    })
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]any{
+            "keys": []map[string]string{{
+                "kty": "RSA",
+                "kid": "test",
+                "use": "sig",
+                "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+                "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+            }},
+        })
+    })
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        if user, _, _ := r.BasicAuth(); user != testOIDCClientID {
+            http.Error(w, "unknown client", http.StatusUnauthorized)
+            return
+        }
+        idp.mutex.Lock()
+        claims, exists := idp.codes[r.FormValue("code")]
+        delete(idp.codes, r.FormValue("code"))
+        idp.redirectURIs = append(idp.redirectURIs, r.FormValue("redirect_uri"))
+        idp.mutex.Unlock()
+        if !exists {
+            http.Error(w, "invalid code", http.StatusBadRequest)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, claims)})
+    })
+    idp.Server = httptest.NewServer(mux)
+    t.Cleanup(idp.Close)
+    return idp
+}
+
+// authorize logs email in for the login the relay redirected to, with an ID
+// token expiring after ttl, and returns the code the provider sends back
+func (idp *mockIdP) authorize(t *testing.T, authURL *url.URL, email string, ttl time.Duration) string {
+    t.Helper()
+    code := randomToken()
+    idp.mutex.Lock()
+    idp.codes[code] = map[string]any{
+        "iss":            idp.URL,
+        "sub":            email,
+        "aud":            testOIDCClientID,
+        "exp":            time.Now().Add(ttl).Unix(),
+        "nonce":          authURL.Query().Get("nonce"),
+        "email":          email,
+        "email_verified": true,
+    }
+    idp.mutex.Unlock()
+    return code
+}
+
+// sign returns claims as an RS256 ID token
+func (idp *mockIdP) sign(t *testing.T, claims map[string]any) string {
+    header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+    payload, _ := json.Marshal(claims)
+    signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+    digest := sha256.Sum256([]byte(signed))
+    signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+    if err != nil {
+        t.Error(err)
+    }
+    return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// oidcRelay is a relay gating an HTTP tunnel on testHostname with OIDC
+type oidcRelay struct {
+    *RelayServer
+    idp      *mockIdP
+    client   *testClient
+    httpAddr string
+}
+
+func startOIDCRelay(t *testing.T) *oidcRelay {
+    t.Helper()
+    idp := newMockIdP(t)
+    provider, err := oidc.NewProvider(context.Background(), idp.URL, testOIDCClientID, "secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    httpAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+    s := startRelay(t, freePort(t), func(s *RelayServer) {
+        s.SetHTTPAddr(httpAddr)
+        if err := s.SetHTTPPublicURL("https://"); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.EnableOIDC(provider, []byte("session key")); err != nil {
+            t.Fatal(err)
+        }
+    })
+    client := mustRegister(t, s, protocol.RegistrationRequest{
+        Protocol:  protocol.ProtocolHTTP,
+        Hostname:  testHostname,
+        OIDCAllow: []string{"@example.com"},
+    })
+    return &oidcRelay{RelayServer: s, idp: idp, client: client, httpAddr: httpAddr}
+}
+
+// get requests path from the tunnel's hostname without following redirects
+func (r *oidcRelay) get(t *testing.T, path string, cookies ...*http.Cookie) *http.Response {
+    t.Helper()
+    req, err := http.NewRequest(http.MethodGet, "http://"+r.httpAddr+path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Host = testHostname
+    for _, cookie := range cookies {
+        req.AddCookie(cookie)
+    }
+    client := &http.Client{
+        Timeout: 5 * time.Second,
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    return resp
+}
+
+// startLogin requests a gated page and returns where the relay sent the
+// user to log in along with the login state cookie
+func (r *oidcRelay) startLogin(t *testing.T, path string) (*url.URL, *http.Cookie) {
+    t.Helper()
+    resp := r.get(t, path)
+    if resp.StatusCode != http.StatusFound {
+        t.Fatalf("gated request answered %s, want a redirect to log in", resp.Status)
+    }
+    authURL, err := url.Parse(resp.Header.Get("Location"))
+    if err != nil || !strings.HasPrefix(authURL.String(), r.idp.URL+"/authorize") {
+        t.Fatalf("redirected to %q, want the provider", resp.Header.Get("Location"))
+    }
+    state := findCookie(resp, "__Host-tun_oidc_state")
+    if state == nil || !state.Secure || !state.HttpOnly {
+        t.Fatalf("login state cookie %+v must be a secure __Host- cookie", state)
+    }
+    return authURL, state
+}
+
+// findCookie returns the cookie named name a response sets
+func findCookie(resp *http.Response, name string) *http.Cookie {
+    for _, cookie := range resp.Cookies() {
+        if cookie.Name == name {
+            return cookie
+        }
+    }
+    return nil
+}
+
+func TestOIDCLogin(t *testing.T) {
+    r := startOIDCRelay(t)
+    authURL, state := r.startLogin(t, "/private?page=1")
+
+    wantCallback := "https://" + testHostname + oidcCallbackPath
+    if got := authURL.Query().Get("redirect_uri"); got != wantCallback {
+        t.Errorf("redirect_uri = %q, want %q", got, wantCallback)
+    }
+
+    code := r.idp.authorize(t, authURL, "alice@example.com", time.Hour)
+    resp := r.get(t, oidcCallbackPath+"?code="+code+"&state="+authURL.Query().Get("state"), state)
+    if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/private?page=1" {
+        t.Fatalf("callback answered %s to %q, want a redirect back to /private?page=1", resp.Status, resp.Header.Get("Location"))
+    }
+    if got := r.idp.redirectURIs; len(got) != 1 || got[0] != wantCallback {
+        t.Errorf("token requests used redirect_uri %q, want %q", got, wantCallback)
+    }
+    session := findCookie(resp, "__Host-tun_session")
+    if session == nil || !session.Secure || !session.HttpOnly || session.Path != "/" || session.Domain != "" {
+        t.Fatalf("session cookie %+v must be a secure host-only __Host- cookie", session)
+    }
+
+    // With the session the request reaches the client, without the relay's
+    // cookies
+    answered := make(chan *http.Response, 1)
+    go func() { answered <- r.get(t, "/private", session, &http.Cookie{Name: "app", Value: "kept"}) }()
+    connect := r.client.next(protocol.MessageTypeConnect)
+    request := r.client.next(protocol.MessageTypeData)
+    if !strings.HasPrefix(string(request.Data), "GET /private ") {
+        t.Errorf("client got %q, want the request", request.Data)
+    }
+    if strings.Contains(string(request.Data), "tun_") || !strings.Contains(string(request.Data), "app=kept") {
+        t.Errorf("client got cookies %q, want only the service's own", request.Data)
+    }
+    r.client.send(protocol.ClientMessage{
+        Type:   protocol.MessageTypeData,
+        UserID: connect.UserID,
+        Data:   []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"),
+    })
+    r.client.send(protocol.ClientMessage{Type: protocol.MessageTypeDisconnect, UserID: connect.UserID})
+    if resp := <-answered; resp.StatusCode != http.StatusOK {
+        t.Errorf("logged in request answered %s", resp.Status)
+    }
+}
+
+func TestOIDCCallbackRejectsBadState(t *testing.T) {
+    r := startOIDCRelay(t)
+    authURL, state := r.startLogin(t, "/")
+    code := r.idp.authorize(t, authURL, "alice@example.com", time.Hour)
+
+    if resp := r.get(t, oidcCallbackPath+"?code="+code+"&state=forged", state); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("callback with a forged state answered %s", resp.Status)
+    }
+    if resp := r.get(t, oidcCallbackPath+"?code="+code+"&state="+authURL.Query().Get("state")); resp.StatusCode != http.StatusBadRequest {
+        t.Errorf("callback without the state cookie answered %s", resp.Status)
+    }
+    if len(r.idp.redirectURIs) != 0 {
+        t.Error("relay redeemed the code of a login it can't tie to the user")
+    }
+}
+
+func TestOIDCCallbackRejectsExpiredToken(t *testing.T) {
+    r := startOIDCRelay(t)
+    authURL, state := r.startLogin(t, "/")
+    code := r.idp.authorize(t, authURL, "alice@example.com", -time.Hour)
+
+    resp := r.get(t, oidcCallbackPath+"?code="+code+"&state="+authURL.Query().Get("state"), state)
+    if resp.StatusCode != http.StatusForbidden || findCookie(resp, "__Host-tun_session") != nil {
+        t.Errorf("callback with an expired ID token answered %s", resp.Status)
+    }
+}
+
+func TestOIDCRejectsForeignSessions(t *testing.T) {
+    r := startOIDCRelay(t)
+    port := r.client.resp.PublicPort
+
+    sessions := map[string]oidcSession{
+        "expired":         {Email: "alice@example.com", Hostname: testHostname, Port: port, Expiry: time.Now().Add(-time.Minute).Unix()},
+        "other hostname":  {Email: "alice@example.com", Hostname: "other.test", Port: port, Expiry: time.Now().Add(time.Hour).Unix()},
+        "not allowed":     {Email: "mallory@evil.test", Hostname: testHostname, Port: port, Expiry: time.Now().Add(time.Hour).Unix()},
+        "other tunnel id": {Email: "alice@example.com", Hostname: testHostname, Port: port + 1, Expiry: time.Now().Add(time.Hour).Unix()},
+    }
+    for name, session := range sessions {
+        value, err := r.oidc.sign(session)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp := r.get(t, "/", &http.Cookie{Name: "__Host-tun_session", Value: value})
+        if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), r.idp.URL) {
+            t.Errorf("%s session answered %s, want a redirect to log in", name, resp.Status)
+        }
+    }
+}
+
+func TestOIDCStaysOnTunnelHostname(t *testing.T) {
+    r := startOIDCRelay(t)
+
+    // The tunnel's own port shares its cookies with every port of the
+    // relay, so users are sent to the hostname
+    req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/private", r.client.resp.PublicPort), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp, err := http.DefaultTransport.RoundTrip(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://"+testHostname+"/private" {
+        t.Errorf("request on the tunnel port answered %s to %q", resp.Status, resp.Header.Get("Location"))
+    }
+    if len(resp.Cookies()) != 0 {
+        t.Error("relay set cookies on its own host")
+    }
+
+    // Tunnels without a hostname can't be gated
+    c := register(t, r.RelayServer, protocol.RegistrationRequest{
+        Protocol:  protocol.ProtocolHTTP,
+        OIDCAllow: []string{"@example.com"},
+    })
+    if c.resp.Success {
+        t.Error("relay gated a tunnel without a hostname")
+    }
+}
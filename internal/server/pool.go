@@ -0,0 +1,326 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "fmt"
+    "log"
+    "math/rand/v2"
+    "net"
+    "strconv"
+    "sync"
+
+    "github.com/euphoricair7/tun/internal/audit"
+    "github.com/euphoricair7/tun/internal/frame"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// poolKey names a pool, pools of different accounts never mix
+type poolKey struct {
+    account string // empty on relays without accounts
+    name    string
+}
+
+// poolKeyFor returns the key of the pool a registration of acct names
+func poolKeyFor(acct *account, name string) poolKey {
+    if acct == nil {
+        return poolKey{name: name}
+    }
+    return poolKey{account: acct.Name, name: name}
+}
+
+// clientPool is the set of clients serving one pooled tunnel. The tunnel
+// itself, its port, listener and options, belongs to the client that created
+// the pool and outlives it as long as other members are left.
+type clientPool struct {
+    key        poolKey
+    name       string
+    balance    string
+    secretHash [sha256.Size]byte // of the PoolSecret of the creator
+    mutex      sync.Mutex
+    members    []*clientConnection
+    next       int  // where round robin continues
+    closed     bool // the last member left or the tunnel was cleaned up
+
+    suspendOnce sync.Once
+}
+
+func newClientPool(key poolKey, req protocol.RegistrationRequest, creator *clientConnection) *clientPool {
+    balance := req.Balance
+    if balance == "" {
+        balance = protocol.BalanceRoundRobin
+    }
+    return &clientPool{
+        key:        key,
+        name:       key.name,
+        balance:    balance,
+        secretHash: sha256.Sum256([]byte(req.PoolSecret)),
+        members:    []*clientConnection{creator},
+    }
+}
+
+// validatePoolSecret checks that a pooled registration carries a secret on
+// relays without accounts, where nothing else tells clients apart
+func validatePoolSecret(acct *account, req protocol.RegistrationRequest) error {
+    if req.Pool != "" && acct == nil && req.PoolSecret == "" {
+        return fmt.Errorf("pools on this relay need a pool secret")
+    }
+    return nil
+}
+
+// admits reports whether secret is the one the pool was created with
+func (p *clientPool) admits(secret string) bool {
+    hash := sha256.Sum256([]byte(secret))
+    return hmac.Equal(hash[:], p.secretHash[:])
+}
+
+// validateBalance checks the balancing strategy a registration asks for
+func validateBalance(req protocol.RegistrationRequest) error {
+    switch req.Balance {
+    case "", protocol.BalanceRoundRobin, protocol.BalanceLeastConn, protocol.BalanceRandom:
+    default:
+        return fmt.Errorf("unknown balancing strategy %q", req.Balance)
+    }
+    if req.Balance != "" && req.Pool == "" {
+        return fmt.Errorf("balancing needs a pool")
+    }
+    return nil
+}
+
+// pick returns the healthy member the next user goes to, nil if none is
+// left
+func (p *clientPool) pick() *clientConnection {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    var healthy []*clientConnection
+    for i := range p.members {
+        member := p.members[(p.next+i)%len(p.members)]
+        if member.healthy() {
+            healthy = append(healthy, member)
+        }
+    }
+    if len(healthy) == 0 {
+        return nil
+    }
+    p.next++
+
+    switch p.balance {
+    case protocol.BalanceRandom:
+        return healthy[rand.IntN(len(healthy))]
+
+    case protocol.BalanceLeastConn:
+        // Ties go round robin so idle members share the first users
+        best, bestLoad := healthy[0], healthy[0].load()
+        for _, member := range healthy[1:] {
+            if load := member.load(); load < bestLoad {
+                best, bestLoad = member, load
+            }
+        }
+        return best
+
+    default:
+        return healthy[0]
+    }
+}
+
+// add makes client a member, reporting false if the pool closed meanwhile
+func (p *clientPool) add(client *clientConnection) bool {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    if p.closed {
+        return false
+    }
+    p.members = append(p.members, client)
+    return true
+}
+
+// remove takes client out of the pool and returns how many members are
+// left. The pool closes with its last member. ok is false if client was no
+// member.
+func (p *clientPool) remove(client *clientConnection) (left int, ok bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    for i, member := range p.members {
+        if member == client {
+            p.members = append(p.members[:i:i], p.members[i+1:]...)
+            if len(p.members) == 0 {
+                p.closed = true
+            }
+            return len(p.members), true
+        }
+    }
+    return len(p.members), false
+}
+
+// close closes the pool and returns the members it had
+func (p *clientPool) close() []*clientConnection {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    p.closed = true
+    members := p.members
+    p.members = nil
+    return members
+}
+
+// size returns the number of members
+func (p *clientPool) size() int {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return len(p.members)
+}
+
+// members returns the clients carrying users for a tunnel, which is just
+// the client that registered it unless it is pooled
+func (c *clientConnection) members() []*clientConnection {
+    if c.pool == nil {
+        return []*clientConnection{c}
+    }
+    c.pool.mutex.Lock()
+    defer c.pool.mutex.Unlock()
+    return append([]*clientConnection(nil), c.pool.members...)
+}
+
+// load returns how many users a client is carrying
+func (c *clientConnection) load() int {
+    c.userConnMutex.RLock()
+    defer c.userConnMutex.RUnlock()
+    return len(c.userConns)
+}
+
+// closeUsers closes every user connection a client carries
+func (c *clientConnection) closeUsers() {
+    c.userConnMutex.Lock()
+    defer c.userConnMutex.Unlock()
+    for _, conn := range c.userConns {
+        conn.Close()
+    }
+}
+
+// joinPool adds a client to the pool its registration names if that pool
+// has a tunnel on this relay. It reports false if there is none, so the
+// client creates the tunnel instead.
+func (s *RelayServer) joinPool(conn net.Conn, acct *account, req protocol.RegistrationRequest, reject func(reason string)) bool {
+    s.clientsMutex.RLock()
+    port, exists := s.pools[poolKeyFor(acct, req.Pool)]
+    tunnel := s.clients[port]
+    s.clientsMutex.RUnlock()
+    if !exists || tunnel == nil {
+        return false
+    }
+
+    if err := checkPoolMember(port, tunnel, req); err != nil {
+        log.Printf("Rejected client %s: %v", conn.RemoteAddr(), err)
+        reject(err.Error())
+        return true
+    }
+    if err := s.checkRegistration(acct, req); err != nil {
+        log.Printf("Rejected client %s: %v", conn.RemoteAddr(), err)
+        reject(err.Error())
+        return true
+    }
+
+    // Users are admitted, shaped and counted by the tunnel, the member only
+    // carries them to its local service
+    member := &clientConnection{
+        conn:            conn,
+        frames:          frame.NewEncoder(conn),
+        userConns:       make(map[string]net.Conn),
+        sourceACL:       tunnel.sourceACL,
+        limiter:         tunnel.limiter,
+        stats:           tunnel.stats,
+        account:         acct,
+        identity:        tunnel.identity,
+        inboundLimiter:  tunnel.inboundLimiter,
+        outboundLimiter: tunnel.outboundLimiter,
+        protocol:        tunnel.protocol,
+        hostname:        tunnel.hostname,
+        pool:            tunnel.pool,
+
+        compression:          negotiateCompression(req),
+        compressionThreshold: req.CompressionThreshold,
+    }
+    if streams, ok := conn.(streamOpener); ok {
+        member.streams = streams
+    }
+
+    // Answer before the first user can be sent its way
+    resp := protocol.RegistrationResponse{
+        Success:     true,
+        PublicPort:  port,
+        Hostname:    tunnel.hostname,
+        Compression: member.compression,
+    }
+    if err := member.frames.Encode(resp); err != nil {
+        log.Printf("Error sending response to client %s: %v", conn.RemoteAddr(), err)
+        conn.Close()
+        s.releaseTunnel(acct)
+        return true
+    }
+    if !tunnel.pool.add(member) {
+        log.Printf("Pool %s closed while client %s joined it", req.Pool, conn.RemoteAddr())
+        conn.Close()
+        s.releaseTunnel(acct)
+        return true
+    }
+
+    log.Printf("Client %s joined pool %s on port %d, clients serving it: %d",
+        conn.RemoteAddr(), req.Pool, port, tunnel.pool.size())
+    s.audit.Log(audit.Event{
+        Type:     audit.RegistrationAccepted,
+        Identity: tunnel.identity,
+        SourceIP: clientIdentity(conn),
+        Port:     port,
+        Hostname: tunnel.hostname,
+        Pool:     req.Pool,
+        Protocol: req.Protocol,
+        Target:   net.JoinHostPort(req.LocalHost, strconv.Itoa(req.LocalPort)),
+    })
+
+    go s.handleClientCommunication(port, member)
+    return true
+}
+
+// checkPoolMember checks that a registration may join the pooled tunnel on
+// port and fits it
+func checkPoolMember(port int, tunnel *clientConnection, req protocol.RegistrationRequest) error {
+    switch {
+    case !tunnel.pool.admits(req.PoolSecret):
+        return fmt.Errorf("wrong secret for pool %s", req.Pool)
+    case req.Protocol != tunnel.protocol:
+        return fmt.Errorf("pool %s serves %s tunnels", req.Pool, tunnel.protocol)
+    case req.Port != 0 && req.Port != port:
+        return fmt.Errorf("pool %s is on port %d", req.Pool, port)
+    case req.Hostname != "" && req.Hostname != tunnel.hostname:
+        return fmt.Errorf("pool %s is not serving hostname %s", req.Pool, req.Hostname)
+    case req.Balance != "" && req.Balance != tunnel.pool.balance:
+        return fmt.Errorf("pool %s balances %s", req.Pool, tunnel.pool.balance)
+    }
+    return nil
+}
+
+// dropClient handles a client going away. A pooled tunnel keeps serving
+// users through its other clients, only the users of this one are closed.
+func (s *RelayServer) dropClient(port int, client *clientConnection) {
+    if client.pool == nil {
+        s.cleanupClient(port)
+        return
+    }
+    left, ok := client.pool.remove(client)
+    if !ok {
+        return // The whole tunnel is being cleaned up
+    }
+
+    client.conn.Close()
+    client.closeUsers()
+    s.releaseTunnel(client.account)
+    if left == 0 {
+        s.cleanupClient(port)
+        return
+    }
+    log.Printf("Client %s left pool %s on port %d, clients serving it: %d",
+        client.conn.RemoteAddr(), client.pool.name, port, left)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "strings"
+    "testing"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+func TestPoolNeedsSecretWithoutAccounts(t *testing.T) {
+    s := startRelay(t, freePort(t), nil)
+
+    client := register(t, s, protocol.RegistrationRequest{Pool: "web"})
+    if client.resp.Success || !strings.Contains(client.resp.Error, "pool secret") {
+        t.Fatalf("registration without a pool secret got %+v", client.resp)
+    }
+}
+
+func TestPoolJoinChecksSecret(t *testing.T) {
+    s := startRelay(t, freePort(t), nil)
+    first := mustRegister(t, s, protocol.RegistrationRequest{Pool: "web", PoolSecret: "s3cret"})
+
+    for _, secret := range []string{"", "guess"} {
+        intruder := register(t, s, protocol.RegistrationRequest{Pool: "web", PoolSecret: secret})
+        if intruder.resp.Success {
+            t.Fatalf("client with secret %q joined the pool", secret)
+        }
+    }
+
+    second := mustRegister(t, s, protocol.RegistrationRequest{Pool: "web", PoolSecret: "s3cret"})
+    if second.resp.PublicPort != first.resp.PublicPort {
+        t.Fatalf("member got port %d, want the pool's %d", second.resp.PublicPort, first.resp.PublicPort)
+    }
+
+    // Round robin sends one user to each member
+    dialTunnel(t, first.resp.PublicPort)
+    first.next(protocol.MessageTypeConnect)
+    dialTunnel(t, first.resp.PublicPort)
+    second.next(protocol.MessageTypeConnect)
+}
+
+func TestPoolsAreKeyedByAccount(t *testing.T) {
+    account := func(name string) Account {
+        hash := sha256.Sum256([]byte(name + "-token"))
+        return Account{Name: name, TokenSHA256: hex.EncodeToString(hash[:])}
+    }
+    s := startRelay(t, 0, func(s *RelayServer) {
+        s.availablePorts = []int{freePort(t), freePort(t)}
+        if err := s.SetAccounts([]Account{account("alice"), account("mallory")}); err != nil {
+            t.Fatal(err)
+        }
+    })
+
+    alice := mustRegister(t, s, protocol.RegistrationRequest{Token: "alice-token", Pool: "web"})
+
+    // Another account naming the same pool gets a pool of its own
+    mallory := mustRegister(t, s, protocol.RegistrationRequest{Token: "mallory-token", Pool: "web"})
+    if mallory.resp.PublicPort == alice.resp.PublicPort {
+        t.Fatal("another account joined the pool")
+    }
+
+    dialTunnel(t, alice.resp.PublicPort)
+    alice.next(protocol.MessageTypeConnect)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/bufpool"
+    "github.com/euphoricair7/tun/internal/quicconn"
+    "github.com/euphoricair7/tun/pkg/protocol"
+    "github.com/quic-go/quic-go"
+)
+
+// quicHandshakeTimeout bounds how long a new QUIC connection may take to
+// open its control stream
+const quicHandshakeTimeout = 30 * time.Second
+
+// streamOpener is implemented by control connections that can carry each
+// user connection on a stream of its own
+type streamOpener interface {
+    OpenStream(ctx context.Context) (net.Conn, error)
+}
+
+// SetQUICAddr accepts clients over QUIC on the UDP address addr, in
+// addition to the raw TCP registration port. Each user connection of a
+// QUIC client gets its own stream instead of sharing the control stream.
+// Must be called before Start.
+func (s *RelayServer) SetQUICAddr(addr string, tlsConfig *tls.Config) {
+    s.quicAddr = addr
+    s.quicTLS = tlsConfig
+}
+
+// startQUIC starts accepting QUIC connections
+func (s *RelayServer) startQUIC() error {
+    listener, err := quic.ListenAddr(s.quicAddr, quicconn.TLSConfig(s.quicTLS), quicconn.Config())
+    if err != nil {
+        return fmt.Errorf("failed to start QUIC listener: %w", err)
+    }
+    s.quicListener = listener
+
+    go func() {
+        for {
+            conn, err := listener.Accept(context.Background())
+            if err != nil {
+                if !errors.Is(err, quic.ErrServerClosed) {
+                    log.Printf("QUIC listener on %s stopped: %v", s.quicAddr, err)
+                }
+                return
+            }
+            go s.handleQUICConnection(conn)
+        }
+    }()
+
+    log.Printf("Accepting QUIC connections on %s", s.quicAddr)
+    return nil
+}
+
+// handleQUICConnection waits for the control stream of a new QUIC
+// connection and registers the client on it
+func (s *RelayServer) handleQUICConnection(conn *quic.Conn) {
+    ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+    stream, err := conn.AcceptStream(ctx)
+    cancel()
+    if err != nil {
+        log.Printf("No control stream from QUIC client %s: %v", conn.RemoteAddr(), err)
+        conn.CloseWithError(0, "")
+        return
+    }
+    s.handleClientRegistration(quicconn.NewControl(stream, conn))
+}
+
+// startStreamSession opens a stream to the client for a new user connection.
+// The stream starts with the connect message one way and the connect result
+// the other, after which it carries the user's bytes unframed.
+func (s *RelayServer) startStreamSession(port int, client *clientConnection, userConn net.Conn, userID, userAddr, publicAddr string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), quicHandshakeTimeout)
+    stream, err := client.streams.OpenStream(ctx)
+    cancel()
+    if err != nil {
+        log.Printf("Error opening stream to client for user %s: %v", userID, err)
+        userConn.Close()
+        return err
+    }
+
+    connectMsg := protocol.ClientMessage{
+        Type:       protocol.MessageTypeConnect,
+        UserID:     userID,
+        SourceAddr: userAddr,
+        DestAddr:   publicAddr,
+    }
+    encoder := json.NewEncoder(stream)
+    if err := encoder.Encode(connectMsg); err != nil {
+        log.Printf("Error notifying client of new connection: %v", err)
+        stream.Close()
+        userConn.Close()
+        return err
+    }
+
+    // Save user connection so it is closed with the tunnel
+    client.userConnMutex.Lock()
+    client.userConns[userID] = userConn
+    client.userConnMutex.Unlock()
+
+    s.activeUsers.add()
+    go s.handleUserStream(port, client, userID, userConn, stream)
+    return nil
+}
+
+// handleUserStream copies bytes between a user and its stream until either
+// side is done
+func (s *RelayServer) handleUserStream(port int, client *clientConnection, userID string, userConn, stream net.Conn) {
+    defer s.activeUsers.done()
+    defer func() {
+        client.userConnMutex.Lock()
+        delete(client.userConns, userID)
+        client.userConnMutex.Unlock()
+    }()
+
+    // A direction that ends cleanly only shuts down its write side, the
+    // other keeps flowing. Anything else closes both.
+    finish := func(clean bool, dst net.Conn) {
+        if clean && closeWrite(dst) == nil {
+            return
+        }
+        stream.Close()
+        userConn.Close()
+    }
+
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        finish(s.copyTraffic(port, client, stream, userConn, true), stream)
+    }()
+    go func() {
+        defer wg.Done()
+        reader := bufio.NewReader(stream)
+        reason, err := readConnectResult(reader)
+        if err != nil || reason != "" {
+            if reason != "" {
+                s.connectFailed(port, client, userID, reason)
+            }
+            stream.Close()
+            userConn.Close()
+            return
+        }
+        finish(s.copyTraffic(port, client, userConn, reader, false), userConn)
+    }()
+    wg.Wait()
+    stream.Close()
+    userConn.Close()
+}
+
+// copyTraffic copies from src to dst, shaping and counting the bytes like
+// traffic on the control connection. It reports whether src ended cleanly.
+func (s *RelayServer) copyTraffic(port int, client *clientConnection, dst net.Conn, src io.Reader, inbound bool) bool {
+    buffer := bufpool.Get(s.readSize)
+    defer bufpool.Put(buffer)
+    for {
+        n, err := src.Read(buffer)
+        if n > 0 {
+            if !s.accountTraffic(port, client, n, inbound) {
+                return false
+            }
+            if inbound {
+                client.stats.wireBytesIn.Add(int64(n))
+            } else {
+                client.stats.wireBytesOut.Add(int64(n))
+            }
+            if _, err := dst.Write(buffer[:n]); err != nil {
+                return false
+            }
+        }
+        if err != nil {
+            return err == io.EOF
+        }
+    }
+}
+
+// readConnectResult reads the connect result a client starts its side of a
+// stream with, returning why it could not reach its local service if it
+// couldn't
+func readConnectResult(reader *bufio.Reader) (string, error) {
+    line, err := reader.ReadBytes('\n')
+    if err != nil {
+        return "", err
+    }
+    var msg protocol.ClientMessage
+    if err := json.Unmarshal(line, &msg); err != nil {
+        return "", err
+    }
+    if msg.Type != protocol.MessageTypeConnectResult {
+        return "", fmt.Errorf("expected %s, got %q", protocol.MessageTypeConnectResult, msg.Type)
+    }
+    return msg.Error, nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// freePort returns a TCP port nothing listens on right now
+func freePort(t *testing.T) int {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startRelay starts a relay handing out publicPort, after setup configured
+// it, and stops it when the test ends
+func startRelay(t *testing.T, publicPort int, setup func(s *RelayServer)) *RelayServer {
+    t.Helper()
+    registrationPort := freePort(t)
+    s, err := NewRelayServer(registrationPort, publicPort, publicPort)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if setup != nil {
+        setup(s)
+    }
+
+    started := make(chan error, 1)
+    go func() { started <- s.Start() }()
+    addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(registrationPort))
+    for deadline := time.Now().Add(5 * time.Second); ; {
+        conn, err := net.Dial("tcp", addr)
+        if err == nil {
+            conn.Close()
+            break
+        }
+        select {
+        case err := <-started:
+            t.Fatalf("relay failed to start: %v", err)
+        default:
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("relay did not start listening on %s", addr)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    t.Cleanup(func() { stopRelay(s) })
+    return s
+}
+
+// stopRelay shuts a relay down unless that already happened
+func stopRelay(s *RelayServer) {
+    select {
+    case <-s.shutdown:
+    default:
+        s.Shutdown()
+    }
+}
+
+// testClient speaks the control protocol like a client would, without a
+// local service behind it
+type testClient struct {
+    t       *testing.T
+    conn    net.Conn
+    decoder *json.Decoder
+    resp    protocol.RegistrationResponse
+}
+
+// register connects to the relay and sends req, failing the test unless
+// the relay answers
+func register(t *testing.T, s *RelayServer, req protocol.RegistrationRequest) *testClient {
+    t.Helper()
+    conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(s.registrationPort)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    if req.LocalPort == 0 {
+        req.LocalHost, req.LocalPort = "127.0.0.1", 1
+    }
+    if err := json.NewEncoder(conn).Encode(req); err != nil {
+        t.Fatal(err)
+    }
+    c := &testClient{t: t, conn: conn, decoder: json.NewDecoder(conn)}
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if err := c.decoder.Decode(&c.resp); err != nil {
+        t.Fatalf("no registration response: %v", err)
+    }
+    conn.SetReadDeadline(time.Time{})
+    return c
+}
+
+// mustRegister is register for registrations that have to succeed
+func mustRegister(t *testing.T, s *RelayServer, req protocol.RegistrationRequest) *testClient {
+    t.Helper()
+    c := register(t, s, req)
+    if !c.resp.Success {
+        t.Fatalf("registration failed: %s", c.resp.Error)
+    }
+    return c
+}
+
+// next returns the next message of type msgType, skipping others
+func (c *testClient) next(msgType string) protocol.ClientMessage {
+    c.t.Helper()
+    c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    defer c.conn.SetReadDeadline(time.Time{})
+    for {
+        var msg protocol.ClientMessage
+        if err := c.decoder.Decode(&msg); err != nil {
+            c.t.Fatalf("waiting for %s message: %v", msgType, err)
+        }
+        if msg.Type == msgType {
+            return msg
+        }
+    }
+}
+
+// quiet reports whether no message of type msgType arrives within wait
+func (c *testClient) quiet(msgType string, wait time.Duration) bool {
+    c.conn.SetReadDeadline(time.Now().Add(wait))
+    defer c.conn.SetReadDeadline(time.Time{})
+    for {
+        var msg protocol.ClientMessage
+        if err := c.decoder.Decode(&msg); err != nil {
+            return true
+        }
+        if msg.Type == msgType {
+            return false
+        }
+    }
+}
+
+// send writes a message to the relay
+func (c *testClient) send(msg protocol.ClientMessage) {
+    c.t.Helper()
+    if err := json.NewEncoder(c.conn).Encode(msg); err != nil {
+        c.t.Fatal(err)
+    }
+}
+
+// dialTunnel connects a user to a public port of the relay
+func dialTunnel(t *testing.T, port int) net.Conn {
+    t.Helper()
+    conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return conn
+}
+
+// readString reads exactly len(want) bytes from conn and compares them
+func readString(t *testing.T, conn net.Conn, want string) {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    defer conn.SetReadDeadline(time.Time{})
+    buffer := make([]byte, len(want))
+    if _, err := io.ReadFull(conn, buffer); err != nil {
+        t.Fatalf("reading %q: %v", want, err)
+    }
+    if string(buffer) != want {
+        t.Fatalf("read %q, want %q", buffer, want)
+    }
+}
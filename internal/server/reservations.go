@@ -0,0 +1,291 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+
+    "github.com/euphoricair7/tun/internal/audit"
+    "github.com/euphoricair7/tun/internal/state"
+)
+
+// Reservation permanently ties a public port or a hostname to an account
+type Reservation struct {
+    Account  string `json:"account"`
+    Port     int    `json:"port,omitempty"`
+    Hostname string `json:"hostname,omitempty"`
+}
+
+// reservationsBucket is where reservations live in the state store
+const reservationsBucket = "reservations"
+
+// reservations keeps the reservations of all accounts in the state store,
+// with a copy in memory for lookups
+type reservations struct {
+    store   state.Store
+    mutex   sync.RWMutex
+    entries []Reservation
+}
+
+// load reads the reservations made before the relay restarted
+func (r *reservations) load() error {
+    values, err := r.store.List(reservationsBucket)
+    if err != nil {
+        return err
+    }
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    r.entries = r.entries[:0]
+    for key, value := range values {
+        var entry Reservation
+        if err := json.Unmarshal(value, &entry); err != nil {
+            return fmt.Errorf("invalid reservation %s: %w", key, err)
+        }
+        r.entries = append(r.entries, entry)
+    }
+    return nil
+}
+
+// ImportReservationsFile copies the reservations in a file written by the
+// -reservations flag of earlier releases into the state store, keeping any
+// the store already holds, and returns how many were added. Must be called
+// after SetStateStore and before Start.
+func (s *RelayServer) ImportReservationsFile(path string) (int, error) {
+    if s.store == nil {
+        return 0, fmt.Errorf("reservations need a state store")
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return 0, err
+    }
+    var entries []Reservation
+    if err := json.Unmarshal(data, &entries); err != nil {
+        return 0, fmt.Errorf("invalid reservations file %s: %w", path, err)
+    }
+
+    added := 0
+    for _, entry := range entries {
+        if _, err := s.store.Get(reservationsBucket, entry.key()); err == nil {
+            continue
+        }
+        value, err := json.Marshal(entry)
+        if err != nil {
+            return added, err
+        }
+        if err := s.store.Put(reservationsBucket, entry.key(), value); err != nil {
+            return added, err
+        }
+        added++
+    }
+    return added, nil
+}
+
+// portOwner returns the account that reserved port, empty if none did
+func (r *reservations) portOwner(port int) string {
+    if r == nil {
+        return ""
+    }
+
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+
+    for _, entry := range r.entries {
+        if entry.Port == port {
+            return entry.Account
+        }
+    }
+    return ""
+}
+
+// hostnameOwner returns the account that reserved hostname, empty if none did
+func (r *reservations) hostnameOwner(hostname string) string {
+    if r == nil {
+        return ""
+    }
+
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+
+    for _, entry := range r.entries {
+        if entry.Hostname == hostname {
+            return entry.Account
+        }
+    }
+    return ""
+}
+
+// count returns how many reservations an account holds
+func (r *reservations) count(accountName string) int {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+
+    n := 0
+    for _, entry := range r.entries {
+        if entry.Account == accountName {
+            n++
+        }
+    }
+    return n
+}
+
+// add records a reservation
+func (r *reservations) add(entry Reservation) error {
+    value, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    if err := r.store.Put(reservationsBucket, entry.key(), value); err != nil {
+        return err
+    }
+
+    r.mutex.Lock()
+    r.entries = append(r.entries, entry)
+    r.mutex.Unlock()
+    return nil
+}
+
+// remove deletes a reservation
+func (r *reservations) remove(entry Reservation) error {
+    if err := r.store.Delete(reservationsBucket, entry.key()); err != nil {
+        return err
+    }
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    for i, existing := range r.entries {
+        if existing == entry {
+            r.entries = append(r.entries[:i], r.entries[i+1:]...)
+            break
+        }
+    }
+    return nil
+}
+
+// ownerName is the account name reservations are checked against, empty on
+// relays without accounts
+func ownerName(a *account) string {
+    if a == nil {
+        return ""
+    }
+    return a.Name
+}
+
+// checkReservations makes sure a registration does not ask for a port or
+// hostname another account reserved
+func (s *RelayServer) checkReservations(a *account, port int, hostname string) error {
+    if owner := s.reservations.portOwner(port); port != 0 && owner != "" && owner != ownerName(a) {
+        return fmt.Errorf("port %d is reserved by another account", port)
+    }
+    if owner := s.reservations.hostnameOwner(hostname); hostname != "" && owner != "" && owner != ownerName(a) {
+        return fmt.Errorf("hostname %s is reserved by another account", hostname)
+    }
+    return nil
+}
+
+// assignablePort reports whether allocatePort may hand out port to a
+// registration that did not ask for a specific port. Reserved ports are
+// only used when their owner asks for them.
+func (s *RelayServer) assignablePort(a *account, port int) bool {
+    return a.allowsPort(port) && s.reservations.portOwner(port) == ""
+}
+
+// reserve permanently reserves the port and hostname of a new tunnel
+func (s *RelayServer) reserve(a *account, port int, hostname string) error {
+    if a == nil || s.reservations == nil {
+        return fmt.Errorf("reservations are not enabled on this relay")
+    }
+
+    // Serialize so concurrent registrations can't exceed the limit
+    s.accountsMutex.Lock()
+    defer s.accountsMutex.Unlock()
+
+    wanted := []Reservation{}
+    if s.reservations.portOwner(port) == "" {
+        wanted = append(wanted, Reservation{Account: a.Name, Port: port})
+    }
+    if hostname != "" && s.reservations.hostnameOwner(hostname) == "" {
+        wanted = append(wanted, Reservation{Account: a.Name, Hostname: hostname})
+    }
+    if s.reservations.count(a.Name)+len(wanted) > a.MaxReservations {
+        return fmt.Errorf("account %s has reached its limit of %d reservations", a.Name, a.MaxReservations)
+    }
+
+    for i, entry := range wanted {
+        if err := s.reservations.add(entry); err != nil {
+            log.Printf("Failed to save reservation: %v", err)
+            // Don't leave the tunnel half reserved
+            for _, saved := range wanted[:i] {
+                if err := s.reservations.remove(saved); err != nil {
+                    log.Printf("Failed to undo reservation of %s: %v", saved.describe(), err)
+                }
+            }
+            return fmt.Errorf("failed to save reservation")
+        }
+    }
+    for _, entry := range wanted {
+        log.Printf("Account %s reserved %s", a.Name, entry.describe())
+        s.audit.Log(audit.Event{
+            Type:     audit.ReservationCreated,
+            Identity: a.Name,
+            Port:     entry.Port,
+            Hostname: entry.Hostname,
+        })
+    }
+    return nil
+}
+
+// unreserve gives up the account's reservations of port and hostname, so
+// other accounts may use them once the tunnel closes
+func (s *RelayServer) unreserve(a *account, port int, hostname string) error {
+    if a == nil || s.reservations == nil {
+        return fmt.Errorf("reservations are not enabled on this relay")
+    }
+
+    s.accountsMutex.Lock()
+    defer s.accountsMutex.Unlock()
+
+    owned := []Reservation{}
+    if port != 0 && s.reservations.portOwner(port) == a.Name {
+        owned = append(owned, Reservation{Account: a.Name, Port: port})
+    }
+    if hostname != "" && s.reservations.hostnameOwner(hostname) == a.Name {
+        owned = append(owned, Reservation{Account: a.Name, Hostname: hostname})
+    }
+
+    for _, entry := range owned {
+        if err := s.reservations.remove(entry); err != nil {
+            log.Printf("Failed to release reservation: %v", err)
+            return fmt.Errorf("failed to release reservation")
+        }
+        log.Printf("Account %s released %s", a.Name, entry.describe())
+        s.audit.Log(audit.Event{
+            Type:     audit.ReservationReleased,
+            Identity: a.Name,
+            Port:     entry.Port,
+            Hostname: entry.Hostname,
+        })
+    }
+    return nil
+}
+
+// key identifies a reservation in the state store
+func (r Reservation) key() string {
+    if r.Hostname != "" {
+        return "hostname:" + r.Hostname
+    }
+    return fmt.Sprintf("port:%d", r.Port)
+}
+
+// describe names what a reservation holds
+func (r Reservation) describe() string {
+    if r.Hostname != "" {
+        return "hostname " + r.Hostname
+    }
+    return fmt.Sprintf("port %d", r.Port)
+}
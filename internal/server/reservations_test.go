@@ -0,0 +1,154 @@
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/state"
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// reservingAccount is an account with token name+"-token" that may hold two
+// reservations
+func reservingAccount(name string) Account {
+    hash := sha256.Sum256([]byte(name + "-token"))
+    return Account{Name: name, TokenSHA256: hex.EncodeToString(hash[:]), MaxReservations: 2}
+}
+
+// reservingRelay starts a relay on publicPort whose reservations are kept in
+// the file at path
+func reservingRelay(t *testing.T, publicPort int, path string) *RelayServer {
+    return startRelay(t, publicPort, func(s *RelayServer) {
+        if err := s.SetAccounts([]Account{reservingAccount("alice"), reservingAccount("bob")}); err != nil {
+            t.Fatal(err)
+        }
+        store, err := state.NewFileStore(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        s.SetStateStore(store)
+    })
+}
+
+func TestReservationsSurviveRestart(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "tun-state.json")
+    port := freePort(t)
+
+    s := reservingRelay(t, port, path)
+    alice := mustRegister(t, s, protocol.RegistrationRequest{Token: "alice-token", Port: port, Reserve: true})
+    alice.conn.Close()
+    stopRelay(s)
+
+    s = reservingRelay(t, port, path)
+    if c := register(t, s, protocol.RegistrationRequest{Token: "bob-token", Port: port}); c.resp.Success || !strings.Contains(c.resp.Error, "reserved") {
+        t.Fatalf("another account got the reserved port after a restart: %+v", c.resp)
+    }
+    mustRegister(t, s, protocol.RegistrationRequest{Token: "alice-token", Port: port})
+}
+
+func TestReleaseReservation(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "tun-state.json")
+    port := freePort(t)
+
+    s := reservingRelay(t, port, path)
+    alice := mustRegister(t, s, protocol.RegistrationRequest{Token: "alice-token", Port: port, Reserve: true})
+    alice.conn.Close()
+
+    if c := register(t, s, protocol.RegistrationRequest{Token: "bob-token", Port: port, Release: true}); c.resp.Success {
+        t.Fatal("another account's registration released the reservation")
+    }
+    if owner := s.reservations.portOwner(port); owner != "alice" {
+        t.Fatalf("port owned by %q after another account's release", owner)
+    }
+
+    // The tunnel may take a moment to let go of the port after alice left
+    for i := 0; ; i++ {
+        c := register(t, s, protocol.RegistrationRequest{Token: "alice-token", Port: port, Release: true})
+        if c.resp.Success {
+            break
+        }
+        if i == 50 {
+            t.Fatalf("release failed: %s", c.resp.Error)
+        }
+        c.conn.Close()
+        time.Sleep(20 * time.Millisecond)
+    }
+    if owner := s.reservations.portOwner(port); owner != "" {
+        t.Fatalf("port still owned by %q", owner)
+    }
+
+    // The release is saved too
+    store, err := state.NewFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if values, err := store.List(reservationsBucket); err != nil || len(values) != 0 {
+        t.Fatalf("saved reservations = %v, %v", values, err)
+    }
+}
+
+// failingStore fails to save the key failKey
+type failingStore struct {
+    *state.MemoryStore
+    failKey string
+}
+
+func (s failingStore) Put(bucket, key string, value []byte) error {
+    if key == s.failKey {
+        return errors.New("disk full")
+    }
+    return s.MemoryStore.Put(bucket, key, value)
+}
+
+func TestReserveRollsBack(t *testing.T) {
+    s := &RelayServer{}
+    if err := s.SetAccounts([]Account{reservingAccount("alice")}); err != nil {
+        t.Fatal(err)
+    }
+    store := failingStore{MemoryStore: state.NewMemoryStore(), failKey: "hostname:app.test"}
+    s.SetStateStore(store)
+
+    if err := s.reserve(s.accounts[0], 8080, "app.test"); err == nil {
+        t.Fatal("reserve succeeded although the hostname could not be saved")
+    }
+    if owner := s.reservations.portOwner(8080); owner != "" {
+        t.Errorf("port 8080 still owned by %q", owner)
+    }
+    if values, err := store.List(reservationsBucket); err != nil || len(values) != 0 {
+        t.Errorf("saved reservations = %v, %v", values, err)
+    }
+}
+
+func TestImportReservationsFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "reservations.json")
+    old := `[{"account": "alice", "port": 8080}, {"account": "bob", "hostname": "app.test"}]`
+    if err := os.WriteFile(path, []byte(old), 0o600); err != nil {
+        t.Fatal(err)
+    }
+
+    s := &RelayServer{}
+    s.SetStateStore(state.NewMemoryStore())
+    if added, err := s.ImportReservationsFile(path); err != nil || added != 2 {
+        t.Fatalf("ImportReservationsFile = %d, %v, want 2", added, err)
+    }
+    // Importing again on the next start keeps what is there
+    if added, err := s.ImportReservationsFile(path); err != nil || added != 0 {
+        t.Fatalf("second ImportReservationsFile = %d, %v, want 0", added, err)
+    }
+
+    if err := s.loadState(); err != nil {
+        t.Fatal(err)
+    }
+    if owner := s.reservations.portOwner(8080); owner != "alice" {
+        t.Errorf("port 8080 owned by %q", owner)
+    }
+    if owner := s.reservations.hostnameOwner("app.test"); owner != "bob" {
+        t.Errorf("app.test owned by %q", owner)
+    }
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "strings"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// dialTimeout bounds how long the relay waits when dialing on behalf of a client
+const dialTimeout = 10 * time.Second
+
+// dialRule is one entry of the allowlist of destinations clients may reach
+// through the relay
+type dialRule struct {
+    host    string     // exact host name, or "*.suffix" wildcard
+    network *net.IPNet // set instead of host for CIDR rules
+    port    string     // port number or "*"
+}
+
+// SetDialAllowlist sets the destinations clients may ask the relay to dial.
+// Each pattern is host:port where host is a name, a "*.domain" wildcard, an
+// IP or a CIDR and port is a number or "*". An empty allowlist disables
+// reverse forwarding. Must be called before Start.
+func (s *RelayServer) SetDialAllowlist(patterns []string) error {
+    rules := make([]dialRule, 0, len(patterns))
+    for _, pattern := range patterns {
+        host, port, err := net.SplitHostPort(strings.TrimSpace(pattern))
+        if err != nil {
+            return fmt.Errorf("invalid dial allowlist entry %q: %w", pattern, err)
+        }
+
+        rule := dialRule{host: strings.ToLower(host), port: port}
+        if strings.Contains(host, "/") {
+            _, network, err := net.ParseCIDR(host)
+            if err != nil {
+                return fmt.Errorf("invalid dial allowlist entry %q: %w", pattern, err)
+            }
+            rule = dialRule{network: network, port: port}
+        } else if ip := net.ParseIP(host); ip != nil {
+            bits := 8 * len(ip.To16())
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            rule = dialRule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, port: port}
+        }
+        rules = append(rules, rule)
+    }
+
+    s.dialRules = rules
+    return nil
+}
+
+// resolveDialTarget checks target against the allowlist and returns the
+// address to dial. Names matched by CIDR rules are resolved here so the
+// relay dials exactly the address it checked.
+func (s *RelayServer) resolveDialTarget(target string) (string, error) {
+    host, port, err := net.SplitHostPort(target)
+    if err != nil {
+        return "", fmt.Errorf("invalid target %q", target)
+    }
+    host = strings.ToLower(host)
+
+    var ips []net.IP
+    resolved := false
+
+    for _, rule := range s.dialRules {
+        if rule.port != "*" && rule.port != port {
+            continue
+        }
+
+        if rule.network == nil {
+            if rule.host == host || (strings.HasPrefix(rule.host, "*.") && strings.HasSuffix(host, rule.host[1:])) {
+                return target, nil
+            }
+            continue
+        }
+
+        if !resolved {
+            resolved = true
+            if ip := net.ParseIP(host); ip != nil {
+                ips = []net.IP{ip}
+            } else {
+                ips, _ = net.LookupIP(host)
+            }
+        }
+        for _, ip := range ips {
+            if rule.network.Contains(ip) {
+                return net.JoinHostPort(ip.String(), port), nil
+            }
+        }
+    }
+
+    return "", fmt.Errorf("destination %s is not allowed", target)
+}
+
+// handleOpenRequest dials a destination on behalf of the client and streams
+// it back over the tunnel, the reverse of a public user connection
+func (s *RelayServer) handleOpenRequest(port int, client *clientConnection, msg protocol.ClientMessage) {
+    if !client.account.allowsFeature(FeatureForward) {
+        reason := fmt.Sprintf("forwarding is not enabled for account %s", client.account.Name)
+        s.auditForward(port, client, msg.Target, reason)
+        sendOpenResult(client, msg.UserID, reason)
+        return
+    }
+
+    addr, err := s.resolveDialTarget(msg.Target)
+    if err != nil {
+        log.Printf("Rejected open request from client on port %d: %v", port, err)
+        s.auditForward(port, client, msg.Target, err.Error())
+        sendOpenResult(client, msg.UserID, err.Error())
+        return
+    }
+
+    conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+    if err != nil {
+        log.Printf("Failed to dial %s for client on port %d: %v", msg.Target, port, err)
+        sendOpenResult(client, msg.UserID, fmt.Sprintf("failed to connect to %s", msg.Target))
+        return
+    }
+
+    client.userConnMutex.Lock()
+    if _, exists := client.userConns[msg.UserID]; exists {
+        client.userConnMutex.Unlock()
+        conn.Close()
+        sendOpenResult(client, msg.UserID, "duplicate connection id")
+        return
+    }
+    halfCloser := newHalfCloseConn(conn)
+    client.userConns[msg.UserID] = halfCloser
+    client.userConnMutex.Unlock()
+
+    if err := sendOpenResult(client, msg.UserID, ""); err != nil {
+        client.userConnMutex.Lock()
+        delete(client.userConns, msg.UserID)
+        client.userConnMutex.Unlock()
+        conn.Close()
+        return
+    }
+
+    log.Printf("Client on port %d opened connection %s to %s", port, msg.UserID, msg.Target)
+
+    // From here on the dialed connection behaves like a public user connection
+    s.activeUsers.add()
+    go s.handleUserData(port, client, msg.UserID, halfCloser)
+    go s.writeToUser(port, client, msg.UserID, halfCloser)
+}
+
+// sendOpenResult tells the client whether its open request succeeded
+func sendOpenResult(client *clientConnection, userID, errMsg string) error {
+    result := protocol.ClientMessage{
+        Type:   protocol.MessageTypeOpenResult,
+        UserID: userID,
+        Error:  errMsg,
+    }
+    if err := client.frames.Encode(result); err != nil {
+        log.Printf("Error sending open result to client: %v", err)
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import "testing"
+
+func TestDialAllowlist(t *testing.T) {
+    s := &RelayServer{}
+    err := s.SetDialAllowlist([]string{
+        "db.internal:5432",
+        "*.example.com:443",
+        "10.1.0.0/16:*",
+        "192.0.2.7:22",
+        "[2001:db8::/32]:80",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        target string
+        want   string // address dialed, empty if the target is refused
+    }{
+        {"db.internal:5432", "db.internal:5432"},
+        {"DB.Internal:5432", "DB.Internal:5432"},
+        {"db.internal:5433", ""},
+        {"api.example.com:443", "api.example.com:443"},
+        {"a.b.example.com:443", "a.b.example.com:443"},
+        {"example.com:443", ""},
+        {"badexample.com:443", ""},
+        {"api.example.com:80", ""},
+        {"10.1.2.3:8080", "10.1.2.3:8080"},
+        {"10.2.0.1:8080", ""},
+        {"192.0.2.7:22", "192.0.2.7:22"},
+        {"192.0.2.8:22", ""},
+        {"[2001:db8::1]:80", "[2001:db8::1]:80"},
+        {"[2001:db9::1]:80", ""},
+        {"no-port", ""},
+    }
+    for _, test := range tests {
+        got, err := s.resolveDialTarget(test.target)
+        if test.want == "" {
+            if err == nil {
+                t.Errorf("%s allowed as %s", test.target, got)
+            }
+            continue
+        }
+        if err != nil || got != test.want {
+            t.Errorf("%s resolved to %q, %v, want %s", test.target, got, err, test.want)
+        }
+    }
+}
+
+func TestDialAllowlistRejectsBadEntries(t *testing.T) {
+    for _, pattern := range []string{"db.internal", "10.0.0.0/33:80"} {
+        s := &RelayServer{}
+        if err := s.SetDialAllowlist([]string{pattern}); err == nil {
+            t.Errorf("%q accepted", pattern)
+        }
+    }
+}
@@ -1,15 +1,28 @@
 package server
 
 import (
+    "crypto/tls"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "log"
     "net"
+    "net/http"
+    "net/url"
+    "strconv"
     "sync"
+    "sync/atomic"
     "time"
 
+    "github.com/euphoricair7/tun/internal/audit"
+    "github.com/euphoricair7/tun/internal/bufpool"
+    "github.com/euphoricair7/tun/internal/cluster"
+    "github.com/euphoricair7/tun/internal/frame"
+    "github.com/euphoricair7/tun/internal/noiseconn"
+    "github.com/euphoricair7/tun/internal/state"
     "github.com/euphoricair7/tun/pkg/protocol"
+    "github.com/quic-go/quic-go"
 )
 
 // RelayServer handles client registrations and forwards traffic
@@ -18,17 +31,75 @@ type RelayServer struct {
     availablePorts   []int
     portsMutex       sync.Mutex
     clients          map[int]*clientConnection
+    pools            map[poolKey]int // pool to port, guarded by clientsMutex
     clientsMutex     sync.RWMutex
     listener         net.Listener
     shutdown         chan struct{}
+    draining         chan struct{}
+    drainOnce        sync.Once
+    activeUsers      userCounter
+    cluster          *clusterState
+    dialRules        []dialRule
+    sourceACL        sourceACL
+    oidc             *oidcGate
+    limits           Limits
+    quota            *quotaTracker
+    accounts         []*account
+    accountsMutex    sync.Mutex
+    httpAddr         string
+    httpPublicURL    *url.URL // how users reach httpAddr, nil if directly
+    vhostServer      *http.Server
+    hosts            map[string]int // hostname to port
+    hostsMutex       sync.RWMutex
+    reservations     *reservations
+    store            state.Store
+    audit            *audit.Logger
+    webSocketAddr    string
+    webSocketTLS     *tls.Config
+    webSocketServer  *http.Server
+    quicAddr         string
+    quicTLS          *tls.Config
+    quicListener     *quic.Listener
+    noiseAddr        string
+    noiseKey         noiseconn.Key
+    noiseListener    net.Listener
+    readSize         int
 }
 
 type clientConnection struct {
     conn          net.Conn
+    frames        *frame.Encoder // every message to the client goes through here
+    listener      net.Listener
     targetHost    string
     targetPort    int
     userConns     map[string]net.Conn // key is user connection ID
     userConnMutex sync.RWMutex
+    sourceACL     sourceACL
+    limiter       *tunnelLimiter
+    stats         *tunnelCounters
+    account       *account     // nil on relays without accounts
+    identity      string       // who quotas are charged to
+    streams       streamOpener // set when user connections get their own QUIC stream
+    pool          *clientPool  // set for tunnels served by several clients
+    healthError   atomic.Value // string, why the client's local service is down
+
+    inboundLimiter  *byteLimiter
+    outboundLimiter *byteLimiter
+    suspendOnce     sync.Once
+
+    compression          string // algorithm for data frames, empty for none
+    compressionThreshold int
+
+    // HTTP tunnels only
+    protocol        string
+    hostHeader      string
+    requestHeaders  []protocol.HeaderRule
+    responseHeaders []protocol.HeaderRule
+    credentials     httpCredentials
+    oidcAllow       []string
+    hostname        string
+    httpServer      *http.Server
+    httpListener    *httpListener
 }
 
 // NewRelayServer creates a new relay server instance
@@ -43,12 +114,23 @@ func NewRelayServer(registrationPort, minPort, maxPort int) (*RelayServer, error
         registrationPort: registrationPort,
         availablePorts:   availablePorts,
         clients:          make(map[int]*clientConnection),
+        pools:            make(map[poolKey]int),
+        hosts:            make(map[string]int),
         shutdown:         make(chan struct{}),
+        draining:         make(chan struct{}),
+        readSize:         protocol.DefaultReadSize,
     }, nil
 }
 
 // Start begins accepting client registration requests
 func (s *RelayServer) Start() error {
+    if s.store != nil {
+        if err := s.loadState(); err != nil {
+            return err
+        }
+        go s.saveStatePeriodically()
+    }
+
     var err error
     s.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.registrationPort))
     if err != nil {
@@ -56,6 +138,32 @@ func (s *RelayServer) Start() error {
     }
     defer s.listener.Close()
 
+    if s.cluster != nil {
+        if err := s.startCluster(); err != nil {
+            return err
+        }
+    }
+    if s.httpAddr != "" {
+        if err := s.startVirtualHosts(); err != nil {
+            return err
+        }
+    }
+    if s.webSocketAddr != "" {
+        if err := s.startWebSocket(); err != nil {
+            return err
+        }
+    }
+    if s.quicAddr != "" {
+        if err := s.startQUIC(); err != nil {
+            return err
+        }
+    }
+    if s.noiseAddr != "" {
+        if err := s.startNoise(); err != nil {
+            return err
+        }
+    }
+
     log.Printf("Registration server listening on port %d", s.registrationPort)
 
     // Accept connections in a loop
@@ -65,6 +173,8 @@ func (s *RelayServer) Start() error {
             select {
             case <-s.shutdown:
                 return nil // Server is shutting down
+            case <-s.draining:
+                return nil // Server is draining, no new registrations
             default:
                 log.Printf("Error accepting connection: %v", err)
                 continue
@@ -76,12 +186,88 @@ func (s *RelayServer) Start() error {
     }
 }
 
+// Drain stops accepting new registrations and user connections, tells every
+// client that the relay is going away and waits up to timeout for in-flight
+// user connections to finish. Shutdown should be called afterwards to close
+// whatever is still open.
+func (s *RelayServer) Drain(timeout time.Duration) {
+    s.drainOnce.Do(func() {
+        close(s.draining)
+        s.audit.Log(audit.Event{
+            Type:   audit.RelayDraining,
+            Reason: fmt.Sprintf("draining for up to %s", timeout),
+        })
+    })
+    if s.listener != nil {
+        s.listener.Close()
+    }
+    if s.cluster != nil {
+        s.stopCluster()
+    }
+    if s.vhostServer != nil {
+        s.vhostServer.SetKeepAlivesEnabled(false)
+    }
+    if s.webSocketServer != nil {
+        s.webSocketServer.Close() // Established control connections are hijacked and stay up
+    }
+    if s.quicListener != nil {
+        s.quicListener.Close() // Established QUIC connections stay up
+    }
+    if s.noiseListener != nil {
+        s.noiseListener.Close()
+    }
+
+    // Stop accepting users and let clients know they should reconnect elsewhere
+    s.clientsMutex.RLock()
+    for port, client := range s.clients {
+        client.listener.Close()
+        if client.httpServer != nil {
+            // Let in-flight requests finish but close idle connections
+            client.httpServer.SetKeepAlivesEnabled(false)
+        }
+
+        drainMsg := protocol.ClientMessage{Type: protocol.MessageTypeDraining}
+        for _, member := range client.members() {
+            if err := member.frames.Encode(drainMsg); err != nil {
+                log.Printf("Error notifying client on port %d of drain: %v", port, err)
+            }
+        }
+    }
+    s.clientsMutex.RUnlock()
+
+    // Wait for in-flight user connections
+    select {
+    case <-s.activeUsers.idle():
+        log.Println("All user connections finished")
+    case <-time.After(timeout):
+        log.Printf("Drain timeout of %s reached, closing remaining user connections", timeout)
+    }
+}
+
 // Shutdown gracefully stops the server
 func (s *RelayServer) Shutdown() {
     close(s.shutdown)
+    s.audit.Log(audit.Event{Type: audit.RelayShutdown})
     if s.listener != nil {
         s.listener.Close()
     }
+    if s.cluster != nil {
+        s.stopCluster()
+    }
+    if s.vhostServer != nil {
+        s.vhostServer.Close()
+    }
+    if s.webSocketServer != nil {
+        s.webSocketServer.Close()
+    }
+    if s.quicListener != nil {
+        s.quicListener.Close()
+    }
+    if s.noiseListener != nil {
+        s.noiseListener.Close()
+    }
+
+    s.saveState()
 
     // Close all client connections
     s.clientsMutex.Lock()
@@ -89,15 +275,21 @@ func (s *RelayServer) Shutdown() {
 
     for port, client := range s.clients {
         log.Printf("Closing client connection on port %d", port)
-        client.conn.Close()
+        client.listener.Close()
+        if client.httpServer != nil {
+            client.httpServer.Close()
+        }
 
-        // Close all user connections for this client
-        client.userConnMutex.Lock()
-        for id, conn := range client.userConns {
-            log.Printf("Closing user connection %s", id)
-            conn.Close()
+        // Close the clients serving the tunnel and their users
+        for _, member := range client.members() {
+            member.conn.Close()
+            member.userConnMutex.Lock()
+            for id, conn := range member.userConns {
+                log.Printf("Closing user connection %s", id)
+                conn.Close()
+            }
+            member.userConnMutex.Unlock()
         }
-        client.userConnMutex.Unlock()
     }
 }
 
@@ -112,74 +304,322 @@ func (s *RelayServer) handleClientRegistration(conn net.Conn) {
     clientAddr := conn.RemoteAddr().String()
     log.Printf("New client connection from %s", clientAddr)
 
+    sourceIP := clientIdentity(conn)
+    identity := sourceIP
+    var req protocol.RegistrationRequest
+
+    // reject refuses the registration and records why
+    reject := func(reason string) {
+        s.audit.Log(audit.Event{
+            Type:     audit.RegistrationRejected,
+            Identity: identity,
+            SourceIP: sourceIP,
+            Port:     req.Port,
+            Hostname: req.Hostname,
+            Protocol: req.Protocol,
+            Reason:   reason,
+        })
+        sendErrorResponse(conn, reason)
+        conn.Close()
+    }
+
+    select {
+    case <-s.draining:
+        reject("Relay is draining")
+        return
+    default:
+    }
+
     // Read client registration request
     decoder := json.NewDecoder(conn)
-    var req protocol.RegistrationRequest
     if err := decoder.Decode(&req); err != nil {
         log.Printf("Error decoding registration request from %s: %v", clientAddr, err)
-        sendErrorResponse(conn, "Invalid request format")
-        conn.Close()
+        reject("Invalid request format")
         return
     }
 
     if req.LocalPort <= 0 {
-        sendErrorResponse(conn, "Invalid local port specified")
-        conn.Close()
+        reject("Invalid local port specified")
+        return
+    }
+
+    if req.Protocol == "" {
+        req.Protocol = protocol.ProtocolTCP
+    }
+    switch req.Protocol {
+    case protocol.ProtocolTCP:
+    case protocol.ProtocolHTTP:
+        if err := validateHTTPOptions(req); err != nil {
+            reject(err.Error())
+            return
+        }
+    default:
+        reject(fmt.Sprintf("Unsupported protocol %q", req.Protocol))
+        return
+    }
+
+    if req.Hostname != "" {
+        if req.Protocol != protocol.ProtocolHTTP {
+            reject("Hostnames are only supported for HTTP tunnels")
+            return
+        }
+        if s.httpAddr == "" {
+            reject("Hostnames are not enabled on this relay")
+            return
+        }
+        hostname, err := normalizeHostname(req.Hostname)
+        if err != nil {
+            reject(err.Error())
+            return
+        }
+        req.Hostname = hostname
+    }
+
+    acl, err := parseSourceACL(req.AllowCIDRs, req.DenyCIDRs)
+    if err != nil {
+        reject(err.Error())
+        return
+    }
+
+    credentials, err := newHTTPCredentials(req)
+    if err != nil {
+        reject(err.Error())
+        return
+    }
+    if credentials.enabled() && req.Protocol != protocol.ProtocolHTTP {
+        reject("Credentials are only supported for HTTP tunnels")
+        return
+    }
+
+    if len(req.OIDCAllow) > 0 {
+        if req.Protocol != protocol.ProtocolHTTP {
+            reject("OIDC login is only supported for HTTP tunnels")
+            return
+        }
+        if s.oidc == nil {
+            reject("OIDC login is not configured on this relay")
+            return
+        }
+        if req.Hostname == "" {
+            reject("OIDC login needs a hostname, browsers share cookies between the relay's ports")
+            return
+        }
+    }
+
+    if err := validateBalance(req); err != nil {
+        reject(err.Error())
+        return
+    }
+    // Compression applies to data frames, which QUIC clients don't send
+    if _, ok := conn.(streamOpener); ok && req.Compression != "" {
+        reject("Compression is not supported over QUIC, user connections get streams of their own")
+        return
+    }
+
+    limits, err := s.tunnelLimits(req)
+    if err != nil {
+        reject(err.Error())
+        return
+    }
+
+    // Hold the client to its account
+    var acct *account
+    if len(s.accounts) > 0 {
+        if acct, err = s.authenticate(req.Token); err != nil {
+            log.Printf("Rejected client %s: %v", clientAddr, err)
+            reject(err.Error())
+            return
+        }
+        identity = acct.Name
+    }
+
+    if err := s.quota.add(identity, 0); err != nil {
+        log.Printf("Rejected client %s: %v", clientAddr, err)
+        reject(fmt.Sprintf("Quota exhausted: %v", err))
+        return
+    }
+
+    // Clients of an existing pool add to its tunnel instead of opening one
+    if err := validatePoolSecret(acct, req); err != nil {
+        reject(err.Error())
+        return
+    }
+    if req.Pool != "" && s.joinPool(conn, acct, req, reject) {
+        return
+    }
+
+    if (req.Reserve || req.Release) && (acct == nil || s.reservations == nil) {
+        reject("Reservations are not enabled on this relay")
+        return
+    }
+    if req.Reserve && req.Release {
+        reject("A tunnel can't both reserve and release")
+        return
+    }
+    if req.Release {
+        if err := s.unreserve(acct, req.Port, req.Hostname); err != nil {
+            reject(err.Error())
+            return
+        }
+    }
+    if err := s.checkReservations(acct, req.Port, req.Hostname); err != nil {
+        log.Printf("Rejected client %s: %v", clientAddr, err)
+        reject(err.Error())
+        return
+    }
+    if err := s.checkRegistration(acct, req); err != nil {
+        log.Printf("Rejected client %s: %v", clientAddr, err)
+        reject(err.Error())
         return
     }
 
-    // Allocate a port
-    port, err := s.allocatePort()
+    // Allocate a port, leaving reserved ones to whoever asks for them
+    allowed := func(port int) bool {
+        return s.assignablePort(acct, port)
+    }
+    if req.Port != 0 {
+        allowed = acct.allowsPort
+    }
+    port, err := s.allocatePort(req.Port, allowed)
     if err != nil {
         log.Printf("Failed to allocate port for %s: %v", clientAddr, err)
-        sendErrorResponse(conn, err.Error())
-        conn.Close()
+        s.releaseTunnel(acct)
+        reject(err.Error())
         return
     }
 
+    if req.Hostname != "" {
+        if err := s.claimHostname(req.Hostname, port); err != nil {
+            s.releasePort(port)
+            s.releaseTunnel(acct)
+            reject(err.Error())
+            return
+        }
+    }
+
+    if req.Reserve {
+        if err := s.reserve(acct, port, req.Hostname); err != nil {
+            if req.Hostname != "" {
+                s.releaseHostname(req.Hostname)
+            }
+            s.releasePort(port)
+            s.releaseTunnel(acct)
+            reject(err.Error())
+            return
+        }
+    }
+
     // Create port listener
     listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
     if err != nil {
         log.Printf("Failed to create listener for port %d: %v", port, err)
+        if req.Hostname != "" {
+            s.releaseHostname(req.Hostname)
+        }
         s.releasePort(port)
-        sendErrorResponse(conn, fmt.Sprintf("Failed to bind to port %d", port))
-        conn.Close()
+        s.releaseTunnel(acct)
+        reject(fmt.Sprintf("Failed to bind to port %d", port))
         return
     }
 
     // Initialize client connection
     client := &clientConnection{
-        conn:       conn,
-        targetHost: req.LocalHost,
-        targetPort: req.LocalPort,
-        userConns:  make(map[string]net.Conn),
+        conn:            conn,
+        frames:          frame.NewEncoder(conn),
+        listener:        listener,
+        targetHost:      req.LocalHost,
+        targetPort:      req.LocalPort,
+        userConns:       make(map[string]net.Conn),
+        sourceACL:       acl,
+        limiter:         newTunnelLimiter(limits),
+        stats:           &tunnelCounters{},
+        account:         acct,
+        identity:        identity,
+        inboundLimiter:  newByteLimiter(limits.InboundRate),
+        outboundLimiter: newByteLimiter(limits.OutboundRate),
+        protocol:        req.Protocol,
+        hostHeader:      req.HostHeader,
+        requestHeaders:  req.RequestHeaders,
+        responseHeaders: req.ResponseHeaders,
+        credentials:     credentials,
+        oidcAllow:       req.OIDCAllow,
+        hostname:        req.Hostname,
+
+        compression:          negotiateCompression(req),
+        compressionThreshold: req.CompressionThreshold,
+    }
+    if streams, ok := conn.(streamOpener); ok {
+        client.streams = streams
+    }
+    if req.Pool != "" {
+        client.pool = newClientPool(poolKeyFor(acct, req.Pool), req, client)
+    }
+    // Reject disallowed users before the client ever hears of them
+    client.listener = &filteredListener{
+        Listener: listener,
+        admit: func(conn net.Conn) (net.Conn, bool) {
+            return s.admitUser(port, client, conn, conn.RemoteAddr().String())
+        },
+    }
+    if client.protocol == protocol.ProtocolHTTP {
+        client.httpListener = newHTTPListener(client.listener)
+        client.httpServer = s.newHTTPServer(port, client)
     }
 
     // Save the client connection
     s.clientsMutex.Lock()
+    if req.Pool != "" {
+        if _, taken := s.pools[client.pool.key]; taken {
+            s.clientsMutex.Unlock()
+            listener.Close()
+            if req.Hostname != "" {
+                s.releaseHostname(req.Hostname)
+            }
+            s.releasePort(port)
+            s.releaseTunnel(acct)
+            reject(fmt.Sprintf("Pool %s was created meanwhile, register again to join it", req.Pool))
+            return
+        }
+        s.pools[client.pool.key] = port
+    }
     s.clients[port] = client
     s.clientsMutex.Unlock()
 
     // Send success response with assigned port
     resp := protocol.RegistrationResponse{
-        Success:    true,
-        PublicPort: port,
+        Success:     true,
+        PublicPort:  port,
+        Hostname:    req.Hostname,
+        Compression: client.compression,
     }
-    encoder := json.NewEncoder(conn)
-    if err := encoder.Encode(resp); err != nil {
+    if err := client.frames.Encode(resp); err != nil {
         log.Printf("Error sending response to client %s: %v", clientAddr, err)
-        s.cleanupClient(port, listener)
+        s.cleanupClient(port)
         return
     }
 
-    log.Printf("Assigned port %d to client %s for service %s:%d", 
-        port, clientAddr, req.LocalHost, req.LocalPort)
+    log.Printf("Assigned port %d to client %s for %s service %s:%d", 
+        port, clientAddr, req.Protocol, req.LocalHost, req.LocalPort)
+    s.audit.Log(audit.Event{
+        Type:     audit.RegistrationAccepted,
+        Identity: identity,
+        SourceIP: sourceIP,
+        Port:     port,
+        Hostname: req.Hostname,
+        Pool:     req.Pool,
+        Protocol: req.Protocol,
+        Target:   net.JoinHostPort(req.LocalHost, strconv.Itoa(req.LocalPort)),
+    })
 
     // Start a goroutine to handle client protocol messages
     go s.handleClientCommunication(port, client)
 
     // Start accepting user connections on the assigned port
-    go s.acceptUserConnections(port, listener, client)
+    if client.protocol == protocol.ProtocolHTTP {
+        go s.serveHTTP(port, client)
+    } else {
+        go s.acceptUserConnections(port, client)
+    }
 }
 
 // handleClientCommunication processes messages from the client
@@ -192,7 +632,7 @@ func (s *RelayServer) handleClientCommunication(port int, client *clientConnecti
             if err != io.EOF {
                 log.Printf("Error decoding message from client on port %d: %v", port, err)
             }
-            s.cleanupClient(port, nil)
+            s.dropClient(port, client)
             return
         }
 
@@ -203,84 +643,179 @@ func (s *RelayServer) handleClientCommunication(port int, client *clientConnecti
             if msg.UserID == "" || msg.Data == nil {
                 continue
             }
+            client.stats.wireBytesOut.Add(int64(len(msg.Data)))
+            data, err := frameData(msg)
+            if err != nil {
+                log.Printf("Dropping user %s on port %d: %v", msg.UserID, port, err)
+                msg.Data.Release()
+                client.userConnMutex.Lock()
+                if userConn, exists := client.userConns[msg.UserID]; exists {
+                    userConn.Close()
+                    delete(client.userConns, msg.UserID)
+                }
+                client.userConnMutex.Unlock()
+                continue
+            }
 
+            // The user's writer shapes and writes it, see writeToUser
             client.userConnMutex.RLock()
             userConn, exists := client.userConns[msg.UserID]
             client.userConnMutex.RUnlock()
+            halfCloser, ok := userConn.(*halfCloseConn)
+            if !exists || !ok {
+                releaseFrame(msg, data)
+                continue
+            }
+            if !halfCloser.queue(msg, data) {
+                // Closing the user tells the client, see handleUserData
+                log.Printf("Dropping user %s on port %d: more than %d bytes waiting for it", msg.UserID, port, maxQueuedBytes)
+                releaseFrame(msg, data)
+                client.userConnMutex.Lock()
+                delete(client.userConns, msg.UserID)
+                client.userConnMutex.Unlock()
+                halfCloser.Close()
+                continue
+            }
+            halfCloser.updateFlow(client, msg.UserID)
 
-            if exists {
-                if _, err := userConn.Write(msg.Data); err != nil {
-                    log.Printf("Error writing to user %s: %v", msg.UserID, err)
-                    client.userConnMutex.Lock()
-                    userConn.Close()
-                    delete(client.userConns, msg.UserID)
-                    client.userConnMutex.Unlock()
-                }
+        case protocol.MessageTypeConnectResult:
+            // Client could not reach its local service for a user
+            if msg.UserID == "" || msg.Error == "" {
+                continue
+            }
+            s.connectFailed(port, client, msg.UserID, msg.Error)
+
+        case protocol.MessageTypeHealth:
+            // Client's local service went down or came back
+            client.setHealth(port, msg.Error)
+
+        case protocol.MessageTypeCloseWrite:
+            // Client finished writing to a user, the user may still write
+            client.userConnMutex.RLock()
+            userConn, exists := client.userConns[msg.UserID]
+            client.userConnMutex.RUnlock()
+            if halfCloser, ok := userConn.(*halfCloseConn); exists && ok {
+                halfCloser.queue(msg, nil) // after the data sent before it
             }
 
         case protocol.MessageTypePing:
             // Handle ping to keep connection alive
-            encoder := json.NewEncoder(client.conn)
             pong := protocol.ClientMessage{Type: protocol.MessageTypePong}
-            if err := encoder.Encode(pong); err != nil {
+            if err := client.frames.Encode(pong); err != nil {
                 log.Printf("Error sending pong to client on port %d: %v", port, err)
             }
 
+        case protocol.MessageTypeOpen:
+            // Client wants the relay to dial a destination for it
+            if msg.UserID == "" || msg.Target == "" {
+                continue
+            }
+            go s.handleOpenRequest(port, client, msg)
+
         case protocol.MessageTypeDisconnect:
+            // Client closed a single user connection
+            if msg.UserID != "" {
+                client.userConnMutex.Lock()
+                userConn, exists := client.userConns[msg.UserID]
+                delete(client.userConns, msg.UserID)
+                client.userConnMutex.Unlock()
+                if halfCloser, ok := userConn.(*halfCloseConn); exists && ok {
+                    halfCloser.queue(msg, nil) // after the data sent before it
+                } else if exists {
+                    userConn.Close()
+                }
+                continue
+            }
+
             // Client wants to disconnect
             log.Printf("Client on port %d requested disconnect", port)
-            s.cleanupClient(port, nil)
+            s.dropClient(port, client)
             return
         }
     }
 }
 
 // acceptUserConnections handles incoming connections on the client's assigned public port
-func (s *RelayServer) acceptUserConnections(port int, listener net.Listener, client *clientConnection) {
-    defer listener.Close()
+func (s *RelayServer) acceptUserConnections(port int, client *clientConnection) {
+    defer client.listener.Close()
 
     for {
-        userConn, err := listener.Accept()
+        userConn, err := client.listener.Accept()
         if err != nil {
             select {
             case <-s.shutdown:
                 return // Server is shutting down
+            case <-s.draining:
+                return // Server is draining, no new users
             default:
+                if errors.Is(err, net.ErrClosed) {
+                    return // Client went away
+                }
                 log.Printf("Error accepting user connection on port %d: %v", port, err)
                 continue
             }
         }
 
-        userAddr := userConn.RemoteAddr().String()
-        log.Printf("New user connection from %s to port %d", userAddr, port)
+        s.startUserSession(port, client, userConn, userConn.RemoteAddr().String(), userConn.LocalAddr().String())
+    }
+}
 
-        // Generate a unique ID for this user connection
-        userID := fmt.Sprintf("%s-%d", userAddr, time.Now().UnixNano())
+// startUserSession announces a new user connection to the client and starts
+// forwarding its data. userAddr is the address of the public user and
+// publicAddr the address it connected to, which differ from the addresses of
+// userConn for connections forwarded by other relays.
+func (s *RelayServer) startUserSession(port int, client *clientConnection, userConn net.Conn, userAddr, publicAddr string) error {
+    log.Printf("New user connection from %s to port %d", userAddr, port)
+
+    // Generate a unique ID for this user connection
+    userID := fmt.Sprintf("%s-%d", userAddr, time.Now().UnixNano())
+    if client.pool != nil {
+        // Pick whichever healthy client of the pool takes this user
+        member := client.pool.pick()
+        if member == nil {
+            return s.turnAway(port, client, userConn, userAddr)
+        }
+        client = member
+    }
+    if !client.healthy() {
+        return s.turnAway(port, client, userConn, userAddr)
+    }
+    if client.streams != nil {
+        return s.startStreamSession(port, client, userConn, userID, userAddr, publicAddr)
+    }
 
-        // Save user connection
+    // Save user connection
+    halfCloser := newHalfCloseConn(userConn)
+    client.userConnMutex.Lock()
+    client.userConns[userID] = halfCloser
+    client.userConnMutex.Unlock()
+
+    // Notify client about new connection
+    connectMsg := protocol.ClientMessage{
+        Type:       protocol.MessageTypeConnect,
+        UserID:     userID,
+        SourceAddr: userAddr,
+        DestAddr:   publicAddr,
+    }
+    if err := client.frames.Encode(connectMsg); err != nil {
+        log.Printf("Error notifying client of new connection: %v", err)
         client.userConnMutex.Lock()
-        client.userConns[userID] = userConn
+        delete(client.userConns, userID)
         client.userConnMutex.Unlock()
-
-        // Notify client about new connection
-        connectMsg := protocol.ClientMessage{
-            Type:   protocol.MessageTypeConnect,
-            UserID: userID,
-        }
-        encoder := json.NewEncoder(client.conn)
-        if err := encoder.Encode(connectMsg); err != nil {
-            log.Printf("Error notifying client of new connection: %v", err)
-            userConn.Close()
-            continue
-        }
-
-        // Start a goroutine to handle user data
-        go s.handleUserData(port, client, userID, userConn)
+        userConn.Close()
+        return err
     }
+
+    // Start goroutines to handle user data in both directions
+    s.activeUsers.add()
+    go s.handleUserData(port, client, userID, halfCloser)
+    go s.writeToUser(port, client, userID, halfCloser)
+    return nil
 }
 
 // handleUserData forwards data from the user connection to the client
-func (s *RelayServer) handleUserData(port int, client *clientConnection, userID string, userConn net.Conn) {
+func (s *RelayServer) handleUserData(port int, client *clientConnection, userID string, userConn *halfCloseConn) {
+    defer s.activeUsers.done()
     defer func() {
         userConn.Close()
         client.userConnMutex.Lock()
@@ -292,48 +827,75 @@ func (s *RelayServer) handleUserData(port int, client *clientConnection, userID
             Type:   protocol.MessageTypeDisconnect,
             UserID: userID,
         }
-        encoder := json.NewEncoder(client.conn)
-        encoder.Encode(disconnectMsg)
+        client.frames.Encode(disconnectMsg)
     }()
 
-    buffer := make([]byte, 4096)
+    compressor := client.newCompressor()
+    buffer := bufpool.Get(s.readSize)
+    defer bufpool.Put(buffer)
     for {
         // Read data from user
         n, err := userConn.Read(buffer)
+        if err == io.EOF && !userConn.userFinished() {
+            // Keep the response flowing until the client finishes too
+            if err := sendCloseWrite(client, userID); err != nil {
+                log.Printf("Error forwarding close from user %s to client: %v", userID, err)
+                return
+            }
+            <-userConn.closed
+            return
+        }
         if err != nil {
             if err != io.EOF {
                 log.Printf("Error reading from user %s: %v", userID, err)
             }
             return
         }
+        if !s.accountTraffic(port, client, n, true) {
+            return
+        }
 
         // Forward data to client
+        data, compressed := compressor.Compress(buffer[:n])
+        client.stats.wireBytesIn.Add(int64(len(data)))
         dataMsg := protocol.ClientMessage{
-            Type:   protocol.MessageTypeData,
-            UserID: userID,
-            Data:   buffer[:n],
+            Type:       protocol.MessageTypeData,
+            UserID:     userID,
+            Data:       data,
+            Compressed: compressed,
         }
-        encoder := json.NewEncoder(client.conn)
-        if err := encoder.Encode(dataMsg); err != nil {
+        if err := client.frames.Encode(dataMsg); err != nil {
             log.Printf("Error forwarding user data to client: %v", err)
             return
         }
     }
 }
 
-// allocatePort finds and reserves an available port
-func (s *RelayServer) allocatePort() (int, error) {
+// allocatePort finds and reserves an available port. A non-zero requested
+// port is the only candidate, otherwise any port allowed accepts is.
+func (s *RelayServer) allocatePort(requested int, allowed func(port int) bool) (int, error) {
     s.portsMutex.Lock()
     defer s.portsMutex.Unlock()
 
-    if len(s.availablePorts) == 0 {
-        return 0, fmt.Errorf("no available ports")
+    // Take the first available port that no other relay instance holds
+    for i, port := range s.availablePorts {
+        if (requested != 0 && port != requested) || !allowed(port) {
+            continue
+        }
+        if err := s.claimPort(port); err != nil {
+            if errors.Is(err, cluster.ErrPortClaimed) {
+                continue
+            }
+            return 0, err
+        }
+        s.availablePorts = append(s.availablePorts[:i:i], s.availablePorts[i+1:]...)
+        return port, nil
     }
 
-    // Take the first available port
-    port := s.availablePorts[0]
-    s.availablePorts = s.availablePorts[1:]
-    return port, nil
+    if requested != 0 {
+        return 0, fmt.Errorf("port %d is not available", requested)
+    }
+    return 0, fmt.Errorf("no available ports")
 }
 
 // releasePort returns a port to the available pool
@@ -341,16 +903,12 @@ func (s *RelayServer) releasePort(port int) {
     s.portsMutex.Lock()
     defer s.portsMutex.Unlock()
 
+    s.unclaimPort(port)
     s.availablePorts = append(s.availablePorts, port)
 }
 
 // cleanupClient releases all resources associated with a client
-func (s *RelayServer) cleanupClient(port int, listener net.Listener) {
-    // Close the listener if provided
-    if listener != nil {
-        listener.Close()
-    }
-
+func (s *RelayServer) cleanupClient(port int) {
     // Lock for client map modifications
     s.clientsMutex.Lock()
     defer s.clientsMutex.Unlock()
@@ -360,21 +918,39 @@ func (s *RelayServer) cleanupClient(port int, listener net.Listener) {
         return
     }
 
-    // Close client connection
-    client.conn.Close()
+    // Stop accepting users
+    client.listener.Close()
+    if client.httpServer != nil {
+        client.httpServer.Close()
+    }
 
-    // Close all user connections
-    client.userConnMutex.Lock()
-    for _, conn := range client.userConns {
-        conn.Close()
+    // Close the clients serving the tunnel and their users
+    members := []*clientConnection{client}
+    if client.pool != nil {
+        members = client.pool.close()
+        delete(s.pools, client.pool.key)
+    }
+    for _, member := range members {
+        member.conn.Close()
+        member.closeUsers()
+        s.releaseTunnel(member.account)
     }
-    client.userConnMutex.Unlock()
 
     // Remove client from map and release port
     delete(s.clients, port)
     s.releasePort(port)
+    if client.hostname != "" {
+        s.releaseHostname(client.hostname)
+    }
 
     log.Printf("Cleaned up client on port %d", port)
+    s.audit.Log(audit.Event{
+        Type:     audit.TunnelClosed,
+        Identity: client.identity,
+        SourceIP: clientIdentity(client.conn),
+        Port:     port,
+        Hostname: client.hostname,
+    })
 }
 
 // sendErrorResponse sends an error response to the client
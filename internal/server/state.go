@@ -0,0 +1,55 @@
+package server
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/state"
+)
+
+// stateSaveInterval is how often quota usage is written to the state store
+const stateSaveInterval = 10 * time.Second
+
+// SetStateStore keeps reservations and quota usage in store so they survive
+// restarts. Reservations are only available with a store. Account tokens
+// and audit events already live in their own files. Must be called before
+// Start.
+func (s *RelayServer) SetStateStore(store state.Store) {
+    s.store = store
+    s.reservations = &reservations{store: store}
+}
+
+// loadState reads what was saved before the relay restarted
+func (s *RelayServer) loadState() error {
+    if err := s.reservations.load(); err != nil {
+        return fmt.Errorf("failed to load reservations: %w", err)
+    }
+    if s.quota != nil {
+        if err := s.quota.load(s.store); err != nil {
+            return fmt.Errorf("failed to load quota usage: %w", err)
+        }
+    }
+    return nil
+}
+
+// saveStatePeriodically writes quota usage until the relay shuts down
+func (s *RelayServer) saveStatePeriodically() {
+    ticker := time.NewTicker(stateSaveInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            s.saveState()
+        case <-s.shutdown:
+            return
+        }
+    }
+}
+
+// saveState writes quota usage that changed since the last save
+func (s *RelayServer) saveState() {
+    if s.store != nil && s.quota != nil {
+        s.quota.save(s.store)
+    }
+}
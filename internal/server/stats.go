@@ -0,0 +1,111 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "sort"
+    "sync/atomic"
+)
+
+// tunnelCounters counts what happened to the users of a tunnel
+type tunnelCounters struct {
+    acceptedConns     atomic.Int64
+    rejectedSource    atomic.Int64
+    rejectedRate      atomic.Int64
+    rejectedCap       atomic.Int64
+    rejectedRequests  atomic.Int64
+    rejectedUnhealthy atomic.Int64 // turned away while the local service was down
+    bytesIn           atomic.Int64
+    bytesOut          atomic.Int64
+
+    // Bytes as carried to and from the client, after compression
+    wireBytesIn  atomic.Int64
+    wireBytesOut atomic.Int64
+
+    // Users the client could not connect to its local service
+    dialFailures  atomic.Int64
+    lastDialError atomic.Value // string
+}
+
+// dialError returns the last reason the client gave for not reaching its
+// local service
+func (c *tunnelCounters) dialError() string {
+    reason, _ := c.lastDialError.Load().(string)
+    return reason
+}
+
+// TunnelStats is a snapshot of a tunnel's counters
+type TunnelStats struct {
+    Port              int    `json:"port"`
+    Protocol          string `json:"protocol"`
+    ActiveConns       int64  `json:"active_conns"`
+    AcceptedConns     int64  `json:"accepted_conns"`
+    RejectedSource    int64  `json:"rejected_source"`
+    RejectedRate      int64  `json:"rejected_rate"`
+    RejectedCap       int64  `json:"rejected_cap"`
+    RejectedRequests  int64  `json:"rejected_requests"`
+    RejectedUnhealthy int64  `json:"rejected_unhealthy"`
+    BytesIn           int64  `json:"bytes_in"`
+    BytesOut          int64  `json:"bytes_out"`
+    WireBytesIn       int64  `json:"wire_bytes_in"`
+    WireBytesOut      int64  `json:"wire_bytes_out"`
+    Compression       string `json:"compression,omitempty"`
+    DialFailures      int64  `json:"dial_failures"`
+    LastDialError     string `json:"last_dial_error,omitempty"`
+
+    // Why the tunnel turns users away, set while no client of it can reach
+    // its local service
+    LocalDown string `json:"local_down,omitempty"`
+
+    // Pooled tunnels only, the pool name and how many clients serve it
+    Pool    string `json:"pool,omitempty"`
+    Clients int    `json:"clients,omitempty"`
+}
+
+// Stats returns the counters of every tunnel registered with this relay
+func (s *RelayServer) Stats() []TunnelStats {
+    s.clientsMutex.RLock()
+    defer s.clientsMutex.RUnlock()
+
+    stats := make([]TunnelStats, 0, len(s.clients))
+    for port, client := range s.clients {
+        var pool string
+        var clients int
+        if client.pool != nil {
+            pool, clients = client.pool.name, client.pool.size()
+        }
+        stats = append(stats, TunnelStats{
+            Port:              port,
+            Protocol:          client.protocol,
+            ActiveConns:       client.limiter.activeConns.Load(),
+            AcceptedConns:     client.stats.acceptedConns.Load(),
+            RejectedSource:    client.stats.rejectedSource.Load(),
+            RejectedRate:      client.stats.rejectedRate.Load(),
+            RejectedCap:       client.stats.rejectedCap.Load(),
+            RejectedRequests:  client.stats.rejectedRequests.Load(),
+            RejectedUnhealthy: client.stats.rejectedUnhealthy.Load(),
+            BytesIn:           client.stats.bytesIn.Load(),
+            BytesOut:          client.stats.bytesOut.Load(),
+            WireBytesIn:       client.stats.wireBytesIn.Load(),
+            WireBytesOut:      client.stats.wireBytesOut.Load(),
+            Compression:       client.compression,
+            DialFailures:      client.stats.dialFailures.Load(),
+            LastDialError:     client.stats.dialError(),
+            LocalDown:         client.downReason(),
+            Pool:              pool,
+            Clients:           clients,
+        })
+    }
+    sort.Slice(stats, func(i, j int) bool {
+        return stats[i].Port < stats[j].Port
+    })
+    return stats
+}
+
+// StatsHandler serves Stats as JSON
+func (s *RelayServer) StatsHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(s.Stats())
+    })
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// viaHostnameContextKey marks requests that reached a tunnel through its
+// hostname on the shared HTTP address
+type viaHostnameContextKey struct{}
+
+// SetHTTPAddr serves HTTP tunnels that registered a hostname on a shared
+// address, routing requests by their Host header. Only tunnels of this
+// relay are reachable there. Must be called before Start.
+func (s *RelayServer) SetHTTPAddr(addr string) {
+    s.httpAddr = addr
+}
+
+// SetHTTPPublicURL sets how users reach the shared HTTP address when a
+// proxy or TLS terminator sits in front of it, as a URL without host such
+// as "https://" or "https://:8443". Tunnel hostnames are filled in. Must be
+// called before Start.
+func (s *RelayServer) SetHTTPPublicURL(rawURL string) error {
+    publicURL, err := url.Parse(rawURL)
+    if err != nil {
+        return fmt.Errorf("invalid public HTTP URL: %w", err)
+    }
+    if publicURL.Scheme != "http" && publicURL.Scheme != "https" {
+        return fmt.Errorf("public HTTP URL %q must be http:// or https://", rawURL)
+    }
+    if publicURL.Hostname() != "" || strings.Trim(publicURL.Path, "/") != "" || publicURL.RawQuery != "" {
+        return fmt.Errorf("public HTTP URL %q may only have a scheme and a port, the tunnel hostname is filled in", rawURL)
+    }
+    s.httpPublicURL = publicURL
+    return nil
+}
+
+// tunnelURL returns the URL users reach the tunnel serving hostname at
+func (s *RelayServer) tunnelURL(hostname string) string {
+    scheme, port := "http", ""
+    if s.httpPublicURL != nil {
+        scheme, port = s.httpPublicURL.Scheme, s.httpPublicURL.Port()
+    } else if _, addrPort, err := net.SplitHostPort(s.httpAddr); err == nil {
+        port = addrPort
+    }
+    if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+        port = ""
+    }
+    if port != "" {
+        return scheme + "://" + net.JoinHostPort(hostname, port)
+    }
+    return scheme + "://" + hostname
+}
+
+// publicHTTPS reports whether users reach the shared HTTP address over TLS
+func (s *RelayServer) publicHTTPS() bool {
+    return s.httpPublicURL != nil && s.httpPublicURL.Scheme == "https"
+}
+
+// startVirtualHosts starts the shared HTTP server
+func (s *RelayServer) startVirtualHosts() error {
+    listener, err := net.Listen("tcp", s.httpAddr)
+    if err != nil {
+        return fmt.Errorf("failed to start HTTP listener: %w", err)
+    }
+
+    s.vhostServer = &http.Server{
+        Handler:           http.HandlerFunc(s.routeVirtualHost),
+        ReadHeaderTimeout: 30 * time.Second,
+    }
+    go func() {
+        err := s.vhostServer.Serve(listener)
+        if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+            log.Printf("HTTP server on %s stopped: %v", s.httpAddr, err)
+        }
+    }()
+
+    log.Printf("Serving tunnel hostnames on %s", s.httpAddr)
+    return nil
+}
+
+// routeVirtualHost passes a request to the tunnel serving its hostname
+func (s *RelayServer) routeVirtualHost(w http.ResponseWriter, r *http.Request) {
+    hostname := r.Host
+    if host, _, err := net.SplitHostPort(hostname); err == nil {
+        hostname = host
+    }
+    hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+
+    s.hostsMutex.RLock()
+    port, exists := s.hosts[hostname]
+    s.hostsMutex.RUnlock()
+
+    var client *clientConnection
+    if exists {
+        s.clientsMutex.RLock()
+        client = s.clients[port]
+        s.clientsMutex.RUnlock()
+    }
+    if client == nil {
+        http.Error(w, "Tunnel not found", http.StatusNotFound)
+        return
+    }
+
+    // The shared listener can't admit connections by tunnel, one connection
+    // may carry requests for several, so each request is admitted like a
+    // user connection on the tunnel's own port and holds a slot while it
+    // runs
+    release, err := s.admitSource(port, client, r.RemoteAddr)
+    switch {
+    case errors.Is(err, errSourceDenied):
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    case errors.Is(err, errConnRate):
+        w.Header().Set("Retry-After", "1")
+        http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+        return
+    case err != nil:
+        http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+        return
+    }
+    defer release()
+
+    ctx := context.WithValue(r.Context(), viaHostnameContextKey{}, true)
+    client.httpServer.Handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// normalizeHostname validates a hostname a client asked for
+func normalizeHostname(hostname string) (string, error) {
+    hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+    if hostname == "" || len(hostname) > 253 {
+        return "", fmt.Errorf("invalid hostname %q", hostname)
+    }
+    for _, label := range strings.Split(hostname, ".") {
+        if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+            return "", fmt.Errorf("invalid hostname %q", hostname)
+        }
+        for _, c := range label {
+            if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+                return "", fmt.Errorf("invalid hostname %q", hostname)
+            }
+        }
+    }
+    return hostname, nil
+}
+
+// claimHostname routes hostname to the tunnel on port
+func (s *RelayServer) claimHostname(hostname string, port int) error {
+    s.hostsMutex.Lock()
+    defer s.hostsMutex.Unlock()
+
+    if _, taken := s.hosts[hostname]; taken {
+        return fmt.Errorf("hostname %s is already in use", hostname)
+    }
+    s.hosts[hostname] = port
+    return nil
+}
+
+// releaseHostname stops routing hostname
+func (s *RelayServer) releaseHostname(hostname string) {
+    s.hostsMutex.Lock()
+    delete(s.hosts, hostname)
+    s.hostsMutex.Unlock()
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/euphoricair7/tun/pkg/protocol"
+)
+
+// startVhostRelay starts a relay serving an HTTP tunnel on testHostname
+// through the shared HTTP address, registered with req
+func startVhostRelay(t *testing.T, req protocol.RegistrationRequest) (*testClient, string) {
+    t.Helper()
+    httpAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+    s := startRelay(t, freePort(t), func(s *RelayServer) {
+        s.SetHTTPAddr(httpAddr)
+    })
+    req.Protocol = protocol.ProtocolHTTP
+    req.Hostname = testHostname
+    return mustRegister(t, s, req), httpAddr
+}
+
+// vhostGet requests / from the tunnel's hostname and returns the status
+func vhostGet(httpAddr string) (int, error) {
+    req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/", nil)
+    if err != nil {
+        return 0, err
+    }
+    req.Host = testHostname
+    client := &http.Client{Timeout: 5 * time.Second}
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    resp.Body.Close()
+    return resp.StatusCode, nil
+}
+
+func TestVirtualHostHonorsConnectionCap(t *testing.T) {
+    client, httpAddr := startVhostRelay(t, protocol.RegistrationRequest{MaxConns: 1})
+
+    first := make(chan int, 1)
+    go func() {
+        status, _ := vhostGet(httpAddr)
+        first <- status
+    }()
+    connect := client.next(protocol.MessageTypeConnect)
+
+    if status, err := vhostGet(httpAddr); err != nil || status != http.StatusServiceUnavailable {
+        t.Fatalf("request over the cap got %d, %v, want %d", status, err, http.StatusServiceUnavailable)
+    }
+
+    // Finishing the first request frees its slot
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypeDisconnect, UserID: connect.UserID})
+    if status := <-first; status != http.StatusBadGateway {
+        t.Fatalf("dropped request got %d, want %d", status, http.StatusBadGateway)
+    }
+    go vhostGet(httpAddr)
+    client.next(protocol.MessageTypeConnect)
+}
+
+func TestVirtualHostHonorsConnectionRate(t *testing.T) {
+    client, httpAddr := startVhostRelay(t, protocol.RegistrationRequest{ConnRate: 1})
+
+    go vhostGet(httpAddr)
+    client.next(protocol.MessageTypeConnect)
+
+    if status, err := vhostGet(httpAddr); err != nil || status != http.StatusTooManyRequests {
+        t.Fatalf("request over the rate got %d, %v, want %d", status, err, http.StatusTooManyRequests)
+    }
+}
+
+func TestVirtualHostHonorsSourceList(t *testing.T) {
+    _, httpAddr := startVhostRelay(t, protocol.RegistrationRequest{DenyCIDRs: []string{"127.0.0.1"}})
+
+    if status, err := vhostGet(httpAddr); err != nil || status != http.StatusForbidden {
+        t.Fatalf("denied source got %d, %v, want %d", status, err, http.StatusForbidden)
+    }
+}
+
+func TestDownServiceIsHiddenBehindAuth(t *testing.T) {
+    client, httpAddr := startVhostRelay(t, protocol.RegistrationRequest{BearerToken: "secret"})
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypeHealth, Error: "connection refused"})
+    client.send(protocol.ClientMessage{Type: protocol.MessageTypePing})
+    client.next(protocol.MessageTypePong) // the relay handled the health message too
+
+    get := func(authorization string) int {
+        req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/", nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        req.Host = testHostname
+        if authorization != "" {
+            req.Header.Set("Authorization", authorization)
+        }
+        resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        return resp.StatusCode
+    }
+
+    if status := get("Bearer secret"); status != http.StatusServiceUnavailable {
+        t.Fatalf("authorized user got %d, want %d", status, http.StatusServiceUnavailable)
+    }
+    if status := get(""); status != http.StatusUnauthorized {
+        t.Fatalf("anonymous user got %d, want %d", status, http.StatusUnauthorized)
+    }
+}
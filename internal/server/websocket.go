@@ -0,0 +1,60 @@
+package server
+
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "time"
+
+    "github.com/euphoricair7/tun/internal/websocket"
+)
+
+// WebSocketPath is where clients open WebSocket control connections
+const WebSocketPath = "/.tun/control"
+
+// SetWebSocketAddr accepts control connections as WebSocket upgrades on
+// addr in addition to the raw TCP registration port, for clients behind
+// firewalls that only let HTTP(S) out. A non-nil tlsConfig serves HTTPS.
+// Must be called before Start.
+func (s *RelayServer) SetWebSocketAddr(addr string, tlsConfig *tls.Config) {
+    s.webSocketAddr = addr
+    s.webSocketTLS = tlsConfig
+}
+
+// startWebSocket starts the WebSocket endpoint
+func (s *RelayServer) startWebSocket() error {
+    listener, err := net.Listen("tcp", s.webSocketAddr)
+    if err != nil {
+        return fmt.Errorf("failed to start WebSocket listener: %w", err)
+    }
+    if s.webSocketTLS != nil {
+        listener = tls.NewListener(listener, s.webSocketTLS)
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc(WebSocketPath, func(w http.ResponseWriter, r *http.Request) {
+        conn, err := websocket.Upgrade(w, r)
+        if err != nil {
+            log.Printf("Rejected WebSocket connection from %s: %v", r.RemoteAddr, err)
+            return
+        }
+        s.handleClientRegistration(conn)
+    })
+
+    s.webSocketServer = &http.Server{
+        Handler:           mux,
+        ReadHeaderTimeout: 30 * time.Second,
+    }
+    go func() {
+        err := s.webSocketServer.Serve(listener)
+        if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+            log.Printf("WebSocket server on %s stopped: %v", s.webSocketAddr, err)
+        }
+    }()
+
+    log.Printf("Accepting WebSocket control connections on %s%s", s.webSocketAddr, WebSocketPath)
+    return nil
+}
@@ -0,0 +1,135 @@
+package state
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+// FileStore keeps data in a single JSON file that is rewritten on every
+// change, which suits the small amount of state a relay has. The file stays
+// readable so operators can inspect and edit it while the relay is stopped.
+type FileStore struct {
+    path    string
+    mutex   sync.RWMutex
+    buckets map[string]map[string]json.RawMessage
+}
+
+// NewFileStore opens the store in the file at path, creating it on the
+// first write
+func NewFileStore(path string) (*FileStore, error) {
+    s := &FileStore{
+        path:    path,
+        buckets: make(map[string]map[string]json.RawMessage),
+    }
+
+    data, err := os.ReadFile(path)
+    switch {
+    case errors.Is(err, os.ErrNotExist):
+    case err != nil:
+        return nil, err
+    default:
+        if err := json.Unmarshal(data, &s.buckets); err != nil {
+            return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+        }
+    }
+    return s, nil
+}
+
+// Get returns the value of key in bucket
+func (s *FileStore) Get(bucket, key string) ([]byte, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    value, exists := s.buckets[bucket][key]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    return append([]byte(nil), value...), nil
+}
+
+// Put sets the value of key in bucket and writes the file
+func (s *FileStore) Put(bucket, key string, value []byte) error {
+    if !json.Valid(value) {
+        return fmt.Errorf("value for %s/%s is not JSON", bucket, key)
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.buckets[bucket] == nil {
+        s.buckets[bucket] = make(map[string]json.RawMessage)
+    }
+    previous, existed := s.buckets[bucket][key]
+    s.buckets[bucket][key] = append(json.RawMessage(nil), value...)
+
+    if err := s.save(); err != nil {
+        if existed {
+            s.buckets[bucket][key] = previous
+        } else {
+            delete(s.buckets[bucket], key)
+        }
+        return err
+    }
+    return nil
+}
+
+// Delete removes key from bucket and writes the file
+func (s *FileStore) Delete(bucket, key string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    previous, existed := s.buckets[bucket][key]
+    if !existed {
+        return nil
+    }
+    delete(s.buckets[bucket], key)
+
+    if err := s.save(); err != nil {
+        s.buckets[bucket][key] = previous
+        return err
+    }
+    return nil
+}
+
+// List returns all values in bucket
+func (s *FileStore) List(bucket string) (map[string][]byte, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    values := make(map[string][]byte, len(s.buckets[bucket]))
+    for key, value := range s.buckets[bucket] {
+        values[key] = append([]byte(nil), value...)
+    }
+    return values, nil
+}
+
+// save replaces the file so a crash never leaves it half written
+func (s *FileStore) save() error {
+    data, err := json.MarshalIndent(s.buckets, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(s.path), ".tun-state-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), s.path)
+}
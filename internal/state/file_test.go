@@ -0,0 +1,117 @@
+package state
+
+import (
+    "bytes"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestFileStoreReloads(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state.json")
+    s, err := NewFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Put("reservations", "port:8080", []byte(`{"account":"a"}`)); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Put("reservations", "port:8081", []byte(`{"account":"b"}`)); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Delete("reservations", "port:8081"); err != nil {
+        t.Fatal(err)
+    }
+
+    // A relay restarting opens the same file
+    s, err = NewFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    value, err := s.Get("reservations", "port:8080")
+    if err != nil || compact(t, value) != `{"account":"a"}` {
+        t.Fatalf("Get = %q, %v", value, err)
+    }
+    if _, err := s.Get("reservations", "port:8081"); err != ErrNotFound {
+        t.Fatalf("deleted key: %v, want ErrNotFound", err)
+    }
+}
+
+func TestFileStoreMissingFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state.json")
+    s, err := NewFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    values, err := s.List("reservations")
+    if err != nil || len(values) != 0 {
+        t.Fatalf("List = %v, %v", values, err)
+    }
+    if _, err := os.Stat(path); !os.IsNotExist(err) {
+        t.Fatalf("opening the store created the file: %v", err)
+    }
+}
+
+func TestFileStoreRejectsCorruptFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "state.json")
+    if err := os.WriteFile(path, []byte(`{"reservations": {`), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := NewFileStore(path); err == nil {
+        t.Fatal("a truncated file was accepted")
+    }
+}
+
+func TestFileStoreWritesAtomically(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "state.json")
+    s, err := NewFileStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Put("quota", "1.2.3.4", []byte(`1`)); err != nil {
+        t.Fatal(err)
+    }
+    before, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Writes that fail leave the file and the store as they were
+    if err := s.Put("quota", "1.2.3.4", []byte(`not json`)); err == nil {
+        t.Fatal("a value that is not JSON was accepted")
+    }
+    blocked := filepath.Join(dir, "blocked")
+    if err := os.MkdirAll(filepath.Join(blocked, "entry"), 0o700); err != nil {
+        t.Fatal(err)
+    }
+    s.path = blocked
+    if err := s.Put("quota", "1.2.3.4", []byte(`2`)); err == nil {
+        t.Fatal("replacing a directory succeeded")
+    }
+    after, err := os.ReadFile(path)
+    if err != nil || string(after) != string(before) {
+        t.Fatalf("file changed by failed writes: %q", after)
+    }
+    if value, _ := s.Get("quota", "1.2.3.4"); string(value) != `1` {
+        t.Fatalf("store kept the failed value %q", value)
+    }
+
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 2 {
+        t.Fatalf("temporary files left behind: %v", entries)
+    }
+}
+
+// compact strips the indentation the file adds to values
+func compact(t *testing.T, value []byte) string {
+    var buf bytes.Buffer
+    if err := json.Compact(&buf, value); err != nil {
+        t.Fatal(err)
+    }
+    return buf.String()
+}
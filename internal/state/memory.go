@@ -0,0 +1,61 @@
+package state
+
+import "sync"
+
+// MemoryStore keeps data in memory only, for tests and throwaway relays
+type MemoryStore struct {
+    mutex   sync.RWMutex
+    buckets map[string]map[string][]byte
+}
+
+// NewMemoryStore creates an empty store
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        buckets: make(map[string]map[string][]byte),
+    }
+}
+
+// Get returns the value of key in bucket
+func (s *MemoryStore) Get(bucket, key string) ([]byte, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    value, exists := s.buckets[bucket][key]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    return append([]byte(nil), value...), nil
+}
+
+// Put sets the value of key in bucket
+func (s *MemoryStore) Put(bucket, key string, value []byte) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.buckets[bucket] == nil {
+        s.buckets[bucket] = make(map[string][]byte)
+    }
+    s.buckets[bucket][key] = append([]byte(nil), value...)
+    return nil
+}
+
+// Delete removes key from bucket
+func (s *MemoryStore) Delete(bucket, key string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    delete(s.buckets[bucket], key)
+    return nil
+}
+
+// List returns all values in bucket
+func (s *MemoryStore) List(bucket string) (map[string][]byte, error) {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+
+    values := make(map[string][]byte, len(s.buckets[bucket]))
+    for key, value := range s.buckets[bucket] {
+        values[key] = append([]byte(nil), value...)
+    }
+    return values, nil
+}
@@ -0,0 +1,23 @@
+package state
+
+import "errors"
+
+// ErrNotFound is returned by Get for keys that have no value
+var ErrNotFound = errors.New("key not found")
+
+// Store keeps the relay's durable data, such as reservations and quota
+// usage, so it survives restarts. Values are JSON documents grouped in
+// buckets.
+type Store interface {
+    // Get returns the value of key in bucket or ErrNotFound
+    Get(bucket, key string) ([]byte, error)
+
+    // Put sets the value of key in bucket
+    Put(bucket, key string, value []byte) error
+
+    // Delete removes key from bucket, if it exists
+    Delete(bucket, key string) error
+
+    // List returns all values in bucket by key
+    List(bucket string) (map[string][]byte, error)
+}
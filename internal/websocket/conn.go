@@ -0,0 +1,215 @@
+package websocket
+
+import (
+    "bufio"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+)
+
+// Opcodes from RFC 6455
+const (
+    opContinuation = 0x0
+    opText         = 0x1
+    opBinary       = 0x2
+    opClose        = 0x8
+    opPing         = 0x9
+    opPong         = 0xA
+)
+
+// maxFrameSize bounds the payload of a single frame we accept
+const maxFrameSize = 16 << 20
+
+// Conn is a WebSocket connection used as a byte stream. Every Write is sent
+// as one binary message and Read returns message payloads back to back, so
+// protocols written for TCP run over it unchanged.
+type Conn struct {
+    net.Conn
+    reader   *bufio.Reader
+    isClient bool // clients mask their frames, servers must not
+
+    readMutex sync.Mutex
+    remaining int64 // unread payload bytes of the current data frame
+    masked    bool
+    maskKey   [4]byte
+    maskPos   int
+
+    writeMutex sync.Mutex
+    closeOnce  sync.Once
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, isClient bool) *Conn {
+    return &Conn{
+        Conn:     conn,
+        reader:   reader,
+        isClient: isClient,
+    }
+}
+
+// Read reads message payload, answering pings and ending at a close frame
+func (c *Conn) Read(p []byte) (int, error) {
+    c.readMutex.Lock()
+    defer c.readMutex.Unlock()
+
+    for c.remaining == 0 {
+        if err := c.nextFrame(); err != nil {
+            return 0, err
+        }
+    }
+
+    if int64(len(p)) > c.remaining {
+        p = p[:c.remaining]
+    }
+    n, err := c.reader.Read(p)
+    c.unmask(p[:n])
+    c.remaining -= int64(n)
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return n, err
+}
+
+// nextFrame reads frame headers, handling control frames, until a data
+// frame with payload starts
+func (c *Conn) nextFrame() error {
+    var header [2]byte
+    if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+        return err
+    }
+
+    opcode := header[0] & 0x0F
+    masked := header[1]&0x80 != 0
+    length := int64(header[1] & 0x7F)
+
+    switch length {
+    case 126:
+        var ext [2]byte
+        if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+            return err
+        }
+        length = int64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+            return err
+        }
+        length = int64(binary.BigEndian.Uint64(ext[:]))
+    }
+    if length < 0 || length > maxFrameSize {
+        return fmt.Errorf("websocket frame of %d bytes is too large", length)
+    }
+    if masked == c.isClient {
+        return errors.New("websocket frame has wrong masking")
+    }
+
+    c.masked = masked
+    c.maskPos = 0
+    if masked {
+        if _, err := io.ReadFull(c.reader, c.maskKey[:]); err != nil {
+            return err
+        }
+    }
+
+    switch opcode {
+    case opBinary, opText, opContinuation:
+        c.remaining = length
+        return nil
+    case opPing, opPong, opClose:
+        if length > 125 {
+            return errors.New("websocket control frame is too large")
+        }
+        payload := make([]byte, length)
+        if _, err := io.ReadFull(c.reader, payload); err != nil {
+            return err
+        }
+        c.unmask(payload)
+
+        switch opcode {
+        case opPing:
+            if err := c.writeFrame(opPong, payload); err != nil {
+                return err
+            }
+        case opClose:
+            // Echo the status and end the stream
+            c.closeOnce.Do(func() {
+                c.writeFrame(opClose, payload)
+            })
+            return io.EOF
+        }
+        return nil
+    default:
+        return fmt.Errorf("unknown websocket opcode %d", opcode)
+    }
+}
+
+// unmask applies the current frame's mask to payload bytes read from it
+func (c *Conn) unmask(b []byte) {
+    if !c.masked {
+        return
+    }
+    for i := range b {
+        b[i] ^= c.maskKey[c.maskPos&3]
+        c.maskPos++
+    }
+}
+
+// Write sends p as one binary message
+func (c *Conn) Write(p []byte) (int, error) {
+    if err := c.writeFrame(opBinary, p); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// writeFrame sends a single final frame
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+    header := make([]byte, 0, 14)
+    header = append(header, 0x80|opcode)
+
+    maskBit := byte(0)
+    if c.isClient {
+        maskBit = 0x80
+    }
+    switch {
+    case len(payload) < 126:
+        header = append(header, maskBit|byte(len(payload)))
+    case len(payload) <= 0xFFFF:
+        header = append(header, maskBit|126)
+        header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+    default:
+        header = append(header, maskBit|127)
+        header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+    }
+
+    frame := make([]byte, 0, len(header)+4+len(payload))
+    frame = append(frame, header...)
+    if c.isClient {
+        var key [4]byte
+        if _, err := rand.Read(key[:]); err != nil {
+            return err
+        }
+        frame = append(frame, key[:]...)
+        for i, b := range payload {
+            frame = append(frame, b^key[i&3])
+        }
+    } else {
+        frame = append(frame, payload...)
+    }
+
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+    _, err := c.Conn.Write(frame)
+    return err
+}
+
+// Close sends a close frame and closes the underlying connection
+func (c *Conn) Close() error {
+    c.closeOnce.Do(func() {
+        c.writeFrame(opClose, []byte{0x03, 0xE8}) // 1000, normal closure
+    })
+    return c.Conn.Close()
+}
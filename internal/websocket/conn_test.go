@@ -0,0 +1,201 @@
+package websocket
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+// pipe returns the client and server ends of a WebSocket over net.Pipe
+func pipe(t *testing.T) (*Conn, *Conn) {
+    t.Helper()
+    clientSide, serverSide := net.Pipe()
+    t.Cleanup(func() {
+        clientSide.Close()
+        serverSide.Close()
+    })
+    clientSide.SetDeadline(time.Now().Add(5 * time.Second))
+    serverSide.SetDeadline(time.Now().Add(5 * time.Second))
+    return newConn(clientSide, bufio.NewReader(clientSide), true), newConn(serverSide, bufio.NewReader(serverSide), false)
+}
+
+// rawFrame builds a final frame, masked like a client's if mask is set
+func rawFrame(opcode byte, payload []byte, mask bool) []byte {
+    frame := []byte{0x80 | opcode}
+    maskBit := byte(0)
+    if mask {
+        maskBit = 0x80
+    }
+    switch {
+    case len(payload) < 126:
+        frame = append(frame, maskBit|byte(len(payload)))
+    case len(payload) <= 0xFFFF:
+        frame = append(frame, maskBit|126)
+        frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+    default:
+        frame = append(frame, maskBit|127)
+        frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+    }
+    if !mask {
+        return append(frame, payload...)
+    }
+    key := []byte{0x12, 0x34, 0x56, 0x78}
+    frame = append(frame, key...)
+    for i, b := range payload {
+        frame = append(frame, b^key[i&3])
+    }
+    return frame
+}
+
+// readRaw reads one frame from conn without a Conn, returning its opcode,
+// whether it was masked and its unmasked payload
+func readRaw(t *testing.T, conn net.Conn) (byte, bool, []byte) {
+    t.Helper()
+    reader := bufio.NewReader(conn)
+    var header [2]byte
+    if _, err := io.ReadFull(reader, header[:]); err != nil {
+        t.Fatal(err)
+    }
+    length := uint64(header[1] & 0x7F)
+    switch length {
+    case 126:
+        var ext [2]byte
+        io.ReadFull(reader, ext[:])
+        length = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        io.ReadFull(reader, ext[:])
+        length = binary.BigEndian.Uint64(ext[:])
+    }
+    masked := header[1]&0x80 != 0
+    var key [4]byte
+    if masked {
+        io.ReadFull(reader, key[:])
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(reader, payload); err != nil {
+        t.Fatal(err)
+    }
+    if masked {
+        for i := range payload {
+            payload[i] ^= key[i&3]
+        }
+    }
+    return header[0] & 0x0F, masked, payload
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+    // Sizes on both sides of the 16 and 64 bit extended lengths
+    for _, size := range []int{0, 1, 125, 126, 65535, 65536, 200000} {
+        client, server := pipe(t)
+        message := bytes.Repeat([]byte{0xa5}, size)
+        for _, ends := range [][2]*Conn{{client, server}, {server, client}} {
+            go ends[0].Write(message)
+            got := make([]byte, size)
+            if _, err := io.ReadFull(ends[1], got); err != nil || !bytes.Equal(got, message) {
+                t.Fatalf("%d byte message came back as %d bytes, %v", size, len(got), err)
+            }
+        }
+    }
+}
+
+func TestMasking(t *testing.T) {
+    clientSide, peer := net.Pipe()
+    defer peer.Close()
+    client := newConn(clientSide, bufio.NewReader(clientSide), true)
+    go client.Write([]byte("hello"))
+    if opcode, masked, payload := readRaw(t, peer); opcode != opBinary || !masked || string(payload) != "hello" {
+        t.Fatalf("client sent opcode %d, masked %v, %q", opcode, masked, payload)
+    }
+
+    serverSide, peer := net.Pipe()
+    defer peer.Close()
+    server := newConn(serverSide, bufio.NewReader(serverSide), false)
+    go server.Write([]byte("hello"))
+    if _, masked, _ := readRaw(t, peer); masked {
+        t.Fatal("server masked its frame")
+    }
+
+    // Each side refuses frames masked the wrong way
+    for _, isClient := range []bool{true, false} {
+        local, peer := net.Pipe()
+        conn := newConn(local, bufio.NewReader(local), isClient)
+        go peer.Write(rawFrame(opBinary, []byte("hello"), isClient))
+        if _, err := conn.Read(make([]byte, 5)); err == nil {
+            t.Errorf("client %v accepted a wrongly masked frame", isClient)
+        }
+        peer.Close()
+    }
+}
+
+func TestPingIsAnsweredWhileReading(t *testing.T) {
+    serverSide, peer := net.Pipe()
+    defer peer.Close()
+    server := newConn(serverSide, bufio.NewReader(serverSide), false)
+
+    go func() {
+        peer.Write(rawFrame(opPing, []byte("are you there"), true))
+        peer.Write(rawFrame(opBinary, []byte("data"), true))
+    }()
+    read := make(chan string, 1)
+    go func() {
+        buffer := make([]byte, 4)
+        n, _ := io.ReadFull(server, buffer)
+        read <- string(buffer[:n])
+    }()
+
+    if opcode, _, payload := readRaw(t, peer); opcode != opPong || string(payload) != "are you there" {
+        t.Fatalf("got opcode %d with %q, want a pong echoing the ping", opcode, payload)
+    }
+    if got := <-read; got != "data" {
+        t.Errorf("read %q after the ping, want data", got)
+    }
+}
+
+func TestCloseIsEchoed(t *testing.T) {
+    serverSide, peer := net.Pipe()
+    defer peer.Close()
+    server := newConn(serverSide, bufio.NewReader(serverSide), false)
+
+    status := []byte{0x03, 0xE9} // 1001, going away
+    go peer.Write(rawFrame(opClose, status, true))
+    readErr := make(chan error, 1)
+    go func() {
+        _, err := server.Read(make([]byte, 1))
+        readErr <- err
+    }()
+
+    if opcode, _, payload := readRaw(t, peer); opcode != opClose || !bytes.Equal(payload, status) {
+        t.Fatalf("got opcode %d with %x, want the close echoed", opcode, payload)
+    }
+    if err := <-readErr; err != io.EOF {
+        t.Errorf("Read after close returned %v, want EOF", err)
+    }
+}
+
+func TestOversizedFramesAreRefused(t *testing.T) {
+    tests := map[string][]byte{
+        "data":     binary.BigEndian.AppendUint64([]byte{0x80 | opBinary, 0x80 | 127}, maxFrameSize+1),
+        "negative": binary.BigEndian.AppendUint64([]byte{0x80 | opBinary, 0x80 | 127}, 1<<63),
+        "control":  rawFrame(opPing, bytes.Repeat([]byte("x"), 126), true),
+    }
+    for name, frame := range tests {
+        serverSide, peer := net.Pipe()
+        server := newConn(serverSide, bufio.NewReader(serverSide), false)
+        go peer.Write(frame)
+        _, err := server.Read(make([]byte, 1))
+        if err == nil || !strings.Contains(err.Error(), "too large") {
+            t.Errorf("%s: Read returned %v, want a too large error", name, err)
+        }
+        if errors.Is(err, io.EOF) {
+            t.Errorf("%s: refused frame looked like a clean close", name)
+        }
+        peer.Close()
+    }
+}
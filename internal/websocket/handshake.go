@@ -0,0 +1,174 @@
+package websocket
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/tls"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// acceptGUID is the fixed suffix of the Sec-WebSocket-Accept computation
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// acceptKey derives Sec-WebSocket-Accept from Sec-WebSocket-Key
+func acceptKey(key string) string {
+    hash := sha1.Sum([]byte(key + acceptGUID))
+    return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// headerContains reports whether a comma-separated header has token
+func headerContains(header http.Header, name, token string) bool {
+    for _, value := range header.Values(name) {
+        for _, part := range strings.Split(value, ",") {
+            if strings.EqualFold(strings.TrimSpace(part), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// validKey reports whether key is a base64 encoded 16 byte nonce
+func validKey(key string) bool {
+    nonce, err := base64.StdEncoding.DecodeString(key)
+    return err == nil && len(nonce) == 16
+}
+
+// Upgrade turns an HTTP request into a server side WebSocket connection
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if r.Method != http.MethodGet ||
+        !headerContains(r.Header, "Connection", "upgrade") ||
+        !headerContains(r.Header, "Upgrade", "websocket") ||
+        r.Header.Get("Sec-WebSocket-Version") != "13" || !validKey(key) {
+        w.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+        return nil, errors.New("not a websocket upgrade request")
+    }
+
+    hijacker, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return nil, errors.New("connection does not support hijacking")
+    }
+    conn, buffered, err := hijacker.Hijack()
+    if err != nil {
+        return nil, err
+    }
+
+    response := "HTTP/1.1 101 Switching Protocols\r\n" +
+        "Upgrade: websocket\r\n" +
+        "Connection: Upgrade\r\n" +
+        "Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+    if _, err := conn.Write([]byte(response)); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    return newConn(conn, buffered.Reader, false), nil
+}
+
+// Dial opens a client WebSocket connection to a ws:// or wss:// URL.
+// dialContext dials the TCP connection, so callers can go through proxies,
+// and tlsConfig is used for wss:// URLs.
+func Dial(ctx context.Context, rawURL string, dialContext func(ctx context.Context, network, addr string) (net.Conn, error), tlsConfig *tls.Config) (*Conn, error) {
+    target, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+
+    addr := target.Host
+    switch target.Scheme {
+    case "ws":
+        if target.Port() == "" {
+            addr = net.JoinHostPort(target.Hostname(), "80")
+        }
+    case "wss":
+        if target.Port() == "" {
+            addr = net.JoinHostPort(target.Hostname(), "443")
+        }
+    default:
+        return nil, fmt.Errorf("unsupported websocket scheme %q", target.Scheme)
+    }
+
+    conn, err := dialContext(ctx, "tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+
+    if target.Scheme == "wss" {
+        config := &tls.Config{}
+        if tlsConfig != nil {
+            config = tlsConfig.Clone()
+        }
+        if config.ServerName == "" {
+            config.ServerName = target.Hostname()
+        }
+        tlsConn := tls.Client(conn, config)
+        if err := tlsConn.HandshakeContext(ctx); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("TLS handshake failed: %w", err)
+        }
+        conn = tlsConn
+    }
+
+    wsConn, err := handshake(ctx, conn, target)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return wsConn, nil
+}
+
+// handshake performs the client side of the opening handshake
+func handshake(ctx context.Context, conn net.Conn, target *url.URL) (*Conn, error) {
+    nonce := make([]byte, 16)
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    key := base64.StdEncoding.EncodeToString(nonce)
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.URL.Scheme = strings.Replace(req.URL.Scheme, "ws", "http", 1)
+    req.Header.Set("Upgrade", "websocket")
+    req.Header.Set("Connection", "Upgrade")
+    req.Header.Set("Sec-WebSocket-Key", key)
+    req.Header.Set("Sec-WebSocket-Version", "13")
+
+    // Don't hang forever on a server that never answers
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+        defer conn.SetDeadline(time.Time{})
+    }
+
+    if err := req.Write(conn); err != nil {
+        return nil, err
+    }
+
+    reader := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(reader, req)
+    if err != nil {
+        return nil, fmt.Errorf("invalid websocket handshake response: %w", err)
+    }
+    if resp.StatusCode != http.StatusSwitchingProtocols {
+        resp.Body.Close()
+        return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+    }
+    if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+        return nil, errors.New("websocket handshake failed: invalid accept key")
+    }
+
+    return newConn(conn, reader, true), nil
+}
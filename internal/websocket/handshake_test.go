@@ -0,0 +1,97 @@
+package websocket
+
+import (
+    "bufio"
+    "context"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestAcceptKey(t *testing.T) {
+    // The example from RFC 6455, section 1.3
+    if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+        t.Errorf("acceptKey = %q", got)
+    }
+}
+
+func TestHandshake(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := Upgrade(w, r)
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        io.Copy(conn, conn)
+    }))
+    defer server.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    conn, err := Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), (&net.Dialer{}).DialContext, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    conn.Write([]byte("echo"))
+    got := make([]byte, 4)
+    if _, err := io.ReadFull(conn, got); err != nil || string(got) != "echo" {
+        t.Errorf("echo came back as %q, %v", got, err)
+    }
+}
+
+func TestUpgradeRefusesBadKeys(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if conn, err := Upgrade(w, r); err == nil {
+            conn.Close()
+        }
+    }))
+    defer server.Close()
+
+    for _, key := range []string{"", "not base64!", "c2hvcnQ="} {
+        req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+        req.Header.Set("Upgrade", "websocket")
+        req.Header.Set("Connection", "Upgrade")
+        req.Header.Set("Sec-WebSocket-Version", "13")
+        req.Header.Set("Sec-WebSocket-Key", key)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusUpgradeRequired {
+            t.Errorf("key %q got %s, want %d", key, resp.Status, http.StatusUpgradeRequired)
+        }
+    }
+}
+
+func TestDialRefusesWrongAcceptKey(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    go func() {
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        http.ReadRequest(bufio.NewReader(conn))
+        conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+            "Upgrade: websocket\r\n" +
+            "Connection: Upgrade\r\n" +
+            "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"))
+    }()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if _, err := Dial(ctx, "ws://"+listener.Addr().String()+"/", (&net.Dialer{}).DialContext, nil); err == nil {
+        t.Fatal("handshake with the wrong accept key succeeded")
+    }
+}
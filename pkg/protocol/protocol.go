@@ -1,32 +1,212 @@
 package protocol
 
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+
+    "github.com/euphoricair7/tun/internal/bufpool"
+)
+
 // Message types for client-server communication
 const (
-    MessageTypeConnect    = "connect"
-    MessageTypeData       = "data"
-    MessageTypeDisconnect = "disconnect"
-    MessageTypePing       = "ping"
-    MessageTypePong       = "pong"
+    MessageTypeConnect       = "connect"
+    MessageTypeConnectResult = "connect_result" // whether the client reached its local service, see Error
+    MessageTypeData          = "data"
+    MessageTypeDisconnect    = "disconnect"
+    MessageTypeCloseWrite    = "close_write" // sender finished writing, the other direction keeps flowing
+    MessageTypePing          = "ping"
+    MessageTypePong          = "pong"
+    MessageTypeDraining      = "draining"
+    MessageTypeOpen          = "open"
+    MessageTypeOpenResult    = "open_result"
+    MessageTypeSuspended     = "suspended"
+    MessageTypeHealth        = "health" // client's local service went down or came back, Error says why it is down
+    MessageTypePause         = "pause"  // relay asks the client to stop reading a user's local service, the user fell behind
+    MessageTypeResume        = "resume" // the user caught up, the client may read its local service again
+)
+
+// Tunnel protocols a client can register
+const (
+    ProtocolTCP  = "tcp"
+    ProtocolHTTP = "http"
 )
 
+// Data read from a connection at once, and so the most one data frame
+// carries. Larger reads mean fewer frames to encode for bulk transfers.
+const (
+    DefaultReadSize = 32 << 10
+    MaxReadSize     = 1 << 20
+)
+
+// Compression algorithms for data frames
+const (
+    CompressionDeflate = "deflate"
+)
+
+// Strategies for spreading new users over the clients of a pool
+const (
+    BalanceRoundRobin = "round_robin"
+    BalanceLeastConn  = "least_conn"
+    BalanceRandom     = "random"
+)
+
+// Header rule actions for HTTP tunnels
+const (
+    HeaderActionAdd    = "add"
+    HeaderActionSet    = "set"
+    HeaderActionRemove = "remove"
+)
+
+// HeaderRule adds, replaces or removes a header on requests or responses
+// passing through an HTTP tunnel
+type HeaderRule struct {
+    Action string `json:"action"`
+    Name   string `json:"name"`
+    Value  string `json:"value,omitempty"`
+}
+
 // RegistrationRequest represents the initial request from client to relay
 type RegistrationRequest struct {
     LocalHost string `json:"local_host"`
     LocalPort int    `json:"local_port"`
+    Protocol  string `json:"protocol,omitempty"` // ProtocolTCP when empty
+
+    // Token identifies the account on relays that have accounts
+    Token string `json:"token,omitempty"`
+
+    // Port asks for a specific public port instead of any free one, and
+    // Hostname for an HTTP tunnel to be served on the relay's shared HTTP
+    // address under that name
+    Port     int    `json:"port,omitempty"`
+    Hostname string `json:"hostname,omitempty"`
+
+    // Reserve keeps the tunnel's port and hostname for the account after it
+    // disconnects, so nobody else is ever given them
+    Reserve bool `json:"reserve,omitempty"`
+
+    // Release gives up the account's reservations of Port and Hostname, so
+    // they are free for anyone once the tunnel disconnects
+    Release bool `json:"release,omitempty"`
+
+    // Source addresses allowed to reach the tunnel, as CIDRs or IPs. Deny
+    // entries win, an empty allow list allows everyone.
+    AllowCIDRs []string `json:"allow_cidrs,omitempty"`
+    DenyCIDRs  []string `json:"deny_cidrs,omitempty"`
+
+    // HTTP tunnel options. HostHeader is sent to the local service instead
+    // of the public Host, "rewrite" means the local service address.
+    HostHeader      string       `json:"host_header,omitempty"`
+    RequestHeaders  []HeaderRule `json:"request_headers,omitempty"`
+    ResponseHeaders []HeaderRule `json:"response_headers,omitempty"`
+
+    // Credentials the relay requires before passing requests to an HTTP
+    // tunnel, "user:password" entries and/or a static bearer token
+    BasicAuth   []string `json:"basic_auth,omitempty"`
+    BearerToken string   `json:"bearer_token,omitempty"`
+
+    // Users who may reach an HTTP tunnel after logging in with the relay's
+    // OIDC provider, as email addresses or "@domain" entries
+    OIDCAllow []string `json:"oidc_allow,omitempty"`
+
+    // Limits on public users, zero leaves the relay's limits in place.
+    // MaxConns caps concurrent connections, ConnRate is new connections per
+    // second per source IP and RequestRate requests per second (HTTP only).
+    MaxConns    int     `json:"max_conns,omitempty"`
+    ConnRate    float64 `json:"conn_rate,omitempty"`
+    RequestRate float64 `json:"request_rate,omitempty"`
+
+    // Bandwidth limits in bytes per second, inbound from users towards the
+    // client and outbound from the client towards users
+    InboundRate  int64 `json:"inbound_rate,omitempty"`
+    OutboundRate int64 `json:"outbound_rate,omitempty"`
+
+    // Compression asks for the data frames of the tunnel to be compressed
+    // with this algorithm. Frames shorter than CompressionThreshold bytes
+    // are sent as is, zero leaves the threshold to the relay.
+    Compression          string `json:"compression,omitempty"`
+    CompressionThreshold int    `json:"compression_threshold,omitempty"`
+
+    // Pool joins the clients of an account registering the same pool name
+    // into one tunnel, new users going to one of them as Balance decides
+    // (BalanceRoundRobin when empty). The tunnel keeps the options of the
+    // client that created it, and lives until its last client leaves.
+    // Clients join only with the PoolSecret the first one registered, which
+    // relays without accounts require since anyone could join otherwise.
+    Pool       string `json:"pool,omitempty"`
+    Balance    string `json:"balance,omitempty"`
+    PoolSecret string `json:"pool_secret,omitempty"`
 }
 
 // RegistrationResponse represents the relay's response to a registration
 type RegistrationResponse struct {
     Success    bool   `json:"success"`
     PublicPort int    `json:"public_port,omitempty"`
+    Hostname   string `json:"hostname,omitempty"`
     Error      string `json:"error,omitempty"`
+
+    // Compression is the algorithm the relay agreed to, empty for none
+    Compression string `json:"compression,omitempty"`
 }
 
 // ClientMessage represents messages exchanged between client and relay
 type ClientMessage struct {
-    Type   string `json:"type"`
-    UserID string `json:"user_id,omitempty"`
-    Data   []byte `json:"data,omitempty"`
+    Type   string  `json:"type"`
+    UserID string  `json:"user_id,omitempty"`
+    Data   Payload `json:"data,omitempty"`
+    Target string  `json:"target,omitempty"` // host:port the relay should dial for an open request
+    Error  string  `json:"error,omitempty"`
+
+    // Original addresses of a public user connection, sent with connect
+    SourceAddr string `json:"source_addr,omitempty"`
+    DestAddr   string `json:"dest_addr,omitempty"`
+
+    // Compressed marks Data as compressed with the tunnel's algorithm
+    Compressed bool `json:"compressed,omitempty"`
+}
+
+// Payload is the data of a message, base64 encoded on the wire like any
+// []byte. Decoding takes its buffer from a pool, Release hands it back once
+// the data has been passed on.
+type Payload []byte
+
+// UnmarshalJSON decodes a base64 string into a pooled buffer
+func (p *Payload) UnmarshalJSON(data []byte) error {
+    if string(data) == "null" {
+        *p = nil
+        return nil
+    }
+    if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+        return errors.New("payload is not a string")
+    }
+    encoded := data[1 : len(data)-1]
+    if len(encoded) == 0 {
+        *p = Payload{}
+        return nil
+    }
+    if bytes.IndexByte(encoded, '\\') >= 0 {
+        // Escaped characters, rare enough to leave to encoding/json
+        var decoded []byte
+        err := json.Unmarshal(data, &decoded)
+        *p = decoded
+        return err
+    }
+
+    buffer := bufpool.Get(base64.StdEncoding.DecodedLen(len(encoded)))
+    n, err := base64.StdEncoding.Decode(buffer, encoded)
+    if err != nil {
+        bufpool.Put(buffer)
+        return err
+    }
+    *p = buffer[:n]
+    return nil
+}
+
+// Release hands the payload's buffer back for reuse. The payload must not
+// be used afterwards.
+func (p Payload) Release() {
+    bufpool.Put(p)
 }
 
 
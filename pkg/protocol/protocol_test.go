@@ -0,0 +1,99 @@
+package protocol
+
+import (
+    "bytes"
+    "encoding/json"
+    "testing"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+    for _, size := range []int{0, 1, 2, 3, 4, 511, 512, 513, DefaultReadSize, MaxReadSize, MaxReadSize + 1} {
+        data := make([]byte, size)
+        for i := range data {
+            data[i] = byte(i * 7)
+        }
+        encoded, err := json.Marshal(ClientMessage{Type: MessageTypeData, Data: data})
+        if err != nil {
+            t.Fatalf("size %d: %v", size, err)
+        }
+
+        var msg ClientMessage
+        if err := json.Unmarshal(encoded, &msg); err != nil {
+            t.Fatalf("size %d: %v", size, err)
+        }
+        if !bytes.Equal(msg.Data, data) {
+            t.Errorf("size %d: payload came back as %d different bytes", size, len(msg.Data))
+        }
+        msg.Data.Release()
+    }
+}
+
+func TestPayloadUnmarshal(t *testing.T) {
+    tests := []struct {
+        name    string
+        line    string
+        want    []byte
+        wantErr bool
+    }{
+        {"empty", `{"type":"data","data":""}`, []byte{}, false},
+        {"one byte", `{"type":"data","data":"eA=="}`, []byte("x"), false},
+        {"null", `{"type":"data","data":null}`, nil, false},
+        {"missing", `{"type":"data"}`, nil, false},
+        {"escaped", `{"type":"data","data":"\/w=="}`, []byte{0xff}, false},
+        {"not base64", `{"type":"data","data":"!!!!"}`, nil, true},
+        {"not a string", `{"type":"data","data":42}`, nil, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var msg ClientMessage
+            err := json.Unmarshal([]byte(tt.line), &msg)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+            }
+            if tt.wantErr {
+                return
+            }
+            if !bytes.Equal(msg.Data, tt.want) || (msg.Data == nil) != (tt.want == nil) {
+                t.Errorf("data = %#v, want %#v", msg.Data, tt.want)
+            }
+            msg.Data.Release()
+        })
+    }
+}
+
+// BenchmarkPayloadRoundTrip compares decoding data frames into a plain
+// []byte, as the data path did before, with pooled Payloads
+func BenchmarkPayloadRoundTrip(b *testing.B) {
+    data := bytes.Repeat([]byte{0xa5}, DefaultReadSize)
+    encoded, err := json.Marshal(ClientMessage{Type: MessageTypeData, UserID: "user-1", Data: data})
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    b.Run("bytes", func(b *testing.B) {
+        var msg struct {
+            Type   string `json:"type"`
+            UserID string `json:"user_id,omitempty"`
+            Data   []byte `json:"data,omitempty"`
+        }
+        b.ReportAllocs()
+        b.SetBytes(int64(len(data)))
+        for i := 0; i < b.N; i++ {
+            msg.Data = nil
+            if err := json.Unmarshal(encoded, &msg); err != nil {
+                b.Fatal(err)
+            }
+        }
+    })
+    b.Run("payload", func(b *testing.B) {
+        b.ReportAllocs()
+        b.SetBytes(int64(len(data)))
+        for i := 0; i < b.N; i++ {
+            var msg ClientMessage
+            if err := json.Unmarshal(encoded, &msg); err != nil {
+                b.Fatal(err)
+            }
+            msg.Data.Release()
+        }
+    })
+}